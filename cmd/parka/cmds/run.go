@@ -0,0 +1,280 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/parka/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var RunCmd = &cobra.Command{
+	Use:   "run --server URL <parents...> <name> [flags]",
+	Short: "Run a command on a server",
+	Long: `Run a command on a server, passing the parameters as flags and arguments like
+for a local command. The rows returned by the server are rendered locally, so all
+the usual output flags (--output, --fields, ...) can be used.
+
+Files given to parameters loaded from a file are uploaded to the server.`,
+	// the flags depend on the remote command, they are parsed once it has been looked up
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		server, args, err := extractServerFlag(args)
+		cobra.CheckErr(err)
+
+		if server == "" {
+			if !isHelpRequested(args) {
+				fmt.Fprintln(os.Stderr, "Error: --server is required")
+			}
+			_ = cmd.Help()
+			return
+		}
+
+		c := client.NewClient(server)
+		descriptions, err := c.ListCommands(cmd.Context())
+		cobra.CheckErr(err)
+
+		description, rest := findRemoteCommand(descriptions, args)
+		if description == nil {
+			if !isHelpRequested(args) {
+				fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n", strings.Join(positionalArgs(args), " "))
+			}
+			fmt.Fprintln(os.Stderr, "Available commands:")
+			for _, d := range descriptions {
+				fmt.Fprintf(os.Stderr, "  %-30s %s\n", strings.ReplaceAll(d.Path(), "/", " "), d.Short)
+			}
+			if !isHelpRequested(args) {
+				os.Exit(1)
+			}
+			return
+		}
+
+		remoteCmd, err := newRemoteCobraCommand(c, description)
+		cobra.CheckErr(err)
+		remoteCmd.SetArgs(rest)
+		err = remoteCmd.Execute()
+		if err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+// extractServerFlag removes --server from args, since flag parsing is disabled for RunCmd.
+func extractServerFlag(args []string) (string, []string, error) {
+	server := ""
+	rest := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			rest = append(rest, args[i:]...)
+			return server, rest, nil
+		case arg == "--server":
+			if i+1 >= len(args) {
+				return "", nil, errors.New("flag needs an argument: --server")
+			}
+			server = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--server="):
+			server = strings.TrimPrefix(arg, "--server=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return strings.TrimSuffix(server, "/"), rest, nil
+}
+
+func isHelpRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "-h" || arg == "--help" {
+			return true
+		}
+	}
+	return false
+}
+
+// positionalArgs returns the arguments before the first flag, which name the command to run.
+func positionalArgs(args []string) []string {
+	ret := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			break
+		}
+		ret = append(ret, arg)
+	}
+	return ret
+}
+
+// findRemoteCommand returns the command whose parents and name are the longest prefix of
+// the positional arguments, and the remaining arguments.
+func findRemoteCommand(
+	descriptions []*client.CommandDescription,
+	args []string,
+) (*client.CommandDescription, []string) {
+	positional := positionalArgs(args)
+
+	var ret *client.CommandDescription
+	for _, d := range descriptions {
+		path := strings.Split(d.Path(), "/")
+		if len(path) > len(positional) || (ret != nil && len(path) <= strings.Count(ret.Path(), "/")+1) {
+			continue
+		}
+		matches := true
+		for i, p := range path {
+			if positional[i] != p {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ret = d
+		}
+	}
+	if ret == nil {
+		return nil, nil
+	}
+	return ret, args[strings.Count(ret.Path(), "/")+1:]
+}
+
+// newRemoteCobraCommand creates a cobra command with the flags and arguments of the remote
+// command, which runs it on server.
+func newRemoteCobraCommand(c *client.Client, description *client.CommandDescription) (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:          description.Name,
+		Short:        description.Short,
+		Long:         description.Long,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRemoteCommand(cmd, args, c, description)
+		},
+	}
+
+	err := cli.AddGlazedProcessorFlagsToCobraCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// the output flags are handled locally, the remote flags have to make room for them
+	flags := []*parameters.ParameterDefinition{}
+	for _, flag := range description.Flags {
+		flagName := strings.ReplaceAll(flag.Name, "_", "-")
+		if cmd.PersistentFlags().Lookup(flagName) != nil {
+			return nil, errors.Errorf("flag %s of command %s conflicts with the output flags", flagName, description.Name)
+		}
+		if flag.ShortFlag != "" && cmd.PersistentFlags().ShorthandLookup(flag.ShortFlag) != nil {
+			flag_ := *flag
+			flag_.ShortFlag = ""
+			flag = &flag_
+		}
+		flags = append(flags, flag)
+	}
+
+	err = parameters.AddFlagsToCobraCommand(cmd.Flags(), flags, "")
+	if err != nil {
+		return nil, err
+	}
+	err = parameters.AddArgumentsToCobraCommand(cmd, description.Arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+func runRemoteCommand(cmd *cobra.Command, args []string, c *client.Client, description *client.CommandDescription) error {
+	// only the parameters given on the command line are sent, the server applies the defaults
+	flags, err := parameters.GatherFlagsFromCobraCommand(cmd, description.Flags, true, "")
+	if err != nil {
+		return err
+	}
+	arguments, err := parameters.GatherArguments(args, description.Arguments, true)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	for k, v := range flags {
+		values[k] = v
+	}
+	for k, v := range arguments {
+		values[k] = v
+	}
+
+	gp, of, err := cli.CreateGlazedProcessorFromCobra(cmd)
+	if err != nil {
+		return err
+	}
+
+	// files are uploaded with the content that was already loaded, which makes it possible
+	// to read them from stdin
+	for _, p := range description.Flags {
+		v, ok := values[p.Name]
+		if !ok || !isFileParameter(p) {
+			continue
+		}
+		fileName, err := cmd.Flags().GetString(strings.ReplaceAll(p.Name, "_", "-"))
+		if err != nil {
+			return err
+		}
+		fileName = filepath.Base(fileName)
+		if fileName == "-" {
+			fileName = "stdin"
+		}
+
+		content, ok := v.(string)
+		if !ok {
+			// objects and lists are uploaded as JSON
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			content = string(b)
+			fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".json"
+		}
+		values[p.Name] = &client.File{Name: fileName, Content: strings.NewReader(content)}
+	}
+
+	rows, err := c.Run(cmd.Context(), description.Path(), values)
+	if err != nil {
+		return errors.Wrapf(err, "%s failed", description.Name)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		err = gp.ProcessInputObject(rows.Row())
+		if err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	s, err := of.Output()
+	if err != nil {
+		return err
+	}
+	fmt.Print(s)
+
+	return nil
+}
+
+// isFileParameter returns true for the parameters whose file is uploaded with the request,
+// instead of sending the loaded value as JSON.
+func isFileParameter(p *parameters.ParameterDefinition) bool {
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeStringFromFile,
+		parameters.ParameterTypeStringListFromFile,
+		parameters.ParameterTypeObjectFromFile,
+		parameters.ParameterTypeObjectListFromFile:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,100 @@
+package cmds
+
+import (
+	"github.com/go-go-golems/parka/pkg/client"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractServerFlag(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		server string
+		rest   []string
+		err    bool
+	}{
+		{name: "none", args: []string{"echo"}, rest: []string{"echo"}},
+		{name: "empty", args: []string{}, rest: []string{}},
+		{name: "separate", args: []string{"--server", "http://localhost:8080/", "echo"}, server: "http://localhost:8080", rest: []string{"echo"}},
+		{
+			name:   "inline",
+			args:   []string{"reports", "daily", "--server=http://localhost:8080", "--limit", "3"},
+			server: "http://localhost:8080",
+			rest:   []string{"reports", "daily", "--limit", "3"},
+		},
+		{name: "last one wins", args: []string{"--server", "http://a", "--server=http://b"}, server: "http://b", rest: []string{}},
+		{
+			// the arguments after -- are passed to the command as they are
+			name:   "end of flags",
+			args:   []string{"--server", "http://a", "echo", "--", "--server", "http://b"},
+			server: "http://a",
+			rest:   []string{"echo", "--", "--server", "http://b"},
+		},
+		{name: "missing value", args: []string{"echo", "--server"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, rest, err := extractServerFlag(tt.args)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server != tt.server || !reflect.DeepEqual(rest, tt.rest) {
+				t.Errorf("expected %q and %q, got %q and %q", tt.server, tt.rest, server, rest)
+			}
+		})
+	}
+}
+
+func TestFindRemoteCommand(t *testing.T) {
+	descriptions := []*client.CommandDescription{}
+	for _, path := range []string{"echo", "reports/daily/full", "reports", "reports/daily"} {
+		segments := strings.Split(path, "/")
+		descriptions = append(descriptions, &client.CommandDescription{
+			Name:    segments[len(segments)-1],
+			Parents: segments[:len(segments)-1],
+		})
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		path string
+		rest []string
+	}{
+		{name: "single", args: []string{"echo"}, path: "echo", rest: []string{}},
+		{name: "flags", args: []string{"echo", "--name", "alice"}, path: "echo", rest: []string{"--name", "alice"}},
+		{name: "parents", args: []string{"reports", "daily", "--limit", "3"}, path: "reports/daily", rest: []string{"--limit", "3"}},
+		{name: "longest", args: []string{"reports", "daily", "full"}, path: "reports/daily/full", rest: []string{}},
+		{name: "arguments", args: []string{"reports", "daily", "2023-01-02"}, path: "reports/daily", rest: []string{"2023-01-02"}},
+		{name: "parent", args: []string{"reports", "weekly"}, path: "reports", rest: []string{"weekly"}},
+		// flag values don't name commands
+		{name: "flag value", args: []string{"--output", "reports", "daily"}},
+		{name: "unknown", args: []string{"daily"}},
+		{name: "empty", args: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, rest := findRemoteCommand(descriptions, tt.args)
+			if tt.path == "" {
+				if d != nil {
+					t.Errorf("expected no command, got %s", d.Path())
+				}
+				return
+			}
+			if d == nil {
+				t.Fatalf("expected %s, got no command", tt.path)
+			}
+			if d.Path() != tt.path || !reflect.DeepEqual(rest, tt.rest) {
+				t.Errorf("expected %s with %q, got %s with %q", tt.path, tt.rest, d.Path(), rest)
+			}
+		})
+	}
+}
@@ -1,15 +1,18 @@
 package cmds
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/go-go-golems/glazed/pkg/cli"
 	"github.com/go-go-golems/parka/pkg"
+	"github.com/go-go-golems/parka/pkg/client"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
-	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var ServeCmd = &cobra.Command{
@@ -22,7 +25,28 @@ var ServeCmd = &cobra.Command{
 
 		serverOptions := []pkg.ServerOption{}
 
-		serverOptions = append(serverOptions, pkg.WithCommands(NewExampleCommand()))
+		commandsDirs, err := cmd.Flags().GetStringSlice("commands-dir")
+		cobra.CheckErr(err)
+		upstreamFlags, err := cmd.Flags().GetStringSlice("upstream")
+		cobra.CheckErr(err)
+		upstreams := []*pkg.Upstream{}
+		for _, u := range upstreamFlags {
+			upstream, err := pkg.ParseUpstream(u)
+			cobra.CheckErr(err)
+			upstreams = append(upstreams, upstream)
+		}
+
+		if len(commandsDirs) == 0 && len(upstreams) == 0 {
+			serverOptions = append(serverOptions, pkg.WithCommands(NewExampleCommand()))
+		}
+		loadedCommands := map[string][]pkg.ParkaCommand{}
+		for _, dir := range commandsDirs {
+			commands, err := pkg.LoadCommandsFromDirectory(dir)
+			cobra.CheckErr(err)
+			log.Info().Str("dir", dir).Int("commands", len(commands)).Msg("Loaded commands")
+			serverOptions = append(serverOptions, pkg.WithCommands(commands...))
+			loadedCommands[dir] = commands
+		}
 
 		dev, _ := cmd.Flags().GetBool("dev")
 		templateDir, err := cmd.Flags().GetString("template-dir")
@@ -51,13 +75,195 @@ var ServeCmd = &cobra.Command{
 			}
 		}
 
-		s, _ := pkg.NewServer(serverOptions...)
+		jobsDir, err := cmd.Flags().GetString("jobs-dir")
+		cobra.CheckErr(err)
+		if jobsDir != "" {
+			store, err := pkg.NewFileJobStore(jobsDir)
+			cobra.CheckErr(err)
+			serverOptions = append(serverOptions, pkg.WithJobStore(store))
+		}
+		maxJobs, err := cmd.Flags().GetInt("max-jobs")
+		cobra.CheckErr(err)
+		jobRetention, err := cmd.Flags().GetDuration("job-retention")
+		cobra.CheckErr(err)
+		serverOptions = append(serverOptions,
+			pkg.WithMaxConcurrentJobs(maxJobs),
+			pkg.WithJobRetention(jobRetention),
+		)
+
+		maxRequestSize, err := cmd.Flags().GetInt64("max-request-size")
+		cobra.CheckErr(err)
+		maxFileSize, err := cmd.Flags().GetInt64("max-file-size")
+		cobra.CheckErr(err)
+		maxUploadMemory, err := cmd.Flags().GetInt64("max-upload-memory")
+		cobra.CheckErr(err)
+		serverOptions = append(serverOptions, pkg.WithUploadLimits(pkg.UploadLimits{
+			MaxRequestSize: maxRequestSize,
+			MaxFileSize:    maxFileSize,
+			MaxMemory:      maxUploadMemory,
+		}))
+
+		fileDirs, err := cmd.Flags().GetStringSlice("file-dir")
+		cobra.CheckErr(err)
+		fileURLs, err := cmd.Flags().GetStringSlice("file-url")
+		cobra.CheckErr(err)
+		serverOptions = append(serverOptions,
+			pkg.WithFileReferenceDirs(fileDirs...),
+			pkg.WithFileReferenceURLs(fileURLs...),
+		)
+
+		cacheTTLs, err := cmd.Flags().GetStringSlice("cache-ttl")
+		cobra.CheckErr(err)
+		for _, rule := range cacheTTLs {
+			pattern, ttl, ok := strings.Cut(rule, "=")
+			if !ok {
+				cobra.CheckErr(fmt.Errorf("invalid cache TTL %s, expected pattern=duration", rule))
+			}
+			d, err := time.ParseDuration(ttl)
+			cobra.CheckErr(err)
+			serverOptions = append(serverOptions, pkg.WithCacheTTL(pattern, d))
+		}
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		cobra.CheckErr(err)
+		cacheSize, err := cmd.Flags().GetInt("cache-size")
+		cobra.CheckErr(err)
+		if cacheDir != "" {
+			cache, err := pkg.NewDiskCache(cacheDir)
+			cobra.CheckErr(err)
+			serverOptions = append(serverOptions, pkg.WithCache(cache))
+		} else if len(cacheTTLs) > 0 {
+			serverOptions = append(serverOptions, pkg.WithCache(pkg.NewMemoryCache(cacheSize)))
+		}
+
+		authenticators, err := createAuthenticators(cmd)
+		cobra.CheckErr(err)
+		if len(authenticators) > 0 {
+			serverOptions = append(serverOptions, pkg.WithAuthenticator(authenticators...))
+		}
+
+		policiesFile, err := cmd.Flags().GetString("policies")
+		cobra.CheckErr(err)
+		if policiesFile != "" {
+			policies, err := pkg.LoadPoliciesFromFile(policiesFile)
+			cobra.CheckErr(err)
+			serverOptions = append(serverOptions, pkg.WithPolicies(policies))
+		}
+
+		limitsFile, err := cmd.Flags().GetString("limits")
+		cobra.CheckErr(err)
+		if limitsFile != "" {
+			limits, err := pkg.LoadLimitsFromFile(limitsFile)
+			cobra.CheckErr(err)
+			serverOptions = append(serverOptions, pkg.WithLimits(limits))
+		}
+		trustedProxies, err := cmd.Flags().GetStringSlice("trusted-proxies")
+		cobra.CheckErr(err)
+		serverOptions = append(serverOptions, pkg.WithTrustedProxies(trustedProxies...))
+
+		s, err := pkg.NewServer(serverOptions...)
+		cobra.CheckErr(err)
+
+		watch, err := cmd.Flags().GetBool("watch")
+		cobra.CheckErr(err)
+		if watch {
+			for dir, commands := range loadedCommands {
+				dir, commands := dir, commands
+				go func() {
+					err := s.WatchCommandsDirectory(context.Background(), dir, commands)
+					if err != nil {
+						log.Error().Err(err).Str("dir", dir).Msg("could not watch commands")
+					}
+				}()
+			}
+		}
+
+		upstreamCheckInterval, err := cmd.Flags().GetDuration("upstream-check-interval")
+		cobra.CheckErr(err)
+		for _, upstream := range upstreams {
+			go s.WatchUpstream(context.Background(), upstream, upstreamCheckInterval)
+		}
 
 		err = s.Run()
 		cobra.CheckErr(err)
 	},
 }
 
+func createAuthenticators(cmd *cobra.Command) ([]pkg.Authenticator, error) {
+	authenticators := []pkg.Authenticator{}
+
+	apiKeys := map[string]string{}
+	apiKeysFile, err := cmd.Flags().GetString("api-keys-file")
+	if err != nil {
+		return nil, err
+	}
+	if apiKeysFile != "" {
+		keys, err := pkg.LoadAPIKeysFromFile(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range keys {
+			apiKeys[k] = v
+		}
+	}
+	apiKeysEnv, err := cmd.Flags().GetString("api-keys-env")
+	if err != nil {
+		return nil, err
+	}
+	if apiKeysEnv != "" {
+		keys, err := pkg.LoadAPIKeysFromEnv(apiKeysEnv)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range keys {
+			apiKeys[k] = v
+		}
+	}
+	if len(apiKeys) > 0 {
+		authenticators = append(authenticators, pkg.NewAPIKeyAuthenticator(apiKeys))
+	}
+
+	htpasswd, err := cmd.Flags().GetString("htpasswd")
+	if err != nil {
+		return nil, err
+	}
+	if htpasswd != "" {
+		users, err := pkg.LoadBasicAuthUsersFromFile(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		authenticator, err := pkg.NewBasicAuthenticator(users)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	jwksFile, err := cmd.Flags().GetString("jwks-file")
+	if err != nil {
+		return nil, err
+	}
+	if jwksFile != "" {
+		issuer, err := cmd.Flags().GetString("jwt-issuer")
+		if err != nil {
+			return nil, err
+		}
+		audience, err := cmd.Flags().GetString("jwt-audience")
+		if err != nil {
+			return nil, err
+		}
+		authenticator, err := pkg.NewJWTAuthenticatorFromJWKSFile(jwksFile,
+			pkg.WithJWTIssuer(issuer),
+			pkg.WithJWTAudience(audience),
+		)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	return authenticators, nil
+}
+
 var LsServerCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "List a server's commands",
@@ -65,17 +271,14 @@ var LsServerCmd = &cobra.Command{
 		server, err := cmd.Flags().GetString("server")
 		cobra.CheckErr(err)
 
-		resp, err := http.Get(server + "/api/commands")
+		descriptions, err := client.NewClient(server).ListCommands(cmd.Context())
 		cobra.CheckErr(err)
-		defer resp.Body.Close()
 
-		// Read the response body
-		body, err := io.ReadAll(resp.Body)
+		// rows keep the field names of the JSON returned by the server
+		b, err := json.Marshal(descriptions)
 		cobra.CheckErr(err)
-
-		// Unmarshal the response JSON into a slice of CommandDescription structs
 		var cmds []map[string]interface{}
-		err = json.Unmarshal(body, &cmds)
+		err = json.Unmarshal(b, &cmds)
 		cobra.CheckErr(err)
 
 		gp, of, err := cli.CreateGlazedProcessorFromCobra(cmd)
@@ -96,6 +299,37 @@ func init() {
 	ServeCmd.Flags().Uint16("port", 8080, "Port to listen on")
 	ServeCmd.Flags().String("template-dir", "pkg/web/src/templates", "Directory containing templates")
 	ServeCmd.Flags().Bool("dev", false, "Enable development mode")
+	ServeCmd.Flags().StringSlice("commands-dir", []string{},
+		"Directories to load YAML commands from, instead of serving the example command")
+	ServeCmd.Flags().Bool("watch", true, "Reload the commands when the files in --commands-dir change")
+	ServeCmd.Flags().StringSlice("upstream", []string{},
+		"Parka servers whose commands are served under /api/command/<name>/, given as name=URL")
+	ServeCmd.Flags().Duration("upstream-check-interval", 10*time.Second, "How often to check that the upstreams are up")
+	ServeCmd.Flags().String("api-keys-file", "", "File with the API keys accepted in the X-API-Key header, one name:key per line")
+	ServeCmd.Flags().String("api-keys-env", "", "Environment variable with comma-separated API keys, as name:key")
+	ServeCmd.Flags().String("htpasswd", "", "htpasswd file with bcrypt hashes for HTTP Basic authentication")
+	ServeCmd.Flags().String("jwks-file", "", "JWKS file with the keys to check JWT bearer tokens against")
+	ServeCmd.Flags().String("jwt-issuer", "", "Issuer required in JWT bearer tokens")
+	ServeCmd.Flags().String("jwt-audience", "", "Audience required in JWT bearer tokens")
+	ServeCmd.Flags().String("policies", "", "YAML file with the policies deciding who may run which commands")
+	ServeCmd.Flags().String("limits", "", "YAML file with the rate limits and concurrency caps of the commands")
+	ServeCmd.Flags().StringSlice("trusted-proxies", []string{},
+		"IP addresses or CIDRs of the reverse proxies whose X-Forwarded-For header identifies clients")
+	ServeCmd.Flags().Int64("max-request-size", pkg.DefaultUploadLimits.MaxRequestSize, "Maximum size in bytes of a POST request, 0 for no limit")
+	ServeCmd.Flags().Int64("max-file-size", pkg.DefaultUploadLimits.MaxFileSize, "Maximum size in bytes of an uploaded file, 0 for no limit")
+	ServeCmd.Flags().Int64("max-upload-memory", pkg.DefaultUploadLimits.MaxMemory,
+		"Bytes of the uploaded files kept in memory, the rest is written to temporary files")
+	ServeCmd.Flags().StringSlice("file-dir", []string{},
+		"Directory whose files can be passed to file parameters as @<path>")
+	ServeCmd.Flags().StringSlice("file-url", []string{},
+		"URL prefix, such as the jobs of another parka server, whose files can be passed to file parameters as @<URL>")
+	ServeCmd.Flags().String("jobs-dir", "", "Directory to store asynchronous jobs in (default: in memory)")
+	ServeCmd.Flags().Int("max-jobs", 4, "Maximum number of asynchronous jobs running at the same time")
+	ServeCmd.Flags().Duration("job-retention", 24*time.Hour, "How long to keep finished jobs")
+	ServeCmd.Flags().StringSlice("cache-ttl", []string{},
+		"Cache the rows of the commands matching a pattern, given as pattern=duration, for example reports/*=10m")
+	ServeCmd.Flags().String("cache-dir", "", "Directory to store the cached rows in (default: in memory)")
+	ServeCmd.Flags().Int("cache-size", pkg.DefaultCacheSize, "Maximum number of entries kept in the in-memory cache")
 
 	LsServerCmd.PersistentFlags().String("server", "", "Server to list commands from")
 	err := cli.AddGlazedProcessorFlagsToCobraCommand(LsServerCmd)
@@ -13,6 +13,7 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(cmds.ServeCmd)
 	rootCmd.AddCommand(cmds.LsServerCmd)
+	rootCmd.AddCommand(cmds.RunCmd)
 }
 
 func main() {
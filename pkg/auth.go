@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Name string
+	// Provider is the kind of authenticator that authenticated the principal, for example "jwt"
+	Provider string
+	Roles    []string
+	// Claims contains additional attributes of the principal, such as the claims of a JWT
+	Claims map[string]interface{}
+}
+
+// ID identifies the principal across authenticators, since different authenticators can
+// know principals with the same name. It is the provider followed by the name, like "api-key:alice".
+func (p *Principal) ID() string {
+	return p.Provider + ":" + p.Name
+}
+
+// principalKey is the gin.Context key the principal is stored under.
+const principalKey = "parka.principal"
+
+// PrincipalFromContext returns the principal of the request. ctx is the *gin.Context
+// passed to RunFromParka, or to Run when a glazed command is served by parka.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// Authenticator authenticates requests. Authenticate returns nil if the request doesn't
+// carry credentials the authenticator knows about, and an error if the credentials are invalid.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// Challenger is implemented by authenticators that send a WWW-Authenticate header
+// when a request is not authenticated.
+type Challenger interface {
+	Challenge() string
+}
+
+// CredentialHeaderAuthenticator is implemented by authenticators reading credentials from
+// headers other than Authorization and Cookie.
+type CredentialHeaderAuthenticator interface {
+	CredentialHeaders() []string
+}
+
+// credentialHeadersKey is the gin.Context key the headers returned by CredentialHeaders are
+// stored under.
+const credentialHeadersKey = "parka.credentialHeaders"
+
+// CredentialHeaders returns the headers that may carry the credentials of the caller of c,
+// which can be nil. They are meant for this server, and must not be forwarded to other servers.
+func CredentialHeaders(c *gin.Context) []string {
+	ret := []string{"Authorization", "Proxy-Authorization", "Cookie"}
+	if c == nil {
+		return ret
+	}
+	return append(ret, c.GetStringSlice(credentialHeadersKey)...)
+}
+
+// WithAuthenticator requires all requests, except for the static files, to be authenticated.
+// When multiple authenticators are given, the first one recognizing the credentials of a request
+// authenticates it.
+func WithAuthenticator(authenticators ...Authenticator) ServerOption {
+	return func(s *Server) {
+		s.Authenticators = append(s.Authenticators, authenticators...)
+	}
+}
+
+func (s *Server) authenticate(c *gin.Context) {
+	headers := []string{}
+	for _, authenticator := range s.Authenticators {
+		if a, ok := authenticator.(CredentialHeaderAuthenticator); ok {
+			headers = append(headers, a.CredentialHeaders()...)
+		}
+	}
+	c.Set(credentialHeadersKey, headers)
+
+	for _, authenticator := range s.Authenticators {
+		principal, err := authenticator.Authenticate(c.Request)
+		if err != nil {
+			s.abortUnauthenticated(c, err.Error())
+			return
+		}
+		if principal != nil {
+			c.Set(principalKey, principal)
+			c.Next()
+			return
+		}
+	}
+
+	s.abortUnauthenticated(c, "authentication required")
+}
+
+func (s *Server) abortUnauthenticated(c *gin.Context, msg string) {
+	for _, authenticator := range s.Authenticators {
+		if challenger, ok := authenticator.(Challenger); ok {
+			c.Writer.Header().Add("WWW-Authenticate", challenger.Challenge())
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, NewHTTPError(http.StatusUnauthorized, "%s", msg))
+}
+
+// APIKeyAuthenticator authenticates requests by a static API key passed in the X-API-Key header.
+type APIKeyAuthenticator struct {
+	Header string
+	// keys maps the sha256 hash of each key to the name of its principal
+	keys map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyAuthenticator creates an authenticator for keys, which maps each key to the name
+// of its principal.
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	ret := &APIKeyAuthenticator{
+		Header: "X-API-Key",
+		keys:   map[[sha256.Size]byte]string{},
+	}
+	for key, name := range keys {
+		ret.keys[sha256.Sum256([]byte(key))] = name
+	}
+	return ret
+}
+
+func (a *APIKeyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	key := req.Header.Get(a.Header)
+	if key == "" {
+		return nil, nil
+	}
+
+	// compare hashes in constant time, to not leak how much of a key matched
+	hash := sha256.Sum256([]byte(key))
+	name := ""
+	for h, n := range a.keys {
+		if subtle.ConstantTimeCompare(h[:], hash[:]) == 1 {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, errors.New("invalid API key")
+	}
+
+	return &Principal{Name: name, Provider: "api-key"}, nil
+}
+
+func (a *APIKeyAuthenticator) CredentialHeaders() []string {
+	return []string{a.Header}
+}
+
+// parseAPIKey parses a key given as name:key. Keys without a name are named after their position.
+func parseAPIKey(s string, idx int) (string, string) {
+	name, key, ok := strings.Cut(s, ":")
+	if !ok {
+		return s, fmt.Sprintf("api-key-%d", idx)
+	}
+	return key, name
+}
+
+// LoadAPIKeysFromFile loads API keys from a file containing one key per line, given
+// either as name:key or as a bare key. Empty lines and lines starting with # are ignored.
+func LoadAPIKeysFromFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, name := parseAPIKey(line, len(keys)+1)
+		keys[key] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read API keys from %s", path)
+	}
+	return keys, nil
+}
+
+// LoadAPIKeysFromEnv loads comma-separated API keys from the environment variable name,
+// in the same format as LoadAPIKeysFromFile.
+func LoadAPIKeysFromEnv(name string) (map[string]string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errors.Errorf("environment variable %s is not set", name)
+	}
+
+	keys := map[string]string{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		key, name := parseAPIKey(s, len(keys)+1)
+		keys[key] = name
+	}
+	return keys, nil
+}
+
+// BasicAuthenticator authenticates requests with HTTP Basic authentication, checking the
+// passwords against bcrypt hashes.
+type BasicAuthenticator struct {
+	Realm string
+	users map[string][]byte
+}
+
+// NewBasicAuthenticator creates an authenticator for users, which maps user names to the bcrypt
+// hash of their password.
+func NewBasicAuthenticator(users map[string]string) (*BasicAuthenticator, error) {
+	ret := &BasicAuthenticator{
+		Realm: "parka",
+		users: map[string][]byte{},
+	}
+	for user, hash := range users {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid bcrypt hash for user %s", user)
+		}
+		ret.users[user] = []byte(hash)
+	}
+	return ret, nil
+}
+
+// dummyBcryptHash is checked for unknown users, so that they take as long as known users
+var dummyBcryptHash = []byte("$2a$10$J6izBfwMISCNBKULT46gDON9jZVQcqsWxUGCQ9CtZXUR4od616.q6")
+
+func (b *BasicAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := b.users[user]
+	if !ok {
+		hash = dummyBcryptHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return nil, errors.New("invalid user or password")
+	}
+
+	return &Principal{Name: user, Provider: "basic"}, nil
+}
+
+func (b *BasicAuthenticator) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", b.Realm)
+}
+
+// LoadBasicAuthUsersFromFile loads users from a htpasswd file with bcrypt hashes, as created by
+// htpasswd -B. Empty lines and lines starting with # are ignored.
+func LoadBasicAuthUsersFromFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.Errorf("invalid line in %s, expected user:hash", path)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read users from %s", path)
+	}
+	return users, nil
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newWhoamiCommand returns a command outputting the name of the principal running it.
+func newWhoamiCommand(path string) *testCommand {
+	return newTestCommand(path, nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		name := ""
+		if principal, ok := PrincipalFromContext(c); ok {
+			name = principal.Name
+		}
+		return []map[string]interface{}{{"principal": name}}, nil
+	})
+}
+
+// withTestAuthenticators authenticates alice, bob, carol and dave by API key, and dave also
+// with HTTP Basic and the password "secret".
+func withTestAuthenticators(t *testing.T) ServerOption {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := NewBasicAuthenticator(map[string]string{"dave": string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return WithAuthenticator(
+		NewAPIKeyAuthenticator(map[string]string{"alice-key": "alice", "bob-key": "bob", "carol-key": "carol", "dave-key": "dave"}),
+		basic,
+	)
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer(t, withTestAuthenticators(t), WithCommands(newWhoamiCommand("whoami")))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "anonymous",
+			target: "/api/command/whoami",
+			status: http.StatusUnauthorized,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("expected a WWW-Authenticate challenge")
+				}
+			},
+		},
+		{name: "wrong key", target: "/api/command/whoami", headers: []string{"X-API-Key", "wrong"}, status: http.StatusUnauthorized},
+		{
+			name:   "api key",
+			target: "/api/command/whoami", headers: []string{"X-API-Key", "alice-key"},
+			status: http.StatusOK,
+			check:  expectRow(map[string]interface{}{"principal": "alice"}),
+		},
+		{
+			name:   "basic",
+			target: "/api/command/whoami", headers: []string{"Authorization", basicAuth("dave", "secret")},
+			status: http.StatusOK,
+			check:  expectRow(map[string]interface{}{"principal": "dave"}),
+		},
+		{
+			name:   "wrong password",
+			target: "/api/command/whoami", headers: []string{"Authorization", basicAuth("dave", "wrong")},
+			status: http.StatusUnauthorized,
+		},
+		// static files stay public
+		{name: "static files", target: "/dist/output.css", status: http.StatusOK},
+	})
+}
+
+func basicAuth(user string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
@@ -0,0 +1,342 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CacheEntry holds the rows output by a command for a set of parameters.
+type CacheEntry struct {
+	// Key identifies the command and its parameters, see cacheKey
+	Key  string                   `json:"key"`
+	Rows []map[string]interface{} `json:"rows"`
+	// Hash is the hash of the rows, used to build the ETag of the responses served from the entry
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Cache stores the rows output by the commands cached with WithCacheTTL.
+//
+// Rows are cached before the glazed middlewares and the output format are applied, so that
+// an entry serves all the formats and field selections of a command.
+// Implementations must be safe for concurrent use, and must not return expired entries.
+type Cache interface {
+	Get(key string) (*CacheEntry, bool, error)
+	Set(entry *CacheEntry) error
+	// Purge removes the entries of the commands at or under path, or all entries if path is empty,
+	// and returns how many were removed.
+	Purge(path string) (int, error)
+}
+
+type cacheRule struct {
+	pattern []string
+	ttl     time.Duration
+}
+
+// WithCache sets the cache used by the commands cached with WithCacheTTL,
+// which defaults to a MemoryCache of DefaultCacheSize entries.
+func WithCache(cache Cache) ServerOption {
+	return func(s *Server) {
+		s.Cache = cache
+	}
+}
+
+// WithCacheTTL caches the rows of the commands matching pattern for ttl. Patterns are
+// matched against the path of commands like in Policies, and the first matching one applies.
+//
+// Commands are only cached when opted in, as their rows are reused for every request with the
+// same parameters. Only deterministic commands should be cached. When authentication is enabled,
+// each principal gets its own entries, since commands can depend on PrincipalFromContext.
+func WithCacheTTL(pattern string, ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.cacheRules = append(s.cacheRules, cacheRule{pattern: strings.Split(pattern, "/"), ttl: ttl})
+	}
+}
+
+func (s *Server) cacheTTL(description *cmds.CommandDescription) time.Duration {
+	segments := strings.Split(commandPath(description), "/")
+	for _, rule := range s.cacheRules {
+		if matchCommandPattern(rule.pattern, segments) {
+			return rule.ttl
+		}
+	}
+	return 0
+}
+
+// cacheKey identifies the rows of a command for the principal and the parsed parameters and
+// layers of a request. It is the path of the command followed by a hash of the principal and
+// the parameters, which are normalized by encoding them as JSON, with sorted keys.
+//
+// principal is nil when authentication is disabled.
+func cacheKey(
+	description *cmds.CommandDescription,
+	principal *Principal,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+) (string, error) {
+	layerParameters := map[string]map[string]interface{}{}
+	for slug, parsedLayer := range parsedLayers {
+		layerParameters[slug] = parsedLayer.Parameters
+	}
+	values := map[string]interface{}{
+		"parameters": ps,
+		"layers":     layerParameters,
+	}
+	if principal != nil {
+		values["principal"] = principal.ID()
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return commandPath(description) + "/" + hex.EncodeToString(h[:]), nil
+}
+
+// cacheKeyHasPath returns true if key belongs to a command at or under path.
+func cacheKeyHasPath(key string, path string) bool {
+	return path == "" || strings.HasPrefix(key, path+"/")
+}
+
+// cacheRecorder is the output formatter of the processor handed to cached commands. It keeps
+// a copy of each row and passes it on to the processor of the request.
+type cacheRecorder struct {
+	gp   *cmds.GlazeProcessor
+	rows []map[string]interface{}
+	err  error
+}
+
+func (r *cacheRecorder) AddRow(row types.Row) {
+	if r.err != nil {
+		return
+	}
+	values := row.GetValues()
+	r.rows = append(r.rows, copyRow(values))
+	r.err = r.gp.ProcessInputObject(values)
+}
+
+func (r *cacheRecorder) SetColumnOrder(columnOrder []types.FieldName) {
+	r.gp.OutputFormatter().SetColumnOrder(columnOrder)
+}
+
+func (r *cacheRecorder) AddTableMiddleware(m middlewares.TableMiddleware) {
+	r.gp.OutputFormatter().AddTableMiddleware(m)
+}
+
+func (r *cacheRecorder) AddTableMiddlewareInFront(m middlewares.TableMiddleware) {
+	r.gp.OutputFormatter().AddTableMiddlewareInFront(m)
+}
+
+func (r *cacheRecorder) AddTableMiddlewareAtIndex(i int, m middlewares.TableMiddleware) {
+	r.gp.OutputFormatter().AddTableMiddlewareAtIndex(i, m)
+}
+
+// Output returns an empty string, the rows are output by the processor of the request.
+func (r *cacheRecorder) Output() (string, error) {
+	return "", r.err
+}
+
+// copyRow copies a row, as the middlewares of the processor may modify it.
+func copyRow(row map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		ret[k] = v
+	}
+	return ret
+}
+
+// runFromParka runs cmd with the processor gp. The rows of cached commands are served from
+// the cache, or stored in it once the command succeeded, see WithCacheTTL.
+//
+// It returns the entry the rows come from or were stored in, or nil if they are not cached.
+func (s *Server) runFromParka(
+	c *gin.Context,
+	cmd ParkaCommand,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) (*CacheEntry, error) {
+	ttl := s.cacheTTL(cmd.Description())
+	if s.Cache == nil || ttl <= 0 {
+		return nil, s.run(c, cmd, parsedLayers, ps, gp)
+	}
+
+	name := commandPath(cmd.Description())
+	var principal *Principal
+	if len(s.Authenticators) > 0 {
+		principal, _ = PrincipalFromContext(c)
+	}
+	key, err := cacheKey(cmd.Description(), principal, parsedLayers, ps)
+	if err != nil {
+		log.Warn().Err(err).Str("command", name).Msg("could not compute cache key, running the command uncached")
+		return nil, s.run(c, cmd, parsedLayers, ps, gp)
+	}
+
+	entry, ok, err := s.Cache.Get(key)
+	if err != nil {
+		log.Warn().Err(err).Str("command", name).Msg("could not read from the cache")
+	}
+	if ok {
+		for _, row := range entry.Rows {
+			err = gp.ProcessInputObject(copyRow(row))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entry, nil
+	}
+
+	recorder := &cacheRecorder{gp: gp, rows: []map[string]interface{}{}}
+	err = s.run(c, cmd, parsedLayers, ps, cmds.NewGlazeProcessor(recorder, []middlewares.ObjectMiddleware{}))
+	if err == nil {
+		err = recorder.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(recorder.rows)
+	if err != nil {
+		log.Warn().Err(err).Str("command", name).Msg("could not cache rows")
+		return nil, nil
+	}
+	h := sha256.Sum256(b)
+	now := time.Now()
+	entry = &CacheEntry{
+		Key:     key,
+		Rows:    recorder.rows,
+		Hash:    hex.EncodeToString(h[:]),
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	err = s.Cache.Set(entry)
+	if err != nil {
+		log.Warn().Err(err).Str("command", name).Msg("could not write to the cache")
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// run runs cmd once a slot is free, see Limit.Concurrency.
+func (s *Server) run(
+	c *gin.Context,
+	cmd ParkaCommand,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	release, err := s.acquireSlot(c, cmd)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return cmd.RunFromParka(c, parsedLayers, ps, gp)
+}
+
+// writeNotModified sets the ETag, Last-Modified and Cache-Control headers of a response
+// served from entry in format. If the request is conditional and the client's copy is still
+// valid, it responds with a 304 and returns true.
+func (s *Server) writeNotModified(c *gin.Context, entry *CacheEntry, format *OutputFormat) bool {
+	h := sha256.Sum256([]byte(entry.Key + "\x00" + format.Name + "\x00" + entry.Hash))
+	etag := `"` + hex.EncodeToString(h[:16]) + `"`
+	maxAge := int(time.Until(entry.Expires).Round(time.Second).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	// responses to authenticated requests must not be stored by shared caches
+	visibility := "public"
+	if len(s.Authenticators) > 0 {
+		visibility = "private"
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", entry.Created.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, maxAge))
+	c.Header("Vary", "Accept")
+
+	notModified := false
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		// If-Modified-Since is ignored when If-None-Match is present
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				notModified = true
+				break
+			}
+		}
+	} else if t, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil {
+		notModified = !entry.Created.Truncate(time.Second).After(t)
+	}
+	if !notModified {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+	c.Writer.WriteHeaderNow()
+	return true
+}
+
+// serveCache exposes DELETE /api/cache/<parents>/<name> to purge the cached rows of the
+// commands at or under a path, and DELETE /api/cache to purge all of them.
+//
+// Purging is restricted to admins, so it is only possible when the policies define admin roles.
+func (s *Server) serveCache() {
+	if s.Cache == nil {
+		return
+	}
+
+	purge := func(c *gin.Context) {
+		writeError(c, &ForbiddenError{Message: "purging the cache requires policies with admin roles"})
+	}
+	if s.Policies != nil && len(s.Policies.AdminRoles) > 0 {
+		purge = s.purgeCache
+	}
+	s.Router.DELETE("/api/cache", purge)
+	s.Router.DELETE("/api/cache/*path", purge)
+}
+
+func (s *Server) purgeCache(c *gin.Context) {
+	err := s.authorizeAdmin(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	path := strings.Trim(c.Param("path"), "/")
+	n, err := s.Cache.Purge(path)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	log.Info().Str("path", path).Int("entries", n).Msg("purged cache")
+	c.JSON(http.StatusOK, gin.H{"purged": n})
+}
+
+// cachedCommand runs a command through the cache of the server, for the code that only
+// takes a ParkaCommand, like JobManager.
+type cachedCommand struct {
+	ParkaCommand
+	s *Server
+}
+
+func (cc *cachedCommand) RunFromParka(
+	c *gin.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	_, err := cc.s.runFromParka(c, cc.ParkaCommand, parsedLayers, ps, gp)
+	return err
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of entries kept by the MemoryCache created when caching is
+// enabled without choosing a cache.
+const DefaultCacheSize = 1000
+
+// MemoryCache keeps up to a maximum number of entries in memory, evicting the least
+// recently used ones first.
+type MemoryCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	// lru holds the entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the stored entry. Entries are never modified once stored, so they are shared
+// instead of copied.
+func (m *MemoryCache) Get(key string) (*CacheEntry, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := e.Value.(*CacheEntry)
+	if entry.expired() {
+		m.lru.Remove(e)
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+	m.lru.MoveToFront(e)
+	return entry, true, nil
+}
+
+func (m *MemoryCache) Set(entry *CacheEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.entries[entry.Key]; ok {
+		e.Value = entry
+		m.lru.MoveToFront(e)
+		return nil
+	}
+	m.entries[entry.Key] = m.lru.PushFront(entry)
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*CacheEntry).Key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Purge(path string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := 0
+	for key, e := range m.entries {
+		if cacheKeyHasPath(key, path) {
+			m.lru.Remove(e)
+			delete(m.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DiskCache stores each entry as a JSON file in a directory, so that entries survive a restart
+// of the server. Expired entries are removed when they are looked up or purged.
+type DiskCache struct {
+	mutex sync.RWMutex
+	dir   string
+}
+
+func NewDiskCache(dir string) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create cache directory %s", dir)
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// path returns the file of an entry, named after the hash of its key since keys contain slashes.
+func (d *DiskCache) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(h[:])+".json")
+}
+
+func (d *DiskCache) read(path string) (*CacheEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{}
+	// keep integers as integers, so that cached rows are output like fresh ones
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	err = decoder.Decode(entry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", path)
+	}
+	for _, row := range entry.Rows {
+		for k, v := range row {
+			row[k] = fromJSONNumbers(v)
+		}
+	}
+	return entry, nil
+}
+
+// fromJSONNumbers converts the json.Number values in v to int64, or to float64 if they are not integers.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromJSONNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSONNumbers(e)
+		}
+	}
+	return v
+}
+
+func (d *DiskCache) Get(key string) (*CacheEntry, bool, error) {
+	d.mutex.RLock()
+	entry, err := d.read(d.path(key))
+	d.mutex.RUnlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	// two keys with the same hash are not going to happen, but don't serve the wrong rows if they do
+	if entry.Key != key {
+		return nil, false, nil
+	}
+	if entry.expired() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		err = os.Remove(d.path(key))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+func (d *DiskCache) Set(entry *CacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// write to a temporary file first, so that a crash doesn't leave a truncated file behind
+	path := d.path(entry.Key)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *DiskCache) Purge(path string) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		filePath := filepath.Join(d.dir, name)
+		entry, err := d.read(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return n, err
+		}
+		if !cacheKeyHasPath(entry.Key, path) && !entry.expired() {
+			continue
+		}
+		err = os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		if cacheKeyHasPath(entry.Key, path) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (e *CacheEntry) expired() bool {
+	return !time.Now().Before(e.Expires)
+}
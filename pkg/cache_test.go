@@ -0,0 +1,290 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCounterCommand returns a command outputting how many times it ran, to tell cached rows apart.
+func newCounterCommand(path string) *testCommand {
+	cmd := newTestCommand(path, []*parameters.ParameterDefinition{
+		{Name: "n", Type: parameters.ParameterTypeInteger, Default: 1},
+	}, nil)
+	cmd.rows = func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		name := ""
+		if principal, ok := PrincipalFromContext(c); ok {
+			name = principal.Name
+		}
+		return []map[string]interface{}{{"run": cmd.runs, "n": ps["n"], "principal": name}}, nil
+	}
+	return cmd
+}
+
+// expectRuns returns a check of how many times cmd ran.
+func expectRuns(cmd *testCommand, runs int) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if cmd.runs != runs {
+			t.Errorf("expected the command to run %d times, ran %d times", runs, cmd.runs)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cmd := newCounterCommand("reports/count")
+	uncached := newCounterCommand("count")
+	s := newTestServer(t, WithCommands(cmd, uncached), WithCacheTTL("reports/*", time.Minute))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "miss",
+			target: "/api/command/reports/count?n=1",
+			status: http.StatusOK,
+			check:  expectHeader("Cache-Control", "public, max-age=60"),
+		},
+		{
+			name:   "hit",
+			target: "/api/command/reports/count?n=1",
+			status: http.StatusOK,
+			check:  expectRow(map[string]interface{}{"run": 1.0}),
+		},
+		// other parameters have their own entry
+		{name: "other parameters", target: "/api/command/reports/count?n=2", status: http.StatusOK, check: expectRuns(cmd, 2)},
+		{
+			// POST requests share the entries of GET requests
+			name:   "post",
+			method: http.MethodPost, target: "/api/command/reports/count",
+			body:   `{"n": 1}`,
+			status: http.StatusOK,
+			check:  expectRuns(cmd, 2),
+		},
+		// commands are not cached unless opted in
+		{name: "uncached", target: "/api/command/count", status: http.StatusOK},
+		{name: "uncached again", target: "/api/command/count", status: http.StatusOK, check: func(t *testing.T, w *httptest.ResponseRecorder) {
+			expectHeader("ETag", "")(t, w)
+			expectRuns(uncached, 2)(t, w)
+		}},
+	})
+}
+
+func TestCacheNotModified(t *testing.T) {
+	s := newTestServer(t, WithCommands(newCounterCommand("reports/count")), WithCacheTTL("reports/*", time.Minute))
+
+	w := get(s, "/api/command/reports/count")
+	expectStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+	lastModified := w.Header().Get("Last-Modified")
+	before := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "etag",
+			target: "/api/command/reports/count", headers: []string{"If-None-Match", etag},
+			status: http.StatusNotModified,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if w.Body.Len() != 0 {
+					t.Errorf("expected an empty body, got %s", w.Body.String())
+				}
+			},
+		},
+		{
+			name:   "weak etag in a list",
+			target: "/api/command/reports/count", headers: []string{"If-None-Match", `"other", W/` + etag},
+			status: http.StatusNotModified,
+		},
+		{name: "other etag", target: "/api/command/reports/count", headers: []string{"If-None-Match", `"other"`}, status: http.StatusOK},
+		{
+			name:   "not modified since",
+			target: "/api/command/reports/count", headers: []string{"If-Modified-Since", lastModified},
+			status: http.StatusNotModified,
+		},
+		{name: "modified since", target: "/api/command/reports/count", headers: []string{"If-Modified-Since", before}, status: http.StatusOK},
+		{
+			// each format has its own ETag
+			name:   "other format",
+			target: "/api/command/reports/count?_output=csv", headers: []string{"If-None-Match", etag},
+			status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if w.Header().Get("ETag") == etag {
+					t.Errorf("expected the CSV output to have another ETag")
+				}
+			},
+		},
+	})
+}
+
+func TestCachePerPrincipal(t *testing.T) {
+	cmd := newCounterCommand("reports/count")
+	s := newTestServer(t, withTestAuthenticators(t), WithCommands(cmd), WithCacheTTL("reports/*", time.Minute))
+
+	tests := []requestTest{}
+	for _, name := range []string{"alice", "alice", "bob"} {
+		name := name
+		tests = append(tests, requestTest{
+			name:   name,
+			target: "/api/command/reports/count", headers: []string{"X-API-Key", name + "-key"},
+			status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				// authenticated responses are private
+				expectHeader("Cache-Control", "private, max-age=60")(t, w)
+				expectRow(map[string]interface{}{"principal": name})(t, w)
+			},
+		})
+	}
+	runRequestTests(t, s, tests)
+	if cmd.runs != 2 {
+		t.Errorf("expected the command to run once per principal, ran %d times", cmd.runs)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	cmd := newCounterCommand("reports/count")
+	s := newTestServer(t, withTestAuthenticators(t), withTestPolicies(), WithCommands(cmd), WithCacheTTL("reports/*", time.Minute))
+
+	bob := []string{"X-API-Key", "bob-key"}
+	runRequestTests(t, s, []requestTest{
+		{name: "fill", target: "/api/command/reports/count", headers: bob, status: http.StatusOK},
+		{name: "purge", method: http.MethodDelete, target: "/api/cache/reports", headers: bob, status: http.StatusForbidden},
+		{name: "still cached", target: "/api/command/reports/count", headers: bob, status: http.StatusOK, check: expectRuns(cmd, 1)},
+		{
+			name:   "purge as admin",
+			method: http.MethodDelete, target: "/api/cache/reports", headers: []string{"X-API-Key", "carol-key"},
+			status: http.StatusOK,
+			check:  expectBody(`{"purged":1}`),
+		},
+		{name: "purged", target: "/api/command/reports/count", headers: bob, status: http.StatusOK, check: expectRuns(cmd, 2)},
+	})
+}
+
+func TestCachePurgeWithoutAdmins(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ServerOption
+		headers []string
+	}{
+		{"without authentication", nil, nil},
+		{"without policies", []ServerOption{withTestAuthenticators(t)}, []string{"X-API-Key", "alice-key"}},
+		{
+			"without admin roles",
+			[]ServerOption{withTestAuthenticators(t), WithPolicies(&Policies{
+				Policies: []*Policy{{Commands: []string{"**"}, Roles: []string{"*"}}},
+			})},
+			[]string{"X-API-Key", "alice-key"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newCounterCommand("reports/count")
+			s := newTestServer(t, append(tt.options, WithCommands(cmd), WithCacheTTL("reports/*", time.Minute))...)
+			runRequestTests(t, s, []requestTest{
+				{name: "fill", target: "/api/command/reports/count", headers: tt.headers, status: http.StatusOK},
+				{
+					name:   "purge",
+					method: http.MethodDelete, target: "/api/cache", headers: tt.headers,
+					status: http.StatusForbidden,
+					check:  expectErrorCode("forbidden"),
+				},
+				{name: "still cached", target: "/api/command/reports/count", headers: tt.headers, status: http.StatusOK, check: expectRuns(cmd, 1)},
+			})
+		})
+	}
+}
+
+func TestDiskCacheOutput(t *testing.T) {
+	cache, err := NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single column, as the columns of a row come out in any order
+	cmd := newTestCommand("reports/count", []*parameters.ParameterDefinition{
+		{Name: "n", Type: parameters.ParameterTypeInteger},
+	}, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{{"n": ps["n"]}}, nil
+	})
+	s := newTestServer(t,
+		WithCommands(cmd),
+		WithCache(cache),
+		WithCacheTTL("reports/*", time.Minute),
+	)
+
+	// cached rows are read back from disk, and must be output like the fresh ones
+	for i, format := range []string{"json", "csv", "table", "markdown", "yaml"} {
+		n := strconv.Itoa(1000000 + i)
+		t.Run(format, func(t *testing.T) {
+			target := "/api/command/reports/count?n=" + n + "&_output=" + format
+			fresh := get(s, target)
+			expectStatus(t, fresh, http.StatusOK)
+			if !strings.Contains(fresh.Body.String(), n) {
+				t.Fatalf("expected the output to contain %s, got %s", n, fresh.Body.String())
+			}
+			runRequestTests(t, s, []requestTest{
+				{name: "cached", target: target, status: http.StatusOK, check: expectBody(fresh.Body.String())},
+			})
+		})
+	}
+	if cmd.runs != 5 {
+		t.Errorf("expected each format to be served from the cache once, the command ran %d times", cmd.runs)
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	cache := NewMemoryCache(2)
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		err := cache.Set(&CacheEntry{Key: key, Expires: time.Now().Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok, _ := cache.Get("a/1"); ok {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+	_ = cache.Set(&CacheEntry{Key: "a/3", Expires: time.Now().Add(-time.Second)})
+	if _, ok, _ := cache.Get("a/3"); ok {
+		t.Errorf("expected expired entries not to be returned")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &CacheEntry{
+		Key:     "reports/count/abc",
+		Rows:    []map[string]interface{}{{"a": 1, "b": 1.5}},
+		Expires: time.Now().Add(time.Minute),
+	}
+	err = cache.Set(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries survive a restart
+	cache, err = NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := cache.Get(entry.Key)
+	if err != nil || !ok || got.Rows[0]["a"] != int64(1) || got.Rows[0]["b"] != 1.5 {
+		t.Fatalf("expected the stored entry, got %v %v %v", got, ok, err)
+	}
+
+	n, err := cache.Purge("other")
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing to be purged, got %d %v", n, err)
+	}
+	n, err = cache.Purge("reports")
+	if err != nil || n != 1 {
+		t.Errorf("expected the entry to be purged, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,521 @@
+// Package client is a Go client for the HTTP API of parka servers.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CommandDescription is the description of a command as returned by /api/commands.
+// The layers of the command are not decoded.
+type CommandDescription struct {
+	Name      string
+	Short     string
+	Long      string
+	Parents   []string
+	Flags     []*parameters.ParameterDefinition
+	Arguments []*parameters.ParameterDefinition
+}
+
+// Path returns the path of the command on the server, made of its parents and its name.
+func (d *CommandDescription) Path() string {
+	return strings.Join(append(append([]string{}, d.Parents...), d.Name), "/")
+}
+
+// ToCommandDescription converts the description to a glazed CommandDescription,
+// with the glazed output layer added.
+func (d *CommandDescription) ToCommandDescription() (*cmds.CommandDescription, error) {
+	glazedParameterLayer, err := cli.NewGlazedParameterLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	description := cmds.NewCommandDescription(
+		d.Name,
+		cmds.WithShort(d.Short),
+		cmds.WithLong(d.Long),
+		cmds.WithFlags(d.Flags...),
+		cmds.WithArguments(d.Arguments...),
+		cmds.WithLayers(glazedParameterLayer),
+	)
+	description.Parents = d.Parents
+
+	return description, nil
+}
+
+// normalizeDefault converts the default value of p decoded from JSON to the type
+// expected by glazed. Defaults that can't be converted are dropped, the server applies
+// its own defaults to the parameters that are not sent anyway.
+func normalizeDefault(p *parameters.ParameterDefinition) {
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeInteger:
+		if f, ok := p.Default.(float64); ok {
+			p.Default = int(f)
+		}
+	case parameters.ParameterTypeIntegerList:
+		if l, ok := p.Default.([]interface{}); ok {
+			ints := []int{}
+			for _, v := range l {
+				f, ok := v.(float64)
+				if !ok {
+					p.Default = nil
+					return
+				}
+				ints = append(ints, int(f))
+			}
+			p.Default = ints
+		}
+	case parameters.ParameterTypeDate:
+		// dates are parsed on the server, and marshalled as RFC3339
+		if s, ok := p.Default.(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				p.Default = t.Format("2006-01-02")
+			}
+		}
+	}
+
+	if p.CheckParameterDefaultValueValidity() != nil {
+		p.Default = nil
+	}
+}
+
+// Error is returned when the server answers with an error status.
+type Error struct {
+	StatusCode int
+	// Code identifies the kind of error, for example "invalid_parameters"
+	Code    string
+	Message string
+	// Parameters are the invalid parameters reported by the server
+	Parameters []*ParameterError
+}
+
+// ParameterError describes why the server rejected a parameter.
+type ParameterError struct {
+	Parameter string   `json:"parameter"`
+	Message   string   `json:"message"`
+	Type      string   `json:"type,omitempty"`
+	Choices   []string `json:"choices,omitempty"`
+}
+
+// errorBody is the JSON body of the error responses of parka.
+type errorBody struct {
+	Error      string            `json:"error"`
+	Code       string            `json:"code"`
+	Parameters []*ParameterError `json:"parameters"`
+}
+
+func (e *errorBody) toError(statusCode int) *Error {
+	return &Error{
+		StatusCode: statusCode,
+		Code:       e.Code,
+		Message:    e.Error,
+		Parameters: e.Parameters,
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+}
+
+// File is a parameter value uploaded as a file. Passing a File to Client.Run sends the
+// parameters as multipart form data instead of JSON.
+type File struct {
+	Name    string
+	Content io.Reader
+}
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Headers are added to all requests, for example to authenticate
+	Headers http.Header
+	// MaxRetries is how many times a request is retried when the server can't be reached,
+	// or answers with 429, 502, 503 or 504. Commands are only run again when it is safe,
+	// see WithRetries.
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+type ClientOption func(*Client)
+
+func NewClient(baseURL string, options ...ClientOption) *Client {
+	c := &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		Headers:    http.Header{},
+		RetryDelay: time.Second,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.HTTPClient = httpClient
+	}
+}
+
+func WithHeader(name string, value string) ClientOption {
+	return func(c *Client) {
+		c.Headers.Set(name, value)
+	}
+}
+
+func WithBearerToken(token string) ClientOption {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+func WithBasicAuth(username string, password string) ClientOption {
+	return func(c *Client) {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, password)
+		c.Headers.Set("Authorization", req.Header.Get("Authorization"))
+	}
+}
+
+// WithRetries retries failed requests up to maxRetries times, waiting delay before the
+// first retry and doubling it for each further one, or as long as the server asks for
+// with a Retry-After header.
+//
+// Listing the commands is retried on connection errors and on 429, 502, 503 and 504.
+// Running a command is only retried if the request could not be sent at all, or if the
+// server answered 429 or 503 with a Retry-After header, so that a command that may already
+// have run is not run twice.
+func WithRetries(maxRetries int, delay time.Duration) ClientOption {
+	return func(c *Client) {
+		c.MaxRetries = maxRetries
+		c.RetryDelay = delay
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// isIdempotent returns true if sending a request with method more than once has the same
+// effect as sending it once.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp, given either in
+// seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// do sends a request, retrying it if necessary. body is sent again on each attempt.
+// Responses with an error status are turned into an *Error.
+//
+// Idempotent requests are retried on connection errors, and on 429, 502, 503 and 504.
+// Other requests, like the POST running a command, might already have been handled when
+// they fail, so they are only retried if the connection failed before the request was
+// written, or if the server answered 429 or 503 with a Retry-After header, which means
+// it didn't run the command.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	header http.Header,
+	body []byte,
+) (*http.Response, error) {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		sent := atomic.Bool{}
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					sent.Store(true)
+				}
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, c.BaseURL+path, bodyReader)
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range c.Headers {
+			req.Header[k] = vs
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err == nil && resp.StatusCode < 400 {
+			return resp, nil
+		}
+
+		retry := attempt < c.MaxRetries && ctx.Err() == nil
+		wait := delay
+		if err != nil {
+			if !retry || (!isIdempotent(method) && sent.Load()) {
+				return nil, err
+			}
+		} else {
+			requested, ok := retryAfter(resp)
+			if isIdempotent(method) {
+				retry = retry && isRetryableStatus(resp.StatusCode)
+			} else {
+				retry = retry && ok &&
+					(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable)
+			}
+			if !retry {
+				defer resp.Body.Close()
+				return nil, newError(resp)
+			}
+			if ok {
+				wait = requested
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func newError(resp *http.Response) *Error {
+	body := &errorBody{}
+	if json.NewDecoder(resp.Body).Decode(body) == nil && body.Error != "" {
+		return body.toError(resp.StatusCode)
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+}
+
+// ListCommands returns the commands served by the server.
+func (c *Client) ListCommands(ctx context.Context) ([]*CommandDescription, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/commands", nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list commands")
+	}
+	defer resp.Body.Close()
+
+	descriptions := []*CommandDescription{}
+	err = json.NewDecoder(resp.Body).Decode(&descriptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode commands")
+	}
+
+	for _, d := range descriptions {
+		for _, p := range append(append([]*parameters.ParameterDefinition{}, d.Flags...), d.Arguments...) {
+			normalizeDefault(p)
+		}
+	}
+
+	return descriptions, nil
+}
+
+// GetCommand returns the description of the command served under path, see CommandDescription.Path.
+func (c *Client) GetCommand(ctx context.Context, path string) (*CommandDescription, error) {
+	descriptions, err := c.ListCommands(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path = strings.Trim(path, "/")
+	for _, d := range descriptions {
+		if d.Path() == path {
+			return d, nil
+		}
+	}
+	return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("unknown command '%s'", path)}
+}
+
+type runOptions struct {
+	streaming bool
+}
+
+type RunOption func(*runOptions)
+
+// WithStreaming requests the rows as NDJSON, so that they can be iterated over while the
+// command is still running.
+func WithStreaming() RunOption {
+	return func(o *runOptions) {
+		o.streaming = true
+	}
+}
+
+// Run runs the command served under path with params, which are sent as JSON, or as
+// multipart form data if one of them is a *File.
+//
+// The returned RowIterator has to be closed.
+func (c *Client) Run(
+	ctx context.Context,
+	path string,
+	params map[string]interface{},
+	options ...RunOption,
+) (RowIterator, error) {
+	o := &runOptions{}
+	for _, option := range options {
+		option(o)
+	}
+
+	header := http.Header{}
+	var body []byte
+	var err error
+	if hasFiles(params) {
+		var contentType string
+		body, contentType, err = newMultipartBody(params)
+		header.Set("Content-Type", contentType)
+	} else {
+		body, err = json.Marshal(params)
+		header.Set("Content-Type", "application/json")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.streaming {
+		header.Set("Accept", "application/x-ndjson")
+	} else {
+		header.Set("Accept", "application/json")
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/api/command/"+strings.Trim(path, "/"), header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.streaming {
+		return newNDJSONRowIterator(resp.Body), nil
+	}
+
+	defer resp.Body.Close()
+	rows := []map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode rows")
+	}
+	return newSliceRowIterator(rows), nil
+}
+
+func hasFiles(params map[string]interface{}) bool {
+	for _, v := range params {
+		if _, ok := v.(*File); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newMultipartBody(params map[string]interface{}) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+
+	for name, v := range params {
+		if f, ok := v.(*File); ok {
+			part, err := w.CreateFormFile(name, f.Name)
+			if err != nil {
+				return nil, "", err
+			}
+			_, err = io.Copy(part, f.Content)
+			if err != nil {
+				return nil, "", errors.Wrapf(err, "could not read file %s", f.Name)
+			}
+			continue
+		}
+
+		for _, s := range formValues(v) {
+			err := w.WriteField(name, s)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// formValues converts a parameter value to form field values.
+func formValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case time.Time:
+		return []string{v.Format(time.RFC3339)}
+	case []string:
+		ret := []string{}
+		for _, s := range v {
+			ret = append(ret, quoteListValue(s))
+		}
+		return ret
+	case map[string]interface{}:
+		ret := []string{}
+		for k, v_ := range v {
+			ret = append(ret, quoteListValue(fmt.Sprintf("%s:%v", k, v_)))
+		}
+		return ret
+	case map[string]string:
+		ret := []string{}
+		for k, v_ := range v {
+			ret = append(ret, quoteListValue(k+":"+v_))
+		}
+		return ret
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		ret := []string{}
+		for i := 0; i < rv.Len(); i++ {
+			ret = append(ret, quoteListValue(fmt.Sprintf("%v", rv.Index(i).Interface())))
+		}
+		return ret
+	}
+	return []string{fmt.Sprintf("%v", v)}
+}
+
+// quoteListValue quotes an element of a list that the server would otherwise split on its commas.
+func quoteListValue(s string) string {
+	if !strings.ContainsAny(s, ",\"") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
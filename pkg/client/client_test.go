@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testResponse is an answer of the server in TestRetries. hangUp closes the connection
+// once the request has been read, without answering.
+type testResponse struct {
+	status     int
+	retryAfter string
+	hangUp     bool
+}
+
+// countingTransport counts the requests passed to the default transport.
+type countingTransport struct {
+	count atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetries(t *testing.T) {
+	list := func(c *Client) error {
+		_, err := c.ListCommands(context.Background())
+		return err
+	}
+	run := func(c *Client) error {
+		rows, err := c.Run(context.Background(), "echo", map[string]interface{}{"name": "alice"})
+		if err != nil {
+			return err
+		}
+		return rows.Close()
+	}
+
+	tests := []struct {
+		name      string
+		call      func(c *Client) error
+		responses []testResponse
+		attempts  int64
+		err       bool
+	}{
+		{name: "get", call: list, responses: []testResponse{{status: 502}, {status: 504}}, attempts: 3},
+		{name: "get too many", call: list, responses: []testResponse{{status: 503}, {status: 503}, {status: 503}}, attempts: 3, err: true},
+		{name: "get not retryable", call: list, responses: []testResponse{{status: 500}}, attempts: 1, err: true},
+		{name: "get hang up", call: list, responses: []testResponse{{hangUp: true}}, attempts: 2},
+		{name: "post", call: run, attempts: 1},
+		{name: "post bad gateway", call: run, responses: []testResponse{{status: 502}}, attempts: 1, err: true},
+		{name: "post gateway timeout", call: run, responses: []testResponse{{status: 504}}, attempts: 1, err: true},
+		{name: "post unavailable", call: run, responses: []testResponse{{status: 503}}, attempts: 1, err: true},
+		{name: "post unavailable retry after", call: run, responses: []testResponse{{status: 503, retryAfter: "0"}}, attempts: 2},
+		{name: "post rate limited", call: run, responses: []testResponse{{status: 429}}, attempts: 1, err: true},
+		{name: "post rate limited retry after", call: run, responses: []testResponse{{status: 429, retryAfter: "0"}}, attempts: 2},
+		{
+			name:      "post rate limited retry after date",
+			call:      run,
+			responses: []testResponse{{status: 429, retryAfter: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}},
+			attempts:  2,
+		},
+		{name: "post hang up", call: run, responses: []testResponse{{hangUp: true}}, attempts: 1, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := atomic.Int64{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(attempts.Add(1)) - 1
+				if i < len(tt.responses) {
+					response := tt.responses[i]
+					if response.hangUp {
+						conn, _, err := w.(http.Hijacker).Hijack()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						_ = conn.Close()
+						return
+					}
+					if response.retryAfter != "" {
+						w.Header().Set("Retry-After", response.retryAfter)
+					}
+					http.Error(w, "failure", response.status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte("[]"))
+			}))
+			defer server.Close()
+
+			err := tt.call(NewClient(server.URL, WithRetries(2, time.Millisecond)))
+			if tt.err && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !tt.err && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if attempts.Load() != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, attempts.Load())
+			}
+		})
+	}
+}
+
+func TestRetriesConnectionRefused(t *testing.T) {
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	_ = l.Close()
+
+	transport := &countingTransport{}
+	c := NewClient(url, WithRetries(2, time.Millisecond), WithHTTPClient(&http.Client{Transport: transport}))
+	// the request was never sent, so running the command again is safe
+	_, err = c.Run(context.Background(), "echo", map[string]interface{}{})
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if transport.count.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", transport.count.Load())
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/commands" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode([]*CommandDescription{
+			{Name: "echo"},
+			{
+				Name:    "daily",
+				Parents: []string{"reports"},
+				Flags: []*parameters.ParameterDefinition{
+					{Name: "count", Type: parameters.ParameterTypeInteger, Default: 3},
+					{Name: "ids", Type: parameters.ParameterTypeIntegerList, Default: []int{1, 2}},
+					{Name: "since", Type: parameters.ParameterTypeDate, Default: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+					{Name: "kind", Type: parameters.ParameterTypeChoice, Choices: []string{"a", "b"}, Default: "c"},
+				},
+				Arguments: []*parameters.ParameterDefinition{
+					{Name: "limit", Type: parameters.ParameterTypeInteger, Default: 10},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+	c := NewClient(server.URL + "/")
+
+	descriptions, err := c.ListCommands(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptions) != 2 || descriptions[0].Path() != "echo" || descriptions[1].Path() != "reports/daily" {
+		t.Fatalf("unexpected commands %v", descriptions)
+	}
+
+	// the defaults are decoded as glazed expects them, or dropped if they are invalid
+	defaults := map[string]interface{}{}
+	for _, p := range append(descriptions[1].Flags, descriptions[1].Arguments...) {
+		defaults[p.Name] = p.Default
+	}
+	expected := map[string]interface{}{"count": 3, "ids": []int{1, 2}, "since": "2023-01-02", "kind": nil, "limit": 10}
+	if !reflect.DeepEqual(defaults, expected) {
+		t.Errorf("expected the defaults %v, got %v", expected, defaults)
+	}
+
+	d, err := c.GetCommand(context.Background(), "/reports/daily/")
+	if err != nil || d.Name != "daily" {
+		t.Errorf("expected to find reports/daily, got %v, %v", d, err)
+	}
+	description, err := d.ToCommandDescription()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(description.Layers) != 1 || description.Layers[0].GetSlug() != "glazed" {
+		t.Errorf("expected the glazed output layer to be added, got %v", description.Layers)
+	}
+
+	_, err = c.GetCommand(context.Background(), "reports/weekly")
+	clientError := &Error{}
+	if !errors.As(err, &clientError) || clientError.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+// testRequest is a request received by the server in TestRun.
+type testRequest struct {
+	header http.Header
+	values map[string][]string
+	files  map[string]string
+}
+
+func TestRun(t *testing.T) {
+	requests := make(chan *testRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &testRequest{header: r.Header, values: map[string][]string{}, files: map[string]string{}}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			err := r.ParseMultipartForm(1 << 20)
+			if err != nil {
+				t.Error(err)
+			}
+			req.values = r.MultipartForm.Value
+			for name, headers := range r.MultipartForm.File {
+				f, err := headers[0].Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(f)
+				req.files[name+":"+headers[0].Filename] = string(b)
+			}
+		} else {
+			values := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&values)
+			for k, v := range values {
+				req.values[k] = formValues(v)
+			}
+		}
+		requests <- req
+
+		switch {
+		case r.URL.Path == "/api/command/fail":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid parameters", "code": "invalid_parameters", "parameters": [{"parameter": "count", "message": "not an integer"}]}`))
+		case r.Header.Get("Accept") == "application/x-ndjson":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			_, _ = w.Write([]byte(`{"row": {"n": 1}}` + "\n" + `{"row": {"n": 2}}` + "\n"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`[{"n": 1}, {"n": 2}]`))
+		}
+	}))
+	defer server.Close()
+	c := NewClient(server.URL, WithHeader("X-API-Key", "key"))
+
+	tests := []struct {
+		name    string
+		path    string
+		params  map[string]interface{}
+		options []RunOption
+		request *testRequest
+		err     string
+	}{
+		{
+			name:   "json",
+			path:   "reports/daily",
+			params: map[string]interface{}{"name": "alice", "ids": []int{1, 2}},
+			request: &testRequest{
+				header: http.Header{"Content-Type": {"application/json"}, "Accept": {"application/json"}, "X-Api-Key": {"key"}},
+				values: map[string][]string{"name": {"alice"}, "ids": {"1", "2"}},
+				files:  map[string]string{},
+			},
+		},
+		{
+			name:    "streaming",
+			path:    "reports/daily",
+			params:  map[string]interface{}{},
+			options: []RunOption{WithStreaming()},
+			request: &testRequest{
+				header: http.Header{"Content-Type": {"application/json"}, "Accept": {"application/x-ndjson"}, "X-Api-Key": {"key"}},
+				values: map[string][]string{},
+				files:  map[string]string{},
+			},
+		},
+		{
+			name: "files",
+			path: "upload",
+			params: map[string]interface{}{
+				"data":  &File{Name: "data.csv", Content: strings.NewReader("a,b\n")},
+				"tags":  []string{"a", "b,c"},
+				"count": 3,
+			},
+			request: &testRequest{
+				header: http.Header{"Accept": {"application/json"}, "X-Api-Key": {"key"}},
+				values: map[string][]string{"tags": {"a", `"b,c"`}, "count": {"3"}},
+				files:  map[string]string{"data:data.csv": "a,b\n"},
+			},
+		},
+		{
+			name:   "error",
+			path:   "fail",
+			params: map[string]interface{}{"count": "x"},
+			err:    "invalid parameters (400)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := c.Run(context.Background(), tt.path, tt.params, tt.options...)
+			req := <-requests
+			if tt.err != "" {
+				clientError := &Error{}
+				if !errors.As(err, &clientError) || clientError.Error() != tt.err {
+					t.Fatalf("expected the error %q, got %v", tt.err, err)
+				}
+				expected := []*ParameterError{{Parameter: "count", Message: "not an integer"}}
+				if clientError.Code != "invalid_parameters" || !reflect.DeepEqual(clientError.Parameters, expected) {
+					t.Errorf("expected the invalid parameters to be reported, got %v", clientError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			for name, values := range tt.request.header {
+				if got := req.header.Values(name); !reflect.DeepEqual(got, values) {
+					t.Errorf("expected the header %s to be %v, got %v", name, values, got)
+				}
+			}
+			if !reflect.DeepEqual(req.values, tt.request.values) || !reflect.DeepEqual(req.files, tt.request.files) {
+				t.Errorf("expected the values %v and files %v, got %v and %v", tt.request.values, tt.request.files, req.values, req.files)
+			}
+
+			ns := []interface{}{}
+			for rows.Next() {
+				ns = append(ns, rows.Row()["n"])
+			}
+			if rows.Err() != nil {
+				t.Fatal(rows.Err())
+			}
+			if !reflect.DeepEqual(ns, []interface{}{float64(1), float64(2)}) {
+				t.Errorf("expected two rows, got %v", ns)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+)
+
+// RemoteCommand is a glazed command running a command on a parka server. It can be run
+// locally, or served again by another parka server.
+type RemoteCommand struct {
+	client      *Client
+	path        string
+	description *cmds.CommandDescription
+	runOptions  []RunOption
+}
+
+func NewRemoteCommand(client *Client, description *CommandDescription, options ...RunOption) (*RemoteCommand, error) {
+	cmdDescription, err := description.ToCommandDescription()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteCommand{
+		client:      client,
+		path:        description.Path(),
+		description: cmdDescription,
+		runOptions:  options,
+	}, nil
+}
+
+// NewRemoteCommands wraps all the commands served by the client's server.
+func NewRemoteCommands(ctx context.Context, client *Client, options ...RunOption) ([]*RemoteCommand, error) {
+	descriptions, err := client.ListCommands(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*RemoteCommand{}
+	for _, d := range descriptions {
+		cmd, err := NewRemoteCommand(client, d, options...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cmd)
+	}
+	return ret, nil
+}
+
+func (r *RemoteCommand) Description() *cmds.CommandDescription {
+	return r.description
+}
+
+func (r *RemoteCommand) Run(
+	ctx context.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	// only send the parameters of the command, the output layers are applied locally
+	params := map[string]interface{}{}
+	for _, p := range append(append([]*parameters.ParameterDefinition{}, r.description.Flags...), r.description.Arguments...) {
+		if v, ok := ps[p.Name]; ok {
+			params[p.Name] = v
+		}
+	}
+
+	rows, err := r.client.Run(ctx, r.path, params, r.runOptions...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		err = gp.ProcessInputObject(rows.Row())
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
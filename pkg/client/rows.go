@@ -0,0 +1,119 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// RowIterator iterates over the rows returned by a command:
+//
+//	for it.Next() {
+//		row := it.Row()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type RowIterator interface {
+	Next() bool
+	Row() types.MapRow
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	Close() error
+}
+
+type sliceRowIterator struct {
+	rows []map[string]interface{}
+	idx  int
+}
+
+func newSliceRowIterator(rows []map[string]interface{}) *sliceRowIterator {
+	return &sliceRowIterator{rows: rows, idx: -1}
+}
+
+func (s *sliceRowIterator) Next() bool {
+	if s.idx+1 >= len(s.rows) {
+		return false
+	}
+	s.idx++
+	return true
+}
+
+func (s *sliceRowIterator) Row() types.MapRow {
+	if s.idx < 0 || s.idx >= len(s.rows) {
+		return nil
+	}
+	return s.rows[s.idx]
+}
+
+func (s *sliceRowIterator) Err() error {
+	return nil
+}
+
+func (s *sliceRowIterator) Close() error {
+	return nil
+}
+
+// ndjsonRowIterator reads the rows streamed by the server one line at a time, see streamLine.
+type ndjsonRowIterator struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	row     types.MapRow
+	err     error
+}
+
+func newNDJSONRowIterator(body io.ReadCloser) *ndjsonRowIterator {
+	return &ndjsonRowIterator{
+		body:    body,
+		decoder: json.NewDecoder(body),
+	}
+}
+
+func (n *ndjsonRowIterator) Next() bool {
+	if n.err != nil {
+		return false
+	}
+
+	n.row = nil
+	line := &streamLine{}
+	err := n.decoder.Decode(line)
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		n.err = errors.Wrap(err, "could not decode row")
+		return false
+	}
+
+	switch {
+	case line.Error != nil:
+		n.err = line.Error.toError(500)
+		return false
+	case line.Row != nil:
+		n.row = line.Row
+		return true
+	default:
+		n.err = errors.New("unexpected line in the streamed rows")
+		return false
+	}
+}
+
+// streamLine is a line streamed by the server. Each line is an object with a single key:
+// "row" for the rows, or "error" for the error body sent when a command fails after it
+// started streaming rows, since the status can't be changed anymore.
+type streamLine struct {
+	Row   map[string]interface{} `json:"row"`
+	Error *errorBody             `json:"error"`
+}
+
+func (n *ndjsonRowIterator) Row() types.MapRow {
+	return n.row
+}
+
+func (n *ndjsonRowIterator) Err() error {
+	return n.err
+}
+
+func (n *ndjsonRowIterator) Close() error {
+	return n.body.Close()
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONRowIterator(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		rows []map[string]interface{}
+		err  string
+	}{
+		{
+			name: "rows",
+			body: `{"row": {"a": 1}}` + "\n" + `{"row": {}}` + "\n",
+			rows: []map[string]interface{}{{"a": float64(1)}, {}},
+		},
+		{
+			name: "rows looking like errors",
+			body: `{"row": {"error": {"error": "x"}}}` + "\n" + `{"row": {"_error": "x"}}` + "\n",
+			rows: []map[string]interface{}{{"error": map[string]interface{}{"error": "x"}}, {"_error": "x"}},
+		},
+		{
+			name: "error",
+			body: `{"row": {"a": 1}}` + "\n" + `{"error": {"error": "late failure", "code": "internal_server_error"}}` + "\n",
+			rows: []map[string]interface{}{{"a": float64(1)}},
+			err:  "late failure (500)",
+		},
+		{
+			name: "unframed row",
+			body: `{"a": 1}` + "\n",
+			err:  "unexpected line in the streamed rows",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := newNDJSONRowIterator(io.NopCloser(strings.NewReader(tt.body)))
+			defer it.Close()
+			rows := []map[string]interface{}{}
+			for it.Next() {
+				rows = append(rows, it.Row())
+			}
+			if len(tt.rows) > 0 && !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("expected rows %v, got %v", tt.rows, rows)
+			}
+			if tt.err == "" && it.Err() != nil {
+				t.Errorf("unexpected error %v", it.Err())
+			}
+			if tt.err != "" && (it.Err() == nil || it.Err().Error() != tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, it.Err())
+			}
+		})
+	}
+}
@@ -1,18 +1,20 @@
 package pkg
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cli"
 	"github.com/go-go-golems/glazed/pkg/cmds"
 	"github.com/go-go-golems/glazed/pkg/cmds/layers"
 	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
 	"github.com/go-go-golems/glazed/pkg/formatters"
 	"github.com/go-go-golems/glazed/pkg/middlewares"
-	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v3"
-	"io"
-	"mime/multipart"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -20,135 +22,362 @@ type JSONMarshaler interface {
 	MarshalJSON() ([]byte, error)
 }
 
-// parseQueryParameters extracts the query parameters out of a request according to the description in parameters
-func parseQueryParameters(c *gin.Context, ps []*parameters.ParameterDefinition) (map[string]interface{}, error) {
+// parseQueryParameters extracts the query parameters out of a request according to the description in parameters.
+// The prefix is prepended to the name of each parameter when looking it up in the query.
+// File loading parameters are given their content or a reference to a file, see FileLoader.
+// All the invalid parameters are reported together, see parameterErrors.
+func parseQueryParameters(
+	c *gin.Context,
+	files *FileLoader,
+	ps []*parameters.ParameterDefinition,
+	prefix string,
+) (map[string]interface{}, error) {
 	params := make(map[string]interface{})
+	errs := parameterErrors{}
 	for _, p := range ps {
-		// TOOD(manuel, 2023-02-26) this is where we catch the fromfile parameters
-		if parameters.IsFileLoadingParameter(p.Type, c.Query(p.Name)) {
-			// TODO(manuel, 2023-02-11) Implement file upload
-			// See https://github.com/go-go-golems/parka/issues/10
-
-			value := c.Query(p.Name)
-			if value == "" {
-				if p.Required {
-					return nil, fmt.Errorf("required parameter '%s' is missing", p.Name)
-				}
-				params[p.Name] = p.Default
-			} else {
-				f := strings.NewReader(value)
-				pValue, err := p.ParseFromReader(f, "")
-				if err != nil {
-					return nil, fmt.Errorf("invalid value for parameter '%s': (%v) %s", p.Name, value, err.Error())
-				}
-				params[p.Name] = pValue
-			}
-		} else {
-			value := c.Query(p.Name)
-			if value == "" {
-				if p.Required {
-					return nil, fmt.Errorf("required parameter '%s' is missing", p.Name)
-				}
-				params[p.Name] = p.Default
-			} else {
-				pValue, err := p.ParseParameter([]string{value})
-				if err != nil {
-					return nil, fmt.Errorf("invalid value for parameter '%s': (%v) %s", p.Name, value, err.Error())
-				}
-				params[p.Name] = pValue
+		values, err := textValues(p, c.QueryArray(prefix+p.Name), c.QueryArray(prefix+p.Name+"[]"))
+		if err != nil {
+			errs.add(p, prefix+p.Name, "invalid value for parameter '%s': %s", p.Name, err.Error())
+			continue
+		}
+		if len(values) == 0 {
+			if p.Required {
+				errs.add(p, prefix+p.Name, "required parameter '%s' is missing", p.Name)
+				continue
 			}
+			params[p.Name] = p.Default
+			continue
 		}
 
+		pValue, err := parseTextValues(files, p, values)
+		if err != nil {
+			errs.add(p, prefix+p.Name, "invalid value for parameter '%s': (%v) %s", p.Name, strings.Join(values, ","), err.Error())
+			continue
+		}
+		params[p.Name] = pValue
 	}
-	return params, nil
+	return params, errs.err()
 }
 
-func parseStringFromFile(c *gin.Context, name string) (string, error) {
-	file, _, err := c.Request.FormFile(name)
-	if err != nil {
-		return "", fmt.Errorf("error retrieving file '%s': %v", name, err)
-	}
-	defer func(file multipart.File) {
-		err := file.Close()
+// textValues collects the values of the parameter p passed as text, in a query string or a form.
+//
+// List parameters can be given as repeated keys, with the name[] syntax, as comma-separated
+// values, or a mix of them:
+//
+//	?ids=1&ids=2,3&ids[]=4
+//
+// The values of name come first, in the order of the request, followed by those of name[].
+// As on the command line, values are separated by commas in the CSV way, so a value
+// containing a comma can be quoted, for example "a,b". Parameters that are not lists only
+// use their first value, so name takes precedence over name[]. Empty values are ignored.
+func textValues(p *parameters.ParameterDefinition, values []string, bracketValues []string) ([]string, error) {
+	ret := []string{}
+	for _, v := range append(append([]string{}, values...), bracketValues...) {
+		if v == "" {
+			continue
+		}
+		if !isCommaSeparatedList(p, v) {
+			ret = append(ret, v)
+			continue
+		}
+		vs, err := splitCommaSeparatedValue(v)
 		if err != nil {
-			log.Error().Err(err).Msgf("error closing file '%s'", name)
+			return nil, err
 		}
-	}(file)
-
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		return "", fmt.Errorf("error reading contents of file '%s': %v", name, err)
+		ret = append(ret, vs...)
 	}
+	return ret, nil
+}
 
-	return string(fileBytes), nil
+// isCommaSeparatedList returns true if the value v of the parameter p is a comma-separated list.
+// The values of file loading parameters are content or references, which are never split.
+func isCommaSeparatedList(p *parameters.ParameterDefinition, v string) bool {
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeStringList,
+		parameters.ParameterTypeIntegerList,
+		parameters.ParameterTypeFloatList:
+		return true
+	case parameters.ParameterTypeKeyValue:
+		return !strings.HasPrefix(v, "@")
+	default:
+		return false
+	}
 }
 
-func parseObjectFromFile(c *gin.Context, name string) (map[string]interface{}, error) {
-	file, fileHeader, err := c.Request.FormFile(name)
+// splitCommaSeparatedValue splits a comma-separated value the same way as the list flags of cobra.
+func splitCommaSeparatedValue(v string) ([]string, error) {
+	if !strings.Contains(v, `"`) {
+		return strings.Split(v, ","), nil
+	}
+	r := csv.NewReader(strings.NewReader(v))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving file '%s': %v", name, err)
+		return nil, errors.Wrapf(err, "could not split %s", v)
 	}
-	defer func(file multipart.File) {
-		err := file.Close()
-		if err != nil {
-			log.Error().Err(err).Msgf("error closing file '%s'", name)
-		}
-	}(file)
+	ret := []string{}
+	for _, record := range records {
+		ret = append(ret, record...)
+	}
+	return ret, nil
+}
 
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("error reading contents of file '%s': %v", name, err)
+// parseTextValues parses the values of a parameter passed as text, see textValues.
+// Only the first value is used for parameters that are not lists.
+func parseTextValues(files *FileLoader, p *parameters.ParameterDefinition, values []string) (interface{}, error) {
+	if isFileParameter(p) {
+		return parseFiles(p, len(values), func(i int) (interface{}, error) {
+			return files.parseFileValue(p, values[i])
+		})
+	}
+	if p.Type == parameters.ParameterTypeKeyValue && strings.HasPrefix(values[0], "@") {
+		return files.parseFileValue(p, values[0])
 	}
+	if !parameters.IsListParameter(p.Type) {
+		values = values[:1]
+	}
+	return p.ParseParameter(values)
+}
+
+// parseFormData extracts the form fields and uploaded files of a POST request according to
+// the description in ps. The prefix is prepended to the name of each parameter when looking it up.
+// File loading parameters are given either uploaded files, or text values as in the query
+// string. The multipart form has to be parsed beforehand, see Server.parseForm.
+func parseFormData(
+	c *gin.Context,
+	files *FileLoader,
+	ps []*parameters.ParameterDefinition,
+	prefix string,
+) (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	errs := parameterErrors{}
+	for _, p := range ps {
+		name := prefix + p.Name
+
+		if fhs := append(formFiles(c, name), formFiles(c, name+"[]")...); len(fhs) > 0 && (isFileParameter(p) || p.Type == parameters.ParameterTypeKeyValue) {
+			pValue, err := parseFiles(p, len(fhs), func(i int) (interface{}, error) {
+				return parseUploadedFile(p, fhs[i])
+			})
+			if err != nil {
+				errs.add(p, name, "invalid file for parameter '%s': %s", p.Name, err.Error())
+				continue
+			}
+			params[p.Name] = pValue
+			continue
+		}
 
-	var obj map[string]interface{}
-	if strings.HasSuffix(fileHeader.Filename, ".json") {
-		err = json.Unmarshal(fileBytes, &obj)
+		values, err := textValues(p, c.PostFormArray(name), c.PostFormArray(name+"[]"))
 		if err != nil {
-			return nil, fmt.Errorf("error parsing contents of file '%s' as JSON: %v", fileHeader.Filename, err)
+			errs.add(p, name, "invalid value for parameter '%s': %s", p.Name, err.Error())
+			continue
 		}
-	} else if strings.HasSuffix(fileHeader.Filename, ".yaml") || strings.HasSuffix(fileHeader.Filename, ".yml") {
-		err = yaml.Unmarshal(fileBytes, &obj)
+		if len(values) == 0 {
+			if p.Required {
+				errs.add(p, name, "required parameter '%s' is missing", p.Name)
+				continue
+			}
+			params[p.Name] = p.Default
+			continue
+		}
+
+		pValue, err := parseTextValues(files, p, values)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing contents of file '%s' as YAML: %v", fileHeader.Filename, err)
+			errs.add(p, name, "invalid value for parameter '%s': (%v) %s", p.Name, strings.Join(values, ","), err.Error())
+			continue
 		}
-	} else {
-		return nil, fmt.Errorf("unsupported file format for file '%s'", fileHeader.Filename)
+		params[p.Name] = pValue
 	}
-
-	return obj, nil
+	return params, errs.err()
 }
 
-func parseFormData(c *gin.Context, ps []*parameters.ParameterDefinition) (map[string]interface{}, error) {
+// parseJSONParameters extracts the parameters out of a decoded JSON object according to the description in ps.
+// The prefix is prepended to the name of each parameter when looking it up in the object.
+func parseJSONParameters(
+	files *FileLoader,
+	values map[string]interface{},
+	ps []*parameters.ParameterDefinition,
+	prefix string,
+) (map[string]interface{}, error) {
 	params := make(map[string]interface{})
+	errs := parameterErrors{}
 	for _, p := range ps {
-		value := c.PostForm(p.Name)
-		if value == "" {
+		value, ok := values[prefix+p.Name]
+		if !ok || value == nil {
 			if p.Required {
-				return nil, fmt.Errorf("required parameter '%s' is missing", p.Name)
+				errs.add(p, prefix+p.Name, "required parameter '%s' is missing", p.Name)
+				continue
 			}
 			params[p.Name] = p.Default
-		} else if p.Type != parameters.ParameterTypeStringFromFile && p.Type != parameters.ParameterTypeObjectFromFile {
-			pValue, err := p.ParseParameter([]string{value})
-			if err != nil {
-				return nil, fmt.Errorf("invalid value for parameter '%s': (%v) %s", p.Name, value, err.Error())
-			}
-			params[p.Name] = pValue
-		} else if p.Type == parameters.ParameterTypeStringFromFile {
-			s, err := parseStringFromFile(c, p.Name)
-			if err != nil {
-				return nil, err
+			continue
+		}
+
+		pValue, err := parseJSONValue(files, p, value)
+		if err != nil {
+			errs.add(p, prefix+p.Name, "invalid value for parameter '%s': (%v) %s", p.Name, value, err.Error())
+			continue
+		}
+		params[p.Name] = pValue
+	}
+	return params, errs.err()
+}
+
+// parseJSONBody decodes the JSON object sent as the body of a request.
+func parseJSONBody(c *gin.Context) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	err := json.NewDecoder(c.Request.Body).Decode(&values)
+	if err != nil {
+		return nil, NewHTTPError(http.StatusBadRequest, "could not parse JSON body: %v", err).WithCode("invalid_body")
+	}
+
+	return values, nil
+}
+
+// checkUnknownParameters checks that values only contains parameters declared by the command,
+// either as flags, arguments or as part of one of its layers.
+func checkUnknownParameters(values map[string]interface{}, description *cmds.CommandDescription) error {
+	known := map[string]bool{}
+	for _, p := range append(description.Flags, description.Arguments...) {
+		known[p.Name] = true
+	}
+	for _, layer := range description.Layers {
+		for name := range layer.GetParameterDefinitions() {
+			known[layer.GetPrefix()+name] = true
+		}
+	}
+
+	unknown := []string{}
+	for k := range values {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+
+	errs := parameterErrors{}
+	for _, k := range unknown {
+		errs.add(nil, k, "unknown parameter '%s'", k)
+	}
+	return errs.err()
+}
+
+// parseJSONCommandParameters parses the layers, flags and arguments of a command from
+// a decoded JSON object, which may only contain parameters declared by the command.
+func parseJSONCommandParameters(
+	files *FileLoader,
+	description *cmds.CommandDescription,
+	values map[string]interface{},
+) (map[string]*layers.ParsedParameterLayer, map[string]interface{}, error) {
+	unknownErr := checkUnknownParameters(values, description)
+	parsedLayers, ps, layersErr := parseLayers(description, NewJSONParameterLayerParser(values, files))
+	flags, flagsErr := parseJSONParameters(files, values, append(description.Flags, description.Arguments...), "")
+	err := mergeParameterErrors(unknownErr, layersErr, flagsErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range flags {
+		ps[k] = v
+	}
+
+	return parsedLayers, ps, nil
+}
+
+// parseJSONValue coerces a value decoded from JSON to the type of the parameter p.
+//
+// Scalars and lists are converted back to their string representation and parsed the
+// same way as the values of a query string, so that they end up with exactly the same types.
+// File loading parameters are given their value directly, or as a string with the content
+// of a file or a reference to it, see FileLoader.
+func parseJSONValue(files *FileLoader, p *parameters.ParameterDefinition, value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok && isFileParameter(p) {
+		return files.parseFileValue(p, s)
+	}
+
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeObjectFromFile:
+		if m, ok := value.(map[string]interface{}); ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("expected an object, got %T", value)
+
+	case parameters.ParameterTypeObjectListFromFile:
+		v, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a list of objects, got %T", value)
+		}
+		for _, o := range v {
+			if _, ok := o.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("expected a list of objects, got a %T element", o)
 			}
-			params[p.Name] = s
-		} else if p.Type == parameters.ParameterTypeObjectFromFile {
-			obj, err := parseObjectFromFile(c, p.Name)
+		}
+		return v, nil
+
+	case parameters.ParameterTypeKeyValue:
+		if m, ok := value.(map[string]interface{}); ok {
+			return m, nil
+		}
+
+	case parameters.ParameterTypeStringFromFile:
+		return nil, fmt.Errorf("expected a string, got %T", value)
+
+	case parameters.ParameterTypeStringListFromFile:
+		return jsonValueToStrings(value)
+	}
+
+	vs, err := jsonValueToStrings(value)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := value.(string); ok && isCommaSeparatedList(p, s) {
+		// a string is split like the value of a query string, the elements of a list are not
+		vs, err = splitCommaSeparatedValue(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(vs) > 1 && !parameters.IsListParameter(p.Type) {
+		return nil, fmt.Errorf("expected a single value, got a list")
+	}
+	if len(vs) == 0 {
+		return p.ParseParameter(vs)
+	}
+
+	return parseTextValues(files, p, vs)
+}
+
+// jsonValueToStrings converts a scalar or a list of scalars decoded from JSON to a list of strings.
+func jsonValueToStrings(value interface{}) ([]string, error) {
+	if l, ok := value.([]interface{}); ok {
+		ret := []string{}
+		for _, v := range l {
+			s, err := jsonScalarToString(v)
 			if err != nil {
 				return nil, err
 			}
-			params[p.Name] = obj
+			ret = append(ret, s)
 		}
+		return ret, nil
+	}
 
+	s, err := jsonScalarToString(value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+func jsonScalarToString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unexpected value of type %T", value)
 	}
-	return params, nil
 }
 
 type ParkaCommand interface {
@@ -171,119 +400,342 @@ func (s *SimpleParkaCommand) RunFromParka(
 	parameters map[string]interface{},
 	gp *cmds.GlazeProcessor,
 ) error {
-	// TODO(manuel, 2023-02-27) Add parsed layers support
 	return s.Command.Run(c, parsedLayers, parameters, gp)
 }
 
+// ForwardingCommand is implemented by commands handling their API requests themselves instead
+// of having their parameters parsed, such as the commands of an upstream server.
+type ForwardingCommand interface {
+	ParkaCommand
+	ForwardRequest(c *gin.Context)
+}
+
 func NewSimpleParkaCommand(c cmds.Command) *SimpleParkaCommand {
 	return &SimpleParkaCommand{c}
 }
 
+// commandPath returns the path of a command below the command endpoints, made of
+// its parents and its name.
+func commandPath(description *cmds.CommandDescription) string {
+	return strings.Join(append(append([]string{}, description.Parents...), description.Name), "/")
+}
+
+// lookupCommandFromPath looks up the command addressed by the *path parameter of a route,
+// and responds with a 404 if there is none, or a 403 if the caller may not run it.
+func (s *Server) lookupCommandFromPath(c *gin.Context) (ParkaCommand, bool) {
+	path := c.Param("path")
+	cmd, ok := s.LookupCommand(path)
+	if !ok {
+		writeError(c, newUnknownCommandError(path))
+		return nil, false
+	}
+	err := s.authorize(c, cmd, nil)
+	if err != nil {
+		writeError(c, err)
+		return nil, false
+	}
+	return cmd, true
+}
+
+// canForward returns true if the request can be forwarded as is, which is not the case when
+// its parameters have to be checked against the policies.
+func (s *Server) canForward(cmd ParkaCommand) (ForwardingCommand, bool) {
+	fc, ok := cmd.(ForwardingCommand)
+	if !ok || (s.Policies != nil && s.Policies.HasParameterConstraints(cmd.Description())) {
+		return nil, false
+	}
+	return fc, true
+}
+
+// forward forwards the request to fc once a slot is free, see Limit.Concurrency.
+func (s *Server) forward(c *gin.Context, cmd ParkaCommand, fc ForwardingCommand) {
+	release, err := s.acquireSlot(c, cmd)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	defer release()
+	fc.ForwardRequest(c)
+}
+
+// serveCommands exposes the commands at /api/command/<parents>/<name>.
+//
+// The command is looked up on each request, so that commands can be swapped while the
+// server is running. Requests that already started keep running the command they looked up.
 func (s *Server) serveCommands() {
-	apiCmds := []interface{}{}
+	s.Router.GET("/api/command/*path", func(c *gin.Context) {
+		cmd, ok := s.lookupCommandFromPath(c)
+		if !ok {
+			return
+		}
+		err := s.limitRate(c, cmd)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if fc, ok := s.canForward(cmd); ok {
+			s.forward(c, cmd, fc)
+			return
+		}
 
-	// this probably should be exposed as a constructor argument, instead
-	// making this generic and adding commands up front.
-	//
-	// Something with either WithCommand() at ocnstructor time,
-	// or probably better ServeCommand() once the server is created.
-	for _, cmd := range s.Commands {
-		description := cmd.Description()
+		parsedLayers, ps, err := parseQueryCommandParameters(c, s.Files, cmd.Description())
+		if err != nil {
+			writeError(c, err)
+			return
+		}
 
-		if jm, ok := cmd.(JSONMarshaler); ok {
-			apiCmds = append(apiCmds, jm)
-		} else {
-			apiCmds = append(apiCmds, description)
+		err = s.checkParameters(c, cmd, ps)
+		if err != nil {
+			writeError(c, err)
+			return
 		}
 
-		path := "/api/command/" + strings.Join(description.Parents, "/") + "/" + description.Name
+		s.runCommand(c, cmd, parsedLayers, ps)
+	})
 
-		// GET and POST (?)
-		s.Router.GET(path, func(c *gin.Context) {
-			// TODO(manuel, 2023-02-27) Parse layers
-			flags, err := parseQueryParameters(c, append(description.Flags, description.Arguments...))
-			if err != nil {
-				c.JSON(400, gin.H{"error": err.Error()})
-				return
-			}
+	s.Router.POST("/api/command/*path", func(c *gin.Context) {
+		cmd, ok := s.lookupCommandFromPath(c)
+		if !ok {
+			return
+		}
+		err := s.limitRate(c, cmd)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if fc, ok := s.canForward(cmd); ok {
+			s.forward(c, cmd, fc)
+			return
+		}
 
-			parsedLayers := map[string]*layers.ParsedParameterLayer{}
+		parsedLayers, ps, err := s.parsePostParameters(c, cmd.Description())
+		if err != nil {
+			writeError(c, err)
+			return
+		}
 
-			of, gp, _ := SetupProcessor()
+		err = s.checkParameters(c, cmd, ps)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
 
-			err = cmd.RunFromParka(c, parsedLayers, flags, gp)
-			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
-			}
+		s.runCommand(c, cmd, parsedLayers, ps)
+	})
 
-			// get gp output
-			_, err = of.Output()
-			if err != nil {
-				c.JSON(500, gin.H{"error": err.Error()})
-				return
+	s.Router.GET("/api/commands", func(c *gin.Context) {
+		apiCmds := []interface{}{}
+		for _, cmd := range s.listCommands(c) {
+			if jm, ok := cmd.(JSONMarshaler); ok {
+				apiCmds = append(apiCmds, jm)
+			} else {
+				apiCmds = append(apiCmds, cmd.Description())
 			}
+		}
+		c.JSON(200, apiCmds)
+	})
+}
 
-			rows := []map[string]interface{}{}
-			for _, row := range of.Table.Rows {
-				rows = append(rows, row.GetValues())
-			}
+// parseQueryCommandParameters parses the layers, flags and arguments of a command from
+// the query parameters of a request.
+func parseQueryCommandParameters(
+	c *gin.Context,
+	files *FileLoader,
+	description *cmds.CommandDescription,
+) (map[string]*layers.ParsedParameterLayer, map[string]interface{}, error) {
+	parsedLayers, ps, layersErr := parseLayers(description, NewQueryParameterLayerParser(c, files))
+	flags, flagsErr := parseQueryParameters(c, files, append(description.Flags, description.Arguments...), "")
+	err := mergeParameterErrors(layersErr, flagsErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range flags {
+		ps[k] = v
+	}
 
-			c.JSON(200, rows)
-		})
+	return parsedLayers, ps, nil
+}
 
-		s.Router.POST(path, func(c *gin.Context) {
-			// check if we are multiform data POST
-			// if so, parse the form data
-
-			if c.ContentType() == "multipart/form-data" {
-				// parse the form data
-				flags, err := parseFormData(c, description.Flags)
-				if err != nil {
-					c.JSON(400, gin.H{"error": err.Error()})
-					return
-				}
-
-				of, gp, _ := SetupProcessor()
-
-				// TODO(manuel, 2023-02-27) parse layers
-				parsedLayers := map[string]*layers.ParsedParameterLayer{}
-				err = cmd.RunFromParka(c, parsedLayers, flags, gp)
-				if err != nil {
-					c.JSON(500, gin.H{"error": err.Error()})
-					return
-				}
-
-				// get gp output
-				_, err = of.Output()
-				if err != nil {
-					c.JSON(500, gin.H{"error": err.Error()})
-					return
-				}
-
-				rows := []map[string]interface{}{}
-				for _, row := range of.Table.Rows {
-					rows = append(rows, row.GetValues())
-				}
-
-				c.JSON(200, rows)
-			}
+// parsePostParameters parses the parameters of a command from the body of a POST request,
+// either form data or a JSON object.
+func (s *Server) parsePostParameters(
+	c *gin.Context,
+	description *cmds.CommandDescription,
+) (map[string]*layers.ParsedParameterLayer, map[string]interface{}, error) {
+	switch c.ContentType() {
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+		err := s.parseForm(c)
+		if err != nil {
+			return nil, nil, err
+		}
 
-		})
+		parsedLayers, ps, layersErr := parseLayers(description, NewFormParameterLayerParser(c, s.Files))
+
+		flags, flagsErr := parseFormData(c, s.Files, append(description.Flags, description.Arguments...), "")
+		err = mergeParameterErrors(layersErr, flagsErr)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range flags {
+			ps[k] = v
+		}
+
+		return parsedLayers, ps, nil
+
+	case "application/json":
+		values, err := parseJSONBody(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return parseJSONCommandParameters(s.Files, description, values)
+
+	default:
+		return nil, nil, NewHTTPError(http.StatusUnsupportedMediaType, "unsupported content type '%s'", c.ContentType())
 	}
+}
 
-	s.Router.GET("/api/commands", func(c *gin.Context) {
-		c.JSON(200, apiCmds)
-	})
+// runCommand runs cmd with the parsed parameters and renders its output in the format
+// negotiated with the client. Errors returned by the command are reported with the
+// status of their HTTPError, or a 500.
+func (s *Server) runCommand(
+	c *gin.Context,
+	cmd ParkaCommand,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+) {
+	format, status, err := NegotiateOutputFormat(c)
+	if err != nil {
+		writeError(c, NewHTTPError(status, "%s", err.Error()))
+		return
+	}
+
+	if format.Streaming {
+		s.runCommandStreaming(c, cmd, format, parsedLayers, ps)
+		return
+	}
+
+	of, gp, err := SetupProcessor(format, parsedLayers)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
 
+	entry, err := s.runFromParka(c, cmd, parsedLayers, ps, gp)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if entry != nil && c.Request.Method == http.MethodGet && s.writeNotModified(c, entry, format) {
+		return
+	}
+
+	err = format.WriteOutput(c, of, cmd.Description().Name)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
 }
 
-func SetupProcessor() (*formatters.JSONOutputFormatter, *cmds.GlazeProcessor, error) {
-	// TODO(manuel, 2023-02-11) For now, create a raw JSON output formatter. We will want more nuance here
-	// See https://github.com/go-go-golems/parka/issues/8
+// SetupProcessor creates the glazed processor and the output formatter used to render
+// the rows of a command in the given format.
+func SetupProcessor(
+	format *OutputFormat,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+) (formatters.OutputFormatter, *cmds.GlazeProcessor, error) {
+	of, err := format.CreateOutputFormatter()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	of := formatters.NewJSONOutputFormatter(true)
-	gp := cmds.NewGlazeProcessor(of, []middlewares.ObjectMiddleware{})
+	gp, err := NewGlazeProcessor(of, parsedLayers)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return of, gp, nil
 }
+
+// NewGlazeProcessor creates a glazed processor writing to the given output formatter.
+//
+// If the command declares glazed layers (fields, filters, renames, ...), the parameters
+// parsed for them are used to add middlewares the same way glazed's cli.SetupProcessor
+// does on the command line. The output format itself is always the one chosen by parka,
+// which is why the select flags only restrict the fields of the output.
+func NewGlazeProcessor(
+	of formatters.OutputFormatter,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+) (*cmds.GlazeProcessor, error) {
+	ps := map[string]interface{}{}
+	for slug, parsedLayer := range parsedLayers {
+		if slug != "glazed" && !strings.HasPrefix(slug, "glazed-") {
+			continue
+		}
+		for k, v := range parsedLayer.Parameters {
+			ps[k] = v
+		}
+	}
+
+	if len(ps) == 0 {
+		return cmds.NewGlazeProcessor(of, []middlewares.ObjectMiddleware{}), nil
+	}
+
+	templateSettings, err := cli.NewTemplateSettings(ps)
+	if err != nil {
+		return nil, err
+	}
+	outputSettings, err := cli.NewOutputFormatterSettings(ps)
+	if err != nil {
+		return nil, err
+	}
+	selectSettings, err := cli.NewSelectSettingsFromParameters(ps)
+	if err != nil {
+		return nil, err
+	}
+	renameSettings, err := cli.NewRenameSettingsFromParameters(ps)
+	if err != nil {
+		return nil, err
+	}
+	fieldsFilterSettings, err := cli.NewFieldsFilterSettings(ps)
+	if err != nil {
+		return nil, err
+	}
+	replaceSettings, err := cli.NewReplaceSettingsFromParameters(ps)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldsFilterSettings.UpdateWithSelectSettings(selectSettings)
+	templateSettings.UpdateWithSelectSettings(selectSettings)
+
+	err = renameSettings.AddMiddlewares(of)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error adding rename middlewares")
+	}
+
+	err = templateSettings.AddMiddlewares(of)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error adding template middlewares")
+	}
+
+	if outputSettings.FlattenObjects {
+		of.AddTableMiddleware(middlewares.NewFlattenObjectMiddleware())
+	}
+	fieldsFilterSettings.AddMiddlewares(of)
+
+	err = replaceSettings.AddMiddlewares(of)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error adding replace middlewares")
+	}
+
+	oms := []middlewares.ObjectMiddleware{}
+	if !templateSettings.UseRowTemplates && len(templateSettings.Templates) > 0 {
+		ogtm, err := middlewares.NewObjectGoTemplateMiddleware(templateSettings.Templates)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not process template argument")
+		}
+		oms = append(oms, ogtm)
+	}
+
+	return cmds.NewGlazeProcessor(of, oms), nil
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newParametersCommand returns an echo command with parameters of the common types.
+func newParametersCommand() *testCommand {
+	return newEchoCommand("echo",
+		&parameters.ParameterDefinition{Name: "name", Type: parameters.ParameterTypeString, Required: true},
+		&parameters.ParameterDefinition{Name: "count", Type: parameters.ParameterTypeInteger, Default: 1},
+		&parameters.ParameterDefinition{Name: "verbose", Type: parameters.ParameterTypeBool},
+		&parameters.ParameterDefinition{Name: "ids", Type: parameters.ParameterTypeIntegerList},
+		&parameters.ParameterDefinition{Name: "tags", Type: parameters.ParameterTypeStringList},
+		&parameters.ParameterDefinition{Name: "config", Type: parameters.ParameterTypeObjectFromFile},
+		&parameters.ParameterDefinition{
+			Name: "mode", Type: parameters.ParameterTypeChoice,
+			Choices: []string{"fast", "slow"}, Default: "fast",
+		},
+	)
+}
+
+// expectInvalidParameters returns a check of the parameters reported by an invalid_parameters error.
+func expectInvalidParameters(names ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		e := decodeError(t, w)
+		if e.Code != ErrorCodeInvalidParameters {
+			t.Errorf("expected code %s, got %s", ErrorCodeInvalidParameters, e.Code)
+		}
+		invalid := []string{}
+		for _, p := range e.Parameters {
+			invalid = append(invalid, p.Parameter)
+		}
+		if !reflect.DeepEqual(invalid, names) {
+			t.Errorf("expected %v to be invalid, got %v", names, invalid)
+		}
+	}
+}
+
+func TestPostParameters(t *testing.T) {
+	s := newTestServer(t, WithCommands(newParametersCommand()))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "json",
+			method: http.MethodPost, target: "/api/command/echo",
+			body:   `{"name": "x", "count": "3", "verbose": true, "ids": [1, 2], "config": {"a": {"b": 1}}}`,
+			status: http.StatusOK,
+			check: expectRow(map[string]interface{}{
+				"name":    "x",
+				"count":   float64(3),
+				"verbose": true,
+				"ids":     []interface{}{float64(1), float64(2)},
+				"tags":    nil,
+				"config":  map[string]interface{}{"a": map[string]interface{}{"b": float64(1)}},
+				"mode":    "fast",
+			}),
+		},
+		{
+			name:   "invalid json parameters",
+			method: http.MethodPost, target: "/api/command/echo",
+			body:   `{"count": "many", "mode": "medium"}`,
+			status: http.StatusBadRequest,
+			check:  expectInvalidParameters("name", "count", "mode"),
+		},
+		{
+			name:   "json array",
+			method: http.MethodPost, target: "/api/command/echo",
+			body:   `[1, 2]`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "unsupported content type",
+			method: http.MethodPost, target: "/api/command/echo",
+			body: "name=x", contentType: "text/plain",
+			status: http.StatusUnsupportedMediaType,
+		},
+	})
+}
+
+func TestListParameters(t *testing.T) {
+	s := newTestServer(t, WithCommands(newParametersCommand()))
+
+	tests := []struct {
+		name  string
+		query string
+		tags  []interface{}
+		ids   []interface{}
+	}{
+		{"repeated", "tags=a&tags=b&ids=1&ids=2", []interface{}{"a", "b"}, []interface{}{1.0, 2.0}},
+		{"brackets", "tags[]=a&tags[]=b&ids[]=3", []interface{}{"a", "b"}, []interface{}{3.0}},
+		{"comma separated", "tags=a,b&ids=1,2,3", []interface{}{"a", "b"}, []interface{}{1.0, 2.0, 3.0}},
+		{"plain values first", "tags[]=c&tags=a,b", []interface{}{"a", "b", "c"}, nil},
+		{"quoted commas", `tags="a,b",c`, []interface{}{"a,b", "c"}, nil},
+		{"empty values skipped", "tags=&tags=a&ids=", []interface{}{"a"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(s, "/api/command/echo?name=x&"+strings.ReplaceAll(tt.query, `"`, "%22"))
+			expectStatus(t, w, http.StatusOK)
+			row := decodeRows(t, w)[0]
+			if !reflect.DeepEqual(row["tags"], tt.tags) {
+				t.Errorf("expected tags %v, got %v", tt.tags, row["tags"])
+			}
+			if tt.ids != nil && !reflect.DeepEqual(row["ids"], tt.ids) {
+				t.Errorf("expected ids %v, got %v", tt.ids, row["ids"])
+			}
+		})
+	}
+}
+
+func TestPostListParameters(t *testing.T) {
+	s := newTestServer(t, WithCommands(newParametersCommand()))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "form",
+			method: http.MethodPost, target: "/api/command/echo",
+			body: "name=x&tags=a,b&tags[]=c&ids[]=1&ids[]=2", contentType: "application/x-www-form-urlencoded",
+			status: http.StatusOK,
+			check: expectRow(map[string]interface{}{
+				"tags": []interface{}{"a", "b", "c"},
+				"ids":  []interface{}{1.0, 2.0},
+			}),
+		},
+		{
+			// strings are split like query values
+			name:   "json strings",
+			method: http.MethodPost, target: "/api/command/echo",
+			body:   `{"name": "a,b", "tags": "a,b", "ids": "1,2"}`,
+			status: http.StatusOK,
+			check: expectRow(map[string]interface{}{
+				"name": "a,b",
+				"tags": []interface{}{"a", "b"},
+				"ids":  []interface{}{1.0, 2.0},
+			}),
+		},
+		{
+			// array elements are kept as is
+			name:   "json arrays",
+			method: http.MethodPost, target: "/api/command/echo",
+			body:   `{"name": "x", "tags": ["a,b", "c"]}`,
+			status: http.StatusOK,
+			check:  expectRow(map[string]interface{}{"tags": []interface{}{"a,b", "c"}}),
+		},
+		{
+			name:   "invalid element",
+			target: "/api/command/echo?name=x&ids=1,two",
+			status: http.StatusBadRequest,
+			check:  expectInvalidParameters("ids"),
+		},
+	})
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type APIDocsCommand struct {
+	Name string
+	// Path is the command path, see commandPath
+	Path   string
+	Short  string
+	Long   template.HTML
+	Fields []*FormField
+}
+
+// APIDocsGroup contains the commands sharing the same parents.
+type APIDocsGroup struct {
+	Name     string
+	Commands []*APIDocsCommand
+}
+
+type APIDocsPage struct {
+	Groups        []*APIDocsGroup
+	OutputFormats []*OutputFormat
+}
+
+func newAPIDocsPage(commands []ParkaCommand) *APIDocsPage {
+	groups := map[string]*APIDocsGroup{}
+	for _, cmd := range commands {
+		description := cmd.Description()
+
+		groupName := strings.Join(description.Parents, "/")
+		group, ok := groups[groupName]
+		if !ok {
+			group = &APIDocsGroup{Name: groupName}
+			groups[groupName] = group
+		}
+
+		command := &APIDocsCommand{
+			Name:  description.Name,
+			Path:  commandPath(description),
+			Short: description.Short,
+		}
+		for _, section := range newFormSections(description, nil) {
+			command.Fields = append(command.Fields, section.Fields...)
+		}
+		if description.Long != "" {
+			long, err := RenderMarkdownToHTML(description.Long)
+			if err != nil {
+				log.Warn().Err(err).Str("command", description.Name).Msg("could not render long description")
+			} else {
+				command.Long = template.HTML(long)
+			}
+		}
+
+		group.Commands = append(group.Commands, command)
+	}
+
+	page := &APIDocsPage{
+		OutputFormats: OutputFormats,
+	}
+	for _, group := range groups {
+		sort.Slice(group.Commands, func(i, j int) bool {
+			return group.Commands[i].Name < group.Commands[j].Name
+		})
+		page.Groups = append(page.Groups, group)
+	}
+	sort.Slice(page.Groups, func(i, j int) bool {
+		return page.Groups[i].Name < page.Groups[j].Name
+	})
+
+	return page
+}
+
+// serveAPIDocs serves an interactive explorer of the command API at /api/docs, rendered
+// with the api-docs.tmpl.html template.
+func (s *Server) serveAPIDocs() {
+	s.Router.GET("/api/docs", func(c *gin.Context) {
+		s.renderTemplate(c, http.StatusOK, "api-docs.tmpl.html", newAPIDocsPage(s.listCommands(c)))
+	})
+}
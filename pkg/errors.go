@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorCodeInvalidParameters is the code of the errors listing the invalid parameters of a request.
+const ErrorCodeInvalidParameters = "invalid_parameters"
+
+// HTTPError is an error reported with a specific HTTP status. It is rendered as:
+//
+//	{
+//	  "error": "invalid value for parameter 'count': ...",
+//	  "code": "invalid_parameters",
+//	  "parameters": [
+//	    {"parameter": "count", "message": "...", "type": "int"}
+//	  ]
+//	}
+//
+// Commands can return it from RunFromParka to choose the status of the response:
+//
+//	return pkg.NewHTTPError(http.StatusNotFound, "no user named %s", name)
+//
+// Other errors returned by commands are reported as a 500.
+type HTTPError struct {
+	Status int `json:"-"`
+	// Code identifies the kind of error, by default derived from the status, for example "not_found"
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	// Parameters are the invalid parameters of the request
+	Parameters []*ParameterError `json:"parameters,omitempty"`
+	// RetryAfter is the number of seconds after which the request can be retried, also sent
+	// as the Retry-After header
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// ParameterError describes why a parameter of a request is invalid.
+type ParameterError struct {
+	Parameter string `json:"parameter"`
+	Message   string `json:"message"`
+	// Type is the expected type of the parameter
+	Type    string   `json:"type,omitempty"`
+	Choices []string `json:"choices,omitempty"`
+}
+
+func NewHTTPError(status int, format string, args ...interface{}) *HTTPError {
+	return &HTTPError{
+		Status:  status,
+		Code:    statusErrorCode(status),
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// WithCode replaces the code of the error, so that clients can tell apart errors with the same status.
+func (e *HTTPError) WithCode(code string) *HTTPError {
+	e.Code = code
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// statusErrorCode derives an error code from an HTTP status, for example "unprocessable_entity".
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(text, " ", "_"), "-", "_"))
+}
+
+func newUnknownCommandError(path string) *HTTPError {
+	return NewHTTPError(http.StatusNotFound, "unknown command '%s'", strings.Trim(path, "/")).WithCode("unknown_command")
+}
+
+// parameterErrors collects the invalid parameters of a request, so that they are all
+// reported at once.
+type parameterErrors []*ParameterError
+
+func (pe *parameterErrors) add(p *parameters.ParameterDefinition, name string, format string, args ...interface{}) {
+	e := &ParameterError{
+		Parameter: name,
+		Message:   fmt.Sprintf(format, args...),
+	}
+	if p != nil {
+		e.Type = string(p.Type)
+		if p.Type == parameters.ParameterTypeChoice {
+			e.Choices = p.Choices
+		}
+	}
+	*pe = append(*pe, e)
+}
+
+// err returns nil if no parameter is invalid, and a 400 *HTTPError listing them otherwise.
+func (pe parameterErrors) err() error {
+	if len(pe) == 0 {
+		return nil
+	}
+
+	msg := pe[0].Message
+	if len(pe) > 1 {
+		msgs := []string{}
+		for _, e := range pe {
+			msgs = append(msgs, e.Message)
+		}
+		msg = fmt.Sprintf("%d invalid parameters: %s", len(pe), strings.Join(msgs, "; "))
+	}
+
+	return &HTTPError{
+		Status:     http.StatusBadRequest,
+		Code:       ErrorCodeInvalidParameters,
+		Message:    msg,
+		Parameters: pe,
+	}
+}
+
+// mergeParameterErrors combines the invalid parameters reported by errs into a single error.
+// If one of errs is not about invalid parameters, it is returned as is.
+func mergeParameterErrors(errs ...error) error {
+	ret := parameterErrors{}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var httpError *HTTPError
+		if !errors.As(err, &httpError) || httpError.Code != ErrorCodeInvalidParameters {
+			return err
+		}
+		ret = append(ret, httpError.Parameters...)
+	}
+	return ret.err()
+}
+
+// toHTTPError returns the status and body err is reported with.
+func toHTTPError(err error) *HTTPError {
+	var httpError *HTTPError
+	if errors.As(err, &httpError) {
+		return httpError
+	}
+	var forbiddenError *ForbiddenError
+	if errors.As(err, &forbiddenError) {
+		return NewHTTPError(http.StatusForbidden, "%s", forbiddenError.Message)
+	}
+	return NewHTTPError(http.StatusInternalServerError, "%s", err.Error())
+}
+
+// errorStatus returns the HTTP status err is reported with.
+func errorStatus(err error) int {
+	return toHTTPError(err).Status
+}
+
+// writeError responds with the JSON body of err, see HTTPError.
+func writeError(c *gin.Context, err error) {
+	if errors.Is(err, context.Canceled) && c.Request.Context().Err() != nil {
+		// the client went away, there is nobody to respond to
+		return
+	}
+	e := toHTTPError(err)
+	setRetryAfter(c, e)
+	c.JSON(e.Status, e)
+}
+
+// setRetryAfter sets the Retry-After header of the response if err tells when to retry.
+func setRetryAfter(c *gin.Context, err error) {
+	e := toHTTPError(err)
+	if e.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+}
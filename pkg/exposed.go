@@ -0,0 +1,381 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+)
+
+// ParameterValidator is implemented by commands checking their parsed parameters further
+// than their parameter definitions do. Errors are reported as invalid parameters, or with
+// their own status if they are an *HTTPError.
+type ParameterValidator interface {
+	ValidateParameters(ps map[string]interface{}) error
+}
+
+type parameterRange struct {
+	min *float64
+	max *float64
+}
+
+// exposedLayer is a copy of a layer of the command, so that its parameters can be changed
+// without touching the original layer.
+type exposedLayer struct {
+	layers.ParameterLayer
+	definitions map[string]*parameters.ParameterDefinition
+}
+
+func newExposedLayer(layer layers.ParameterLayer) *exposedLayer {
+	ret := &exposedLayer{
+		ParameterLayer: layer,
+		definitions:    map[string]*parameters.ParameterDefinition{},
+	}
+	for name, p := range layer.GetParameterDefinitions() {
+		p_ := *p
+		ret.definitions[name] = &p_
+	}
+	return ret
+}
+
+func (l *exposedLayer) GetParameterDefinitions() map[string]*parameters.ParameterDefinition {
+	return l.definitions
+}
+
+func (l *exposedLayer) AddFlag(flag *parameters.ParameterDefinition) {
+	l.definitions[flag.Name] = flag
+}
+
+// MarshalJSON outputs the layer like a layers.ParameterLayerImpl, with the exposed parameters.
+func (l *exposedLayer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&layers.ParameterLayerImpl{
+		Name:        l.GetName(),
+		Slug:        l.GetSlug(),
+		Description: l.GetDescription(),
+		Prefix:      l.GetPrefix(),
+		Flags:       getLayerParameterDefinitions(l),
+	})
+}
+
+// exposedParameter is a flag, an argument or the parameter of a layer of an ExposedCommand.
+// Layer parameters are exposed under the prefix of their layer followed by their name.
+type exposedParameter struct {
+	name       string
+	definition *parameters.ParameterDefinition
+	// layer is nil for flags and arguments
+	layer *exposedLayer
+}
+
+// hiddenParameter is the value passed to the command for a parameter that is not exposed.
+type hiddenParameter struct {
+	definition *parameters.ParameterDefinition
+	// layer is the slug of the layer of the parameter, empty for flags and arguments
+	layer string
+	value interface{}
+}
+
+// ExposedCommand changes how the parameters of a command are exposed over the web, without
+// touching the definition of the command used on the command line. Parameters can be hidden,
+// pinned to a fixed value, or get other defaults, choices and ranges.
+//
+// Layer parameters are referred to by the name they are passed under, including the prefix
+// of their layer.
+//
+//	cmd, err := NewExposedCommand(queryCmd,
+//		WithHiddenParameters("db-password"),
+//		WithPinnedParameter("format", "json"),
+//		WithParameterRange("limit", 1, 1000),
+//	)
+type ExposedCommand struct {
+	cmds.Command
+	description *cmds.CommandDescription
+	hidden      map[string]*hiddenParameter
+	ranges      map[string]parameterRange
+}
+
+type ExposedCommandOption func(*ExposedCommand) error
+
+func NewExposedCommand(cmd cmds.Command, options ...ExposedCommandOption) (*ExposedCommand, error) {
+	original := cmd.Description()
+	description := *original
+	description.Flags = copyParameterDefinitions(original.Flags)
+	description.Arguments = copyParameterDefinitions(original.Arguments)
+	description.Layers = []layers.ParameterLayer{}
+	for _, layer := range original.Layers {
+		description.Layers = append(description.Layers, newExposedLayer(layer))
+	}
+
+	ret := &ExposedCommand{
+		Command:     cmd,
+		description: &description,
+		hidden:      map[string]*hiddenParameter{},
+		ranges:      map[string]parameterRange{},
+	}
+	for _, option := range options {
+		err := option(ret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not expose command %s", original.Name)
+		}
+	}
+
+	return ret, nil
+}
+
+func copyParameterDefinitions(ps []*parameters.ParameterDefinition) []*parameters.ParameterDefinition {
+	ret := []*parameters.ParameterDefinition{}
+	for _, p := range ps {
+		p_ := *p
+		ret = append(ret, &p_)
+	}
+	return ret
+}
+
+func (e *ExposedCommand) parameters() []*exposedParameter {
+	ret := []*exposedParameter{}
+	for _, p := range append(append([]*parameters.ParameterDefinition{}, e.description.Flags...), e.description.Arguments...) {
+		ret = append(ret, &exposedParameter{name: p.Name, definition: p})
+	}
+	for _, layer := range e.description.Layers {
+		l, ok := layer.(*exposedLayer)
+		if !ok {
+			continue
+		}
+		for _, p := range getLayerParameterDefinitions(l) {
+			ret = append(ret, &exposedParameter{name: l.GetPrefix() + p.Name, definition: p, layer: l})
+		}
+	}
+	return ret
+}
+
+func (e *ExposedCommand) lookupParameter(name string) (*exposedParameter, error) {
+	for _, p := range e.parameters() {
+		if p.name == name {
+			return p, nil
+		}
+	}
+	if _, ok := e.hidden[name]; ok {
+		return nil, errors.Errorf("parameter %s is hidden", name)
+	}
+	return nil, errors.Errorf("unknown parameter %s", name)
+}
+
+func (e *ExposedCommand) hideParameter(p *exposedParameter, value interface{}) {
+	filter := func(ps []*parameters.ParameterDefinition) []*parameters.ParameterDefinition {
+		ret := []*parameters.ParameterDefinition{}
+		for _, p_ := range ps {
+			if p_ != p.definition {
+				ret = append(ret, p_)
+			}
+		}
+		return ret
+	}
+	hidden := &hiddenParameter{definition: p.definition, value: value}
+	if p.layer != nil {
+		delete(p.layer.definitions, p.definition.Name)
+		hidden.layer = p.layer.GetSlug()
+	} else {
+		e.description.Flags = filter(e.description.Flags)
+		e.description.Arguments = filter(e.description.Arguments)
+	}
+	e.hidden[p.name] = hidden
+	delete(e.ranges, p.name)
+}
+
+// WithHiddenParameters hides parameters, which keep their default value.
+func WithHiddenParameters(names ...string) ExposedCommandOption {
+	return func(e *ExposedCommand) error {
+		for _, name := range names {
+			p, err := e.lookupParameter(name)
+			if err != nil {
+				return err
+			}
+			if p.definition.Required && p.definition.Default == nil {
+				return errors.Errorf("required parameter %s can't be hidden without a value", name)
+			}
+			e.hideParameter(p, p.definition.Default)
+		}
+		return nil
+	}
+}
+
+// WithPinnedParameter hides a parameter, and always runs the command with value.
+func WithPinnedParameter(name string, value interface{}) ExposedCommandOption {
+	return func(e *ExposedCommand) error {
+		p, err := e.lookupParameter(name)
+		if err != nil {
+			return err
+		}
+		p_ := *p.definition
+		p_.Default = value
+		err = p_.CheckParameterDefaultValueValidity()
+		if err != nil {
+			return err
+		}
+		e.hideParameter(p, p_.Default)
+		return nil
+	}
+}
+
+func WithParameterDefault(name string, value interface{}) ExposedCommandOption {
+	return func(e *ExposedCommand) error {
+		p, err := e.lookupParameter(name)
+		if err != nil {
+			return err
+		}
+		p.definition.Default = value
+		p.definition.Required = false
+		return p.definition.CheckParameterDefaultValueValidity()
+	}
+}
+
+// WithParameterChoices restricts the choices of a choice parameter.
+func WithParameterChoices(name string, choices ...string) ExposedCommandOption {
+	return func(e *ExposedCommand) error {
+		p, err := e.lookupParameter(name)
+		if err != nil {
+			return err
+		}
+		if p.definition.Type != parameters.ParameterTypeChoice {
+			return errors.Errorf("parameter %s is not a choice", name)
+		}
+		for _, choice := range choices {
+			found := false
+			for _, c := range p.definition.Choices {
+				if c == choice {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("%s is not a choice of parameter %s", choice, name)
+			}
+		}
+		p.definition.Choices = choices
+		return p.definition.CheckParameterDefaultValueValidity()
+	}
+}
+
+// WithParameterRange restricts the values of a numeric parameter to [min, max]. For lists,
+// each element has to be in the range. The range is added to the help of the parameter.
+func WithParameterRange(name string, min float64, max float64) ExposedCommandOption {
+	return func(e *ExposedCommand) error {
+		p, err := e.lookupParameter(name)
+		if err != nil {
+			return err
+		}
+		//exhaustive:ignore
+		switch p.definition.Type {
+		case parameters.ParameterTypeInteger, parameters.ParameterTypeFloat,
+			parameters.ParameterTypeIntegerList, parameters.ParameterTypeFloatList:
+		default:
+			return errors.Errorf("parameter %s is not numeric", name)
+		}
+		if min > max {
+			return errors.Errorf("invalid range for parameter %s", name)
+		}
+		if _, ok := e.ranges[name]; ok {
+			return errors.Errorf("parameter %s already has a range", name)
+		}
+		e.ranges[name] = parameterRange{min: &min, max: &max}
+		p.definition.Help = strings.TrimSpace(fmt.Sprintf("%s (between %v and %v)", p.definition.Help, min, max))
+		return nil
+	}
+}
+
+func (e *ExposedCommand) Description() *cmds.CommandDescription {
+	return e.description
+}
+
+// ParameterRange returns the range set with WithParameterRange for the parameter passed as name.
+func (e *ExposedCommand) ParameterRange(name string) (float64, float64, bool) {
+	r, ok := e.ranges[name]
+	if !ok {
+		return 0, 0, false
+	}
+	return *r.min, *r.max, true
+}
+
+func (e *ExposedCommand) ValidateParameters(ps map[string]interface{}) error {
+	errs := parameterErrors{}
+	for _, p := range e.parameters() {
+		r, ok := e.ranges[p.name]
+		if !ok {
+			continue
+		}
+		// layer parameters are merged into ps under their name without prefix
+		v, ok := ps[p.definition.Name]
+		if !ok || v == nil {
+			continue
+		}
+		values := []interface{}{v}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Slice {
+			values = []interface{}{}
+			for i := 0; i < rv.Len(); i++ {
+				values = append(values, rv.Index(i).Interface())
+			}
+		}
+		for _, v := range values {
+			f, ok := constraintNumber(v)
+			if !ok {
+				errs.add(p.definition, p.name, "invalid value for parameter '%s': %v is not a number", p.name, v)
+				break
+			}
+			if f < *r.min || f > *r.max {
+				errs.add(p.definition, p.name, "invalid value for parameter '%s': %v is not between %v and %v", p.name, v, *r.min, *r.max)
+				break
+			}
+		}
+	}
+	return errs.err()
+}
+
+func (e *ExposedCommand) RunFromParka(
+	c *gin.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	ps_ := map[string]interface{}{}
+	for k, v := range ps {
+		ps_[k] = v
+	}
+	parsedLayers_ := map[string]*layers.ParsedParameterLayer{}
+	for slug, l := range parsedLayers {
+		parsedLayers_[slug] = l
+	}
+
+	set := func(values map[string]interface{}, k string, v interface{}) {
+		if v == nil {
+			delete(values, k)
+		} else {
+			values[k] = v
+		}
+	}
+	for _, h := range e.hidden {
+		set(ps_, h.definition.Name, h.value)
+		if h.layer == "" {
+			continue
+		}
+		l, ok := parsedLayers_[h.layer]
+		if !ok {
+			continue
+		}
+		l_ := &layers.ParsedParameterLayer{Layer: l.Layer, Parameters: map[string]interface{}{}}
+		for k, v := range l.Parameters {
+			l_.Parameters[k] = v
+		}
+		set(l_.Parameters, h.definition.Name, h.value)
+		parsedLayers_[h.layer] = l_
+	}
+
+	if pc, ok := e.Command.(ParkaCommand); ok {
+		return pc.RunFromParka(c, parsedLayers_, ps_, gp)
+	}
+	return e.Command.Run(c, parsedLayers_, ps_, gp)
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// layerEchoCommand outputs its parameters, along with the parameters of its db layer
+// prefixed with "layer-".
+type layerEchoCommand struct {
+	*testCommand
+}
+
+func (l *layerEchoCommand) RunFromParka(
+	c *gin.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	row := copyRow(ps)
+	if db, ok := parsedLayers["db"]; ok {
+		for k, v := range db.Parameters {
+			row["layer-"+k] = v
+		}
+	}
+	return gp.ProcessInputObject(row)
+}
+
+func newQueryCommand(t *testing.T) *layerEchoCommand {
+	cmd := newEchoCommand("query",
+		&parameters.ParameterDefinition{Name: "name", Type: parameters.ParameterTypeString, Required: true},
+		&parameters.ParameterDefinition{Name: "limit", Type: parameters.ParameterTypeInteger, Default: 10, Help: "Maximum number of rows"},
+		&parameters.ParameterDefinition{Name: "ids", Type: parameters.ParameterTypeIntegerList},
+		&parameters.ParameterDefinition{Name: "format", Type: parameters.ParameterTypeChoice, Default: "json", Choices: []string{"json", "csv", "yaml"}},
+	)
+	db, err := layers.NewParameterLayer("db", "Database", layers.WithPrefix("db-"), layers.WithFlags(
+		&parameters.ParameterDefinition{Name: "host", Type: parameters.ParameterTypeString, Default: "localhost"},
+		&parameters.ParameterDefinition{Name: "port", Type: parameters.ParameterTypeInteger, Default: 5432},
+		&parameters.ParameterDefinition{Name: "password", Type: parameters.ParameterTypeString, Default: "secret"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.description.Layers = []layers.ParameterLayer{db}
+	return &layerEchoCommand{testCommand: cmd}
+}
+
+func newExposedQueryCommand(t *testing.T) *ExposedCommand {
+	ret, err := NewExposedCommand(newQueryCommand(t),
+		WithHiddenParameters("db-password"),
+		WithPinnedParameter("name", "pinned"),
+		WithParameterDefault("limit", 20),
+		WithParameterDefault("db-host", "db.example.com"),
+		WithParameterChoices("format", "json", "csv"),
+		WithParameterRange("limit", 1, 100),
+		WithParameterRange("ids", 1, 10),
+		WithParameterRange("db-port", 1024, 65535),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestExposedCommand(t *testing.T) {
+	s := newTestServer(t, WithCommands(newExposedQueryCommand(t)))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name: "defaults", target: "/api/command/query", status: http.StatusOK,
+			check: expectRow(map[string]interface{}{
+				"name": "pinned", "limit": float64(20), "format": "json",
+				"host": "db.example.com", "password": "secret",
+				"layer-host": "db.example.com", "layer-port": float64(5432), "layer-password": "secret",
+			}),
+		},
+		{
+			name: "hidden", target: "/api/command/query?db-password=other&name=other", status: http.StatusOK,
+			check: expectRow(map[string]interface{}{"name": "pinned", "password": "secret", "layer-password": "secret"}),
+		},
+		{
+			name: "hidden in json", method: http.MethodPost, target: "/api/command/query",
+			body:   `{"db-password": "other"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "layer parameter", target: "/api/command/query?db-host=other&db-port=2000", status: http.StatusOK,
+			check: expectRow(map[string]interface{}{"host": "other", "layer-host": "other", "layer-port": float64(2000)}),
+		},
+		{name: "choice", target: "/api/command/query?format=csv&_output=json", status: http.StatusOK},
+		{name: "removed choice", target: "/api/command/query?format=yaml", status: http.StatusBadRequest, check: expectInvalidParameters("format")},
+		{name: "range", target: "/api/command/query?limit=100", status: http.StatusOK, check: expectRow(map[string]interface{}{"limit": float64(100)})},
+		{name: "out of range", target: "/api/command/query?limit=101", status: http.StatusBadRequest, check: expectInvalidParameters("limit")},
+		{name: "list out of range", target: "/api/command/query?ids=1,11", status: http.StatusBadRequest, check: expectInvalidParameters("ids")},
+		{name: "layer out of range", target: "/api/command/query?db-port=80", status: http.StatusBadRequest, check: expectInvalidParameters("db-port")},
+	})
+}
+
+func TestExposedCommandOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ExposedCommandOption
+		err     string
+	}{
+		{"unknown", []ExposedCommandOption{WithHiddenParameters("password")}, "unknown parameter password"},
+		{"hidden twice", []ExposedCommandOption{WithHiddenParameters("db-password"), WithParameterDefault("db-password", "x")}, "parameter db-password is hidden"},
+		{"required", []ExposedCommandOption{WithHiddenParameters("name")}, "required parameter name can't be hidden without a value"},
+		{"pinned to an invalid value", []ExposedCommandOption{WithPinnedParameter("db-port", "x")}, "is not an integer"},
+		{"invalid default", []ExposedCommandOption{WithParameterDefault("format", "xml")}, "format"},
+		{"not a choice", []ExposedCommandOption{WithParameterChoices("limit", "1")}, "parameter limit is not a choice"},
+		{"unknown choice", []ExposedCommandOption{WithParameterChoices("format", "xml")}, "xml is not a choice of parameter format"},
+		{"default outside the choices", []ExposedCommandOption{WithParameterChoices("format", "csv")}, "format"},
+		{"not numeric", []ExposedCommandOption{WithParameterRange("db-host", 1, 2)}, "parameter db-host is not numeric"},
+		{"invalid range", []ExposedCommandOption{WithParameterRange("limit", 2, 1)}, "invalid range for parameter limit"},
+		{"range twice", []ExposedCommandOption{WithParameterRange("limit", 1, 2), WithParameterRange("limit", 1, 3)}, "parameter limit already has a range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewExposedCommand(newQueryCommand(t), tt.options...)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestExposedCommandDescription(t *testing.T) {
+	original := newQueryCommand(t)
+	cmd, err := NewExposedCommand(original, WithHiddenParameters("db-password"),
+		WithParameterRange("limit", 1, 100), WithParameterRange("ids", 1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the original command is left untouched
+	if len(original.description.Layers[0].GetParameterDefinitions()) != 3 || original.description.Flags[1].Help != "Maximum number of rows" {
+		t.Errorf("the original command was changed")
+	}
+
+	s := newTestServer(t, WithCommands(cmd))
+	w := get(s, "/api/commands")
+	expectStatus(t, w, http.StatusOK)
+	var descriptions []struct {
+		Flags []struct {
+			Name string
+			Help string
+		}
+		Layers []struct {
+			Slug   string
+			Prefix string
+			Flags  []struct{ Name string }
+		}
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &descriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptions) != 1 || len(descriptions[0].Layers) != 1 {
+		t.Fatalf("unexpected descriptions %s", w.Body.String())
+	}
+	if help := descriptions[0].Flags[1].Help; help != "Maximum number of rows (between 1 and 100)" {
+		t.Errorf("expected the range in the help, got %q", help)
+	}
+	layerFlags := []string{}
+	for _, f := range descriptions[0].Layers[0].Flags {
+		layerFlags = append(layerFlags, f.Name)
+	}
+	if descriptions[0].Layers[0].Prefix != "db-" || !reflect.DeepEqual(layerFlags, []string{"host", "port"}) {
+		t.Errorf("expected the db layer without its password, got %v", descriptions[0].Layers[0])
+	}
+
+	spec := newOpenAPISpec([]ParkaCommand{cmd})
+	get := spec.Paths["/api/command/query"].Get
+	schemas := map[string]*OpenAPISchema{}
+	for _, p := range get.Parameters {
+		schemas[p.Name] = p.Schema
+	}
+	if _, ok := schemas["db-password"]; ok {
+		t.Errorf("expected db-password to be hidden")
+	}
+	if limit := schemas["limit"]; limit.Minimum == nil || *limit.Minimum != 1 || limit.Maximum == nil || *limit.Maximum != 100 {
+		t.Errorf("expected the range of limit in its schema, got %v", limit)
+	}
+	if ids := schemas["ids"].Items; ids.Minimum == nil || *ids.Minimum != 1 || *ids.Maximum != 10 {
+		t.Errorf("expected the range of ids in the schema of its elements, got %v", ids)
+	}
+	body := spec.Paths["/api/command/query"].Post.RequestBody.Content["application/json"].Schema
+	if limit := body.Properties["limit"]; limit.Minimum == nil || *limit.Maximum != 100 {
+		t.Errorf("expected the range of limit in the body schema, got %v", limit)
+	}
+}
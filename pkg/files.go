@@ -0,0 +1,406 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File loading parameters (stringFromFile, stringListFromFile, objectFromFile,
+// objectListFromFile and keyValue given as @file) are never read from the filesystem of the
+// server by their name. Over HTTP, their value is either:
+//
+//   - an uploaded file, as a part of a multipart request
+//   - the content of the file itself, passed as a query parameter, form field or JSON string
+//   - a reference to a file starting with @, either @<URL> for a URL below one of the
+//     allowed prefixes, for example the result of a job on another parka server, or
+//     @<path> for a file in one of the allowed directories, see FileLoader
+//
+// The list types accept multiple files, whose content is concatenated.
+
+// FileLoader loads the files referenced by the values of file loading parameters.
+// No reference is allowed by default.
+type FileLoader struct {
+	// Dirs are the server-side directories files can be referenced from. Relative paths
+	// are looked up in each of them.
+	Dirs []string
+	// URLs are the prefixes of the URLs files can be fetched from, for example
+	// https://reports.example.com/api/jobs/
+	URLs []*url.URL
+	// MaxSize is the maximum size of a referenced file, 0 for no limit
+	MaxSize int64
+	Client  *http.Client
+}
+
+func NewFileLoader() *FileLoader {
+	ret := &FileLoader{
+		MaxSize: DefaultUploadLimits.MaxFileSize,
+	}
+	ret.Client = &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !ret.isAllowedURL(req.URL) {
+				return errors.Errorf("redirect to %s is not allowed", req.URL)
+			}
+			return nil
+		},
+	}
+	return ret
+}
+
+// WithFileReferenceDirs allows file loading parameters to reference files in dirs, as @<path>.
+func WithFileReferenceDirs(dirs ...string) ServerOption {
+	return func(s *Server) {
+		for _, dir := range dirs {
+			abs, err := filepath.Abs(dir)
+			if err == nil {
+				abs, err = filepath.EvalSymlinks(abs)
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("dir", dir).Msg("ignoring file reference directory")
+				continue
+			}
+			s.Files.Dirs = append(s.Files.Dirs, abs)
+		}
+	}
+}
+
+// WithFileReferenceURLs allows file loading parameters to reference URLs starting with one of
+// prefixes, as @<URL>.
+func WithFileReferenceURLs(prefixes ...string) ServerOption {
+	return func(s *Server) {
+		for _, prefix := range prefixes {
+			u, err := url.Parse(prefix)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				log.Warn().Str("prefix", prefix).Msg("ignoring invalid file reference URL")
+				continue
+			}
+			if !strings.HasSuffix(u.Path, "/") {
+				u.Path += "/"
+			}
+			s.Files.URLs = append(s.Files.URLs, u)
+		}
+	}
+}
+
+func (f *FileLoader) isAllowedURL(u *url.URL) bool {
+	if u.User != nil {
+		return false
+	}
+	for _, prefix := range f.URLs {
+		if u.Scheme == prefix.Scheme && u.Host == prefix.Host && strings.HasPrefix(u.Path+"/", prefix.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitReader fails reading past the maximum size of the loader.
+func (f *FileLoader) limitReader(r io.Reader, name string) io.Reader {
+	if f.MaxSize <= 0 {
+		return r
+	}
+	return &maxSizeReader{r: io.LimitReader(r, f.MaxSize+1), name: name, remaining: f.MaxSize}
+}
+
+type maxSizeReader struct {
+	r         io.Reader
+	name      string
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, errors.Errorf("file '%s' is too large", m.name)
+	}
+	return n, err
+}
+
+// load parses the file referenced by ref, either a URL or a path, for the parameter p.
+func (f *FileLoader) load(p *parameters.ParameterDefinition, ref string) (interface{}, error) {
+	if f == nil {
+		return nil, errors.New("file references are not allowed")
+	}
+
+	if u, err := url.Parse(ref); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		u.Path = path.Clean("/" + u.Path)
+		u.RawPath = ""
+		if !f.isAllowedURL(u) {
+			return nil, errors.Errorf("URL %s is not allowed", ref)
+		}
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		// parka servers answer with the rows of commands and jobs as JSON
+		req.Header.Set("Accept", "application/json")
+		resp, err := f.Client.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch %s", ref)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("could not fetch %s: %s", ref, resp.Status)
+		}
+		return parseFileContent(p, f.limitReader(resp.Body, ref), u.Path, resp.Header.Get("Content-Type"))
+	}
+
+	fileName, err := f.resolvePath(ref)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Errorf("could not open file %s", ref)
+	}
+	defer file.Close()
+	return parseFileContent(p, f.limitReader(file, ref), fileName, "")
+}
+
+// resolvePath returns the path of the file ref, making sure it is in one of the allowed directories.
+func (f *FileLoader) resolvePath(ref string) (string, error) {
+	for _, dir := range f.Dirs {
+		fileName := ref
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(dir, fileName)
+		}
+		// resolve symlinks, so that they can't point outside of the directory
+		fileName, err := filepath.EvalSymlinks(filepath.Clean(fileName))
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, fileName)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if stat, err := os.Stat(fileName); err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+		return fileName, nil
+	}
+	return "", errors.Errorf("file %s is not allowed", ref)
+}
+
+// isFileParameter returns true for the parameter types that are loaded from a file.
+// keyValue parameters are only loaded from a file when their value starts with @.
+func isFileParameter(p *parameters.ParameterDefinition) bool {
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeStringFromFile, parameters.ParameterTypeStringListFromFile,
+		parameters.ParameterTypeObjectFromFile, parameters.ParameterTypeObjectListFromFile:
+		return true
+	}
+	return false
+}
+
+// parseFileValue parses the text value of a file loading parameter, either a reference
+// starting with @ or the content of the file.
+func (f *FileLoader) parseFileValue(p *parameters.ParameterDefinition, value string) (interface{}, error) {
+	if strings.HasPrefix(value, "@") {
+		return f.load(p, value[1:])
+	}
+	return parseFileContent(p, strings.NewReader(value), "", "")
+}
+
+// parseFiles parses the values of a file loading parameter, each of them loaded with parse.
+// The values of list parameters are concatenated, other parameters take a single file.
+func parseFiles(p *parameters.ParameterDefinition, n int, parse func(i int) (interface{}, error)) (interface{}, error) {
+	if n > 1 && p.Type != parameters.ParameterTypeStringListFromFile && p.Type != parameters.ParameterTypeObjectListFromFile {
+		return nil, errors.New("expected a single file")
+	}
+
+	var ret interface{}
+	for i := 0; i < n; i++ {
+		v, err := parse(i)
+		if err != nil {
+			return nil, err
+		}
+		//exhaustive:ignore
+		switch p.Type {
+		case parameters.ParameterTypeStringListFromFile:
+			l, _ := ret.([]string)
+			ret = append(l, v.([]string)...)
+		case parameters.ParameterTypeObjectListFromFile:
+			l, _ := ret.([]interface{})
+			ret = append(l, v.([]interface{})...)
+		default:
+			ret = v
+		}
+	}
+	return ret, nil
+}
+
+// File formats, detected by detectFileFormat.
+const (
+	fileFormatJSON = "json"
+	fileFormatYAML = "yaml"
+	fileFormatCSV  = "csv"
+	fileFormatTSV  = "tsv"
+)
+
+// detectFileFormat detects the format of a file from its content type, falling back to the
+// extension of its name. It returns an empty string if the format is unknown.
+func detectFileFormat(contentType string, name string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			return fileFormatJSON
+		case mediaType == "application/yaml" || mediaType == "application/x-yaml" ||
+			mediaType == "text/yaml" || mediaType == "text/x-yaml":
+			return fileFormatYAML
+		case mediaType == "text/csv":
+			return fileFormatCSV
+		case mediaType == "text/tab-separated-values":
+			return fileFormatTSV
+		}
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return fileFormatJSON
+	case ".yaml", ".yml":
+		return fileFormatYAML
+	case ".csv":
+		return fileFormatCSV
+	case ".tsv":
+		return fileFormatTSV
+	}
+	return ""
+}
+
+// parseFileContent parses the content of a file for the file loading parameter p. The format
+// of objects is detected from contentType and name, and defaults to JSON. Lists of objects can
+// also be loaded from CSV and TSV files with a header row.
+func parseFileContent(p *parameters.ParameterDefinition, r io.Reader, name string, contentType string) (interface{}, error) {
+	format := detectFileFormat(contentType, name)
+
+	//exhaustive:ignore
+	switch p.Type {
+	case parameters.ParameterTypeStringFromFile:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case parameters.ParameterTypeStringListFromFile:
+		if format == fileFormatJSON || format == fileFormatYAML {
+			l := []interface{}{}
+			err := decodeFile(r, format, &l)
+			if err != nil {
+				return nil, err
+			}
+			ret := []string{}
+			for _, v := range l {
+				ret = append(ret, fmt.Sprintf("%v", v))
+			}
+			return ret, nil
+		}
+		ret := []string{}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			ret = append(ret, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return ret, nil
+
+	case parameters.ParameterTypeObjectFromFile, parameters.ParameterTypeKeyValue:
+		obj := map[string]interface{}{}
+		err := decodeFile(r, format, &obj)
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+
+	case parameters.ParameterTypeObjectListFromFile:
+		if format == fileFormatCSV || format == fileFormatTSV {
+			return parseCSVObjects(r, format == fileFormatTSV)
+		}
+		l := []interface{}{}
+		err := decodeFile(r, format, &l)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range l {
+			if _, ok := o.(map[string]interface{}); !ok {
+				return nil, errors.Errorf("expected a list of objects, got a %T element", o)
+			}
+		}
+		return l, nil
+
+	default:
+		return nil, errors.Errorf("parameter '%s' can't be loaded from a file", p.Name)
+	}
+}
+
+// decodeFile decodes a JSON or YAML file into v.
+func decodeFile(r io.Reader, format string, v interface{}) error {
+	switch format {
+	case fileFormatYAML:
+		err := yaml.NewDecoder(r).Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "could not parse YAML")
+		}
+	case fileFormatJSON, "":
+		err := json.NewDecoder(r).Decode(v)
+		if err != nil {
+			return errors.Wrap(err, "could not parse JSON")
+		}
+	default:
+		return errors.Errorf("unsupported file format %s", format)
+	}
+	return nil
+}
+
+// parseCSVObjects parses a CSV or TSV file into a list of objects, keyed by the header row.
+func parseCSVObjects(r io.Reader, tsv bool) ([]interface{}, error) {
+	reader := csv.NewReader(r)
+	if tsv {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []interface{}{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse CSV")
+	}
+
+	ret := []interface{}{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse CSV")
+		}
+		row := map[string]interface{}{}
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
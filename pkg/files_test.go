@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fileReferenceTest returns a request test passing ref as a reference to the text parameter of
+// an echo command. Allowed references are expected to load a file containing "allowed".
+func fileReferenceTest(name string, ref string, status int) requestTest {
+	rt := requestTest{name: name, target: "/api/command/echo?text=" + url.QueryEscape("@"+ref), status: status}
+	if status == http.StatusOK {
+		rt.check = expectRow(map[string]interface{}{"text": "allowed"})
+	} else {
+		rt.check = expectInvalidParameters("text")
+	}
+	return rt
+}
+
+func TestFileReferenceDirs(t *testing.T) {
+	root := t.TempDir()
+	data := filepath.Join(root, "data")
+	for name, content := range map[string]string{
+		"data/allowed.txt":  "allowed",
+		"data2/secret.txt":  "secret",
+		"outside/other.txt": "other",
+	} {
+		fileName := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fileName, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink(filepath.Join(root, "outside", "other.txt"), filepath.Join(data, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(data, "allowed.txt"), filepath.Join(data, "inside.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t,
+		WithCommands(newEchoCommand("echo", &parameters.ParameterDefinition{Name: "text", Type: parameters.ParameterTypeStringFromFile})),
+		WithFileReferenceDirs(data),
+	)
+	runRequestTests(t, s, []requestTest{
+		fileReferenceTest("relative", "allowed.txt", http.StatusOK),
+		fileReferenceTest("absolute", filepath.Join(data, "allowed.txt"), http.StatusOK),
+		fileReferenceTest("symlink inside", "inside.txt", http.StatusOK),
+		fileReferenceTest("traversal", "../outside/other.txt", http.StatusBadRequest),
+		fileReferenceTest("absolute traversal", data+"/../outside/other.txt", http.StatusBadRequest),
+		fileReferenceTest("symlink outside", "link.txt", http.StatusBadRequest),
+		fileReferenceTest("sibling prefix", filepath.Join(root, "data2", "secret.txt"), http.StatusBadRequest),
+		fileReferenceTest("relative sibling prefix", "../data2/secret.txt", http.StatusBadRequest),
+		fileReferenceTest("directory", ".", http.StatusBadRequest),
+		fileReferenceTest("missing", "missing.txt", http.StatusBadRequest),
+	})
+}
+
+func TestFileReferenceURLs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/allowed.txt", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("allowed"))
+	})
+	mux.HandleFunc("/private/secret.txt", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("secret"))
+	})
+	mux.Handle("/files/redirect", http.RedirectHandler("/private/secret.txt", http.StatusFound))
+	mux.Handle("/files/redirect-allowed", http.RedirectHandler("/files/allowed.txt", http.StatusFound))
+	files := httptest.NewServer(mux)
+	defer files.Close()
+
+	s := newTestServer(t,
+		WithCommands(newEchoCommand("echo", &parameters.ParameterDefinition{Name: "text", Type: parameters.ParameterTypeStringFromFile})),
+		WithFileReferenceURLs(files.URL+"/files"),
+	)
+	runRequestTests(t, s, []requestTest{
+		fileReferenceTest("allowed", files.URL+"/files/allowed.txt", http.StatusOK),
+		fileReferenceTest("redirect to an allowed URL", files.URL+"/files/redirect-allowed", http.StatusOK),
+		fileReferenceTest("redirect", files.URL+"/files/redirect", http.StatusBadRequest),
+		fileReferenceTest("traversal", files.URL+"/files/../private/secret.txt", http.StatusBadRequest),
+		fileReferenceTest("encoded traversal", files.URL+"/files/%2e%2e/private/secret.txt", http.StatusBadRequest),
+		fileReferenceTest("other path", files.URL+"/private/secret.txt", http.StatusBadRequest),
+	})
+}
+
+func TestIsAllowedURL(t *testing.T) {
+	f := NewFileLoader()
+	for _, prefix := range []string{"https://allowed.example.com/files/", "http://localhost:8080/api/jobs/"} {
+		u, err := url.Parse(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.URLs = append(f.URLs, u)
+	}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://allowed.example.com/files/a.json", true},
+		{"https://allowed.example.com/files", true},
+		{"http://localhost:8080/api/jobs/1/result", true},
+		{"https://allowed.example.com.evil/files/a.json", false},
+		{"https://evil.com/allowed.example.com/files/a.json", false},
+		{"https://allowed.example.com@evil.com/files/a.json", false},
+		{"https://user@allowed.example.com/files/a.json", false},
+		{"https://allowed.example.com:8443/files/a.json", false},
+		{"http://allowed.example.com/files/a.json", false},
+		{"https://allowed.example.com/files2/a.json", false},
+		{"https://allowed.example.com/", false},
+		{"http://localhost:8081/api/jobs/1/result", false},
+		{"http://localhost/api/jobs/1/result", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.isAllowedURL(u) != tt.allowed {
+				t.Errorf("expected %s to be allowed: %v", tt.url, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/formatters"
+	"net/http"
+)
+
+// OutputFormat describes one of the glazed output formats that a client can request
+// from the /api/command endpoints, along with the HTTP metadata needed to serve it.
+type OutputFormat struct {
+	// Name is the value passed in the _output= query parameter.
+	Name string
+	// Output and TableFormat are handed to glazed's OutputFormatterSettings.
+	Output      string
+	TableFormat string
+	// ContentTypes are the MIME types that select this format through the Accept header.
+	// The first one is used as the Content-Type of the response.
+	ContentTypes []string
+	Extension    string
+	// Attachment marks formats that are meant to be downloaded rather than displayed.
+	Attachment bool
+	// Streaming formats write each row as soon as the command emits it,
+	// see runCommandStreaming.
+	Streaming bool
+	// Description documents the format in the OpenAPI spec, when there is more to it than the rows.
+	Description string
+}
+
+// OutputFormats lists the supported formats, JSON first, since it is the default
+// when the client doesn't express any preference.
+var OutputFormats = []*OutputFormat{
+	{
+		Name:         "json",
+		Output:       "json",
+		ContentTypes: []string{"application/json"},
+		Extension:    "json",
+	},
+	{
+		Name:         "csv",
+		Output:       "table",
+		TableFormat:  "csv",
+		ContentTypes: []string{"text/csv"},
+		Extension:    "csv",
+		Attachment:   true,
+	},
+	{
+		Name:         "tsv",
+		Output:       "table",
+		TableFormat:  "tsv",
+		ContentTypes: []string{"text/tab-separated-values"},
+		Extension:    "tsv",
+		Attachment:   true,
+	},
+	{
+		Name:         "yaml",
+		Output:       "yaml",
+		ContentTypes: []string{"application/x-yaml", "application/yaml", "text/yaml"},
+		Extension:    "yaml",
+	},
+	{
+		Name:         "markdown",
+		Output:       "table",
+		TableFormat:  "markdown",
+		ContentTypes: []string{"text/markdown"},
+		Extension:    "md",
+	},
+	{
+		Name:         "html",
+		Output:       "table",
+		TableFormat:  "html",
+		ContentTypes: []string{"text/html"},
+		Extension:    "html",
+	},
+	{
+		Name:         "table",
+		Output:       "table",
+		TableFormat:  "ascii",
+		ContentTypes: []string{"text/plain"},
+		Extension:    "txt",
+	},
+	{
+		Name:         "ndjson",
+		ContentTypes: []string{"application/x-ndjson", "application/jsonl"},
+		Extension:    "ndjson",
+		Streaming:    true,
+		Description: `ndjson: one {"row": Row} line per row. A command failing after rows were sent ends ` +
+			`the stream with an {"error": Error} line, since the status can't be changed anymore.`,
+	},
+	{
+		Name:         "sse",
+		ContentTypes: []string{"text/event-stream"},
+		Extension:    "txt",
+		Streaming:    true,
+		Description: `sse: one "row" event per row, followed by a "done" event with the number of rows, ` +
+			`or by an "error" event with an Error if the command fails.`,
+	},
+}
+
+func LookupOutputFormat(name string) (*OutputFormat, bool) {
+	for _, f := range OutputFormats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateOutputFormat picks the output format for a request. An explicit _output= query
+// parameter takes precedence over the Accept header. The returned status code is the one
+// to use when no format could be selected.
+func NegotiateOutputFormat(c *gin.Context) (*OutputFormat, int, error) {
+	if name := c.Query("_output"); name != "" {
+		f, ok := LookupOutputFormat(name)
+		if !ok {
+			return nil, http.StatusBadRequest, fmt.Errorf("unsupported output format '%s'", name)
+		}
+		return f, http.StatusOK, nil
+	}
+
+	offered := []string{}
+	for _, f := range OutputFormats {
+		offered = append(offered, f.ContentTypes...)
+	}
+
+	contentType := c.NegotiateFormat(offered...)
+	for _, f := range OutputFormats {
+		for _, ct := range f.ContentTypes {
+			if ct == contentType {
+				return f, http.StatusOK, nil
+			}
+		}
+	}
+
+	return nil, http.StatusNotAcceptable, fmt.Errorf("none of the accepted content types '%s' are supported", c.GetHeader("Accept"))
+}
+
+func (f *OutputFormat) ContentType() string {
+	return f.ContentTypes[0]
+}
+
+func (f *OutputFormat) CreateOutputFormatter() (formatters.OutputFormatter, error) {
+	if f.Streaming {
+		return nil, fmt.Errorf("output format '%s' can only be streamed", f.Name)
+	}
+	ofs := &cli.OutputFormatterSettings{
+		Output:       f.Output,
+		TableFormat:  f.TableFormat,
+		WithHeaders:  true,
+		CsvSeparator: ",",
+	}
+	return ofs.CreateOutputFormatter()
+}
+
+// SetContentHeaders sets the Content-Type and Content-Disposition headers for a response
+// rendering the output of the command called name.
+func (f *OutputFormat) SetContentHeaders(c *gin.Context, name string) {
+	disposition := "inline"
+	if f.Attachment {
+		disposition = "attachment"
+	}
+	c.Header("Content-Type", f.ContentType()+"; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("%s; filename=\"%s.%s\"", disposition, name, f.Extension))
+}
+
+// WriteOutput renders the rows collected in the output formatter to the response.
+//
+// JSON is rendered as an array of rows (even if empty), which is what the API returned
+// before other formats were supported.
+func (f *OutputFormat) WriteOutput(c *gin.Context, of formatters.OutputFormatter, name string) error {
+	s, err := of.Output()
+	if err != nil {
+		return err
+	}
+
+	f.SetContentHeaders(c, name)
+
+	if jof, ok := of.(*formatters.JSONOutputFormatter); ok {
+		rows := []map[string]interface{}{}
+		for _, row := range jof.Table.Rows {
+			rows = append(rows, row.GetValues())
+		}
+		c.JSON(http.StatusOK, rows)
+		return nil
+	}
+
+	c.String(http.StatusOK, s)
+	return nil
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateOutputFormat(t *testing.T) {
+	s := newTestServer(t, WithCommands(newEchoCommand("reports/echo",
+		&parameters.ParameterDefinition{Name: "name", Type: parameters.ParameterTypeString, Default: "world"},
+	)))
+
+	expectContent := func(contentType string, contains string) func(t *testing.T, w *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, contentType) {
+				t.Errorf("expected content type %s, got %s", contentType, ct)
+			}
+			expectBody(contains)(t, w)
+		}
+	}
+	runRequestTests(t, s, []requestTest{
+		{name: "default", target: "/api/command/reports/echo", status: http.StatusOK,
+			check: expectContent("application/json", `"name":"world"`)},
+		{name: "accept any", target: "/api/command/reports/echo", headers: []string{"Accept", "*/*"}, status: http.StatusOK,
+			check: expectContent("application/json", `"name":"world"`)},
+		{name: "accept csv", target: "/api/command/reports/echo", headers: []string{"Accept", "text/csv"}, status: http.StatusOK,
+			check: expectContent("text/csv", "name\nworld")},
+		{name: "accept list", target: "/api/command/reports/echo", headers: []string{"Accept", "application/x-yaml, text/csv"},
+			status: http.StatusOK, check: expectContent("application/x-yaml", "name: world")},
+		{name: "output parameter", target: "/api/command/reports/echo?_output=tsv", headers: []string{"Accept", "application/json"},
+			status: http.StatusOK, check: expectContent("text/tab-separated-values", "name\nworld")},
+		{name: "ndjson", target: "/api/command/reports/echo?name=x", headers: []string{"Accept", "application/x-ndjson"},
+			status: http.StatusOK, check: expectContent("application/x-ndjson", `{"row":{"name":"x"}}`+"\n")},
+		{name: "attachment", target: "/api/command/reports/echo?_output=csv", status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, `attachment; filename="echo.csv"`) {
+					t.Errorf("unexpected Content-Disposition %q", cd)
+				}
+			}},
+		{name: "not acceptable", target: "/api/command/reports/echo", headers: []string{"Accept", "image/png"},
+			status: http.StatusNotAcceptable, check: expectErrorCode("not_acceptable")},
+		{name: "unknown output", target: "/api/command/reports/echo?_output=pdf", status: http.StatusBadRequest},
+	})
+}
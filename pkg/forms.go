@@ -0,0 +1,465 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/formatters"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FormField is the data passed to the command form template to render the input widget
+// of a single parameter.
+type FormField struct {
+	// Name is the name of the form field, including the layer prefix
+	Name     string
+	Help     string
+	Type     parameters.ParameterType
+	Required bool
+	// Widget is one of text, number, checkbox, date, select, list, file
+	Widget  string
+	Step    string
+	Choices []string
+	// Values are the current values of the field, either submitted or the defaults.
+	// Single value widgets only use the first one.
+	Values []string
+}
+
+func (f *FormField) Value() string {
+	if len(f.Values) == 0 {
+		return ""
+	}
+	return f.Values[0]
+}
+
+func (f *FormField) IsChecked() bool {
+	return f.Value() == "true"
+}
+
+func (f *FormField) HasValue(v string) bool {
+	for _, v_ := range f.Values {
+		if v_ == v {
+			return true
+		}
+	}
+	return false
+}
+
+// FormSection groups the fields of the command flags, its arguments, and each of its layers.
+type FormSection struct {
+	Name        string
+	Description string
+	Fields      []*FormField
+}
+
+// ResultTable is the output of a command, rendered to strings for display.
+type ResultTable struct {
+	Columns []string
+	Rows    [][]string
+}
+
+type CommandFormPage struct {
+	Command  *cmds.CommandDescription
+	Long     template.HTML
+	Action   string
+	Sections []*FormSection
+	Result   *ResultTable
+	Error    string
+}
+
+func widgetForParameterType(t parameters.ParameterType) string {
+	//exhaustive:ignore
+	switch t {
+	case parameters.ParameterTypeInteger, parameters.ParameterTypeFloat:
+		return "number"
+	case parameters.ParameterTypeBool:
+		return "checkbox"
+	case parameters.ParameterTypeDate:
+		return "date"
+	case parameters.ParameterTypeChoice:
+		return "select"
+	case parameters.ParameterTypeStringList,
+		parameters.ParameterTypeIntegerList,
+		parameters.ParameterTypeFloatList,
+		parameters.ParameterTypeKeyValue:
+		return "list"
+	case parameters.ParameterTypeStringFromFile,
+		parameters.ParameterTypeObjectFromFile,
+		parameters.ParameterTypeObjectListFromFile,
+		parameters.ParameterTypeStringListFromFile:
+		return "file"
+	default:
+		return "text"
+	}
+}
+
+// defaultToFormValues renders the default value of a parameter the way the browser
+// would submit it.
+func defaultToFormValues(p *parameters.ParameterDefinition) []string {
+	if p.Default == nil {
+		return []string{}
+	}
+
+	switch v := p.Default.(type) {
+	case time.Time:
+		return []string{v.Format("2006-01-02")}
+	case string:
+		if p.Type == parameters.ParameterTypeDate {
+			if d, err := parameters.ParseDate(v); err == nil {
+				return []string{d.Format("2006-01-02")}
+			}
+		}
+		return []string{v}
+	}
+
+	rv := reflect.ValueOf(p.Default)
+	if rv.Kind() == reflect.Slice {
+		ret := []string{}
+		for i := 0; i < rv.Len(); i++ {
+			ret = append(ret, fmt.Sprintf("%v", rv.Index(i).Interface()))
+		}
+		return ret
+	}
+	if rv.Kind() == reflect.Map {
+		ret := []string{}
+		iter := rv.MapRange()
+		for iter.Next() {
+			ret = append(ret, fmt.Sprintf("%v:%v", iter.Key().Interface(), iter.Value().Interface()))
+		}
+		return ret
+	}
+
+	return []string{fmt.Sprintf("%v", p.Default)}
+}
+
+// newFormFields creates the form fields for a list of parameter definitions. The values found
+// in submitted are used instead of the defaults.
+func newFormFields(ps []*parameters.ParameterDefinition, prefix string, submitted map[string][]string) []*FormField {
+	ret := []*FormField{}
+	for _, p := range ps {
+		name := prefix + p.Name
+		f := &FormField{
+			Name:     name,
+			Help:     p.Help,
+			Type:     p.Type,
+			Required: p.Required,
+			Widget:   widgetForParameterType(p.Type),
+			Choices:  p.Choices,
+			Values:   defaultToFormValues(p),
+		}
+		if p.Type == parameters.ParameterTypeFloat {
+			f.Step = "any"
+		} else if p.Type == parameters.ParameterTypeInteger {
+			f.Step = "1"
+		}
+
+		if v, ok := submitted[name]; ok && f.Widget != "file" {
+			f.Values = v
+		}
+
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+func newFormSections(description *cmds.CommandDescription, submitted map[string][]string) []*FormSection {
+	ret := []*FormSection{}
+	if len(description.Arguments) > 0 {
+		ret = append(ret, &FormSection{
+			Name:   "Arguments",
+			Fields: newFormFields(description.Arguments, "", submitted),
+		})
+	}
+	if len(description.Flags) > 0 {
+		ret = append(ret, &FormSection{
+			Name:   "Flags",
+			Fields: newFormFields(description.Flags, "", submitted),
+		})
+	}
+	for _, layer := range description.Layers {
+		ret = append(ret, &FormSection{
+			Name:        layer.GetName(),
+			Description: layer.GetDescription(),
+			Fields:      newFormFields(getLayerParameterDefinitions(layer), layer.GetPrefix(), submitted),
+		})
+	}
+	return ret
+}
+
+func formatCell(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	switch v_ := v.(type) {
+	case string:
+		return v_
+	case time.Time:
+		return v_.Format(time.RFC3339)
+	}
+
+	kind := reflect.ValueOf(v).Kind()
+	if kind == reflect.Slice || kind == reflect.Map {
+		b, err := json.Marshal(v)
+		if err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// newResultTable renders the rows collected by a JSON output formatter, after all the table
+// middlewares have been applied.
+func newResultTable(of formatters.OutputFormatter) (*ResultTable, error) {
+	jof, ok := of.(*formatters.JSONOutputFormatter)
+	if !ok {
+		return nil, fmt.Errorf("unexpected output formatter %T", of)
+	}
+	_, err := jof.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ResultTable{
+		Columns: jof.Table.Columns,
+	}
+	for _, row := range jof.Table.Rows {
+		values := row.GetValues()
+		cells := []string{}
+		for _, column := range jof.Table.Columns {
+			cells = append(cells, formatCell(values[column]))
+		}
+		ret.Rows = append(ret.Rows, cells)
+	}
+
+	return ret, nil
+}
+
+func (s *Server) newCommandFormPage(c *gin.Context, cmd ParkaCommand, submitted map[string][]string) *CommandFormPage {
+	description := cmd.Description()
+
+	page := &CommandFormPage{
+		Command:  description,
+		Action:   c.Request.URL.Path,
+		Sections: newFormSections(description, submitted),
+	}
+
+	if description.Long != "" {
+		long, err := RenderMarkdownToHTML(description.Long)
+		if err != nil {
+			log.Warn().Err(err).Str("command", description.Name).Msg("could not render long description")
+		} else {
+			page.Long = template.HTML(long)
+		}
+	}
+
+	return page
+}
+
+// runCommandForm runs a command with the parameters submitted through its form, which has
+// already been parsed with parseForm, and stores either the result table or the error in page.
+// It returns the HTTP status to respond with.
+func (s *Server) runCommandForm(c *gin.Context, cmd ParkaCommand, page *CommandFormPage) int {
+	description := cmd.Description()
+
+	err := s.limitRate(c, cmd)
+	if err != nil {
+		page.Error = err.Error()
+		setRetryAfter(c, err)
+		return errorStatus(err)
+	}
+
+	parsedLayers, ps, layersErr := parseLayers(description, NewFormParameterLayerParser(c, s.Files))
+	flags, flagsErr := parseFormData(c, s.Files, append(description.Flags, description.Arguments...), "")
+	err = mergeParameterErrors(layersErr, flagsErr)
+	if err != nil {
+		page.Error = err.Error()
+		return errorStatus(err)
+	}
+	for k, v := range flags {
+		ps[k] = v
+	}
+
+	err = s.checkParameters(c, cmd, ps)
+	if err != nil {
+		page.Error = err.Error()
+		return errorStatus(err)
+	}
+
+	format, _ := LookupOutputFormat("json")
+	of, gp, err := SetupProcessor(format, parsedLayers)
+	if err != nil {
+		page.Error = err.Error()
+		return http.StatusInternalServerError
+	}
+
+	_, err = s.runFromParka(c, cmd, parsedLayers, ps, gp)
+	if err != nil {
+		page.Error = err.Error()
+		setRetryAfter(c, err)
+		return errorStatus(err)
+	}
+
+	page.Result, err = newResultTable(of)
+	if err != nil {
+		page.Error = err.Error()
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusOK
+}
+
+// renderTemplate renders the page template name within the layout of base.tmpl.html.
+//
+// The page template renders the content of the page. It can define the title of the page and
+// additional head elements as the templates "<page>-title" and "<page>-head", where page is
+// name without the .tmpl.html extension, like "command-title" for command.tmpl.html.
+func (s *Server) renderTemplate(c *gin.Context, status int, name string, data interface{}) {
+	t, err := s.LookupTemplate(name)
+	if err != nil || t == nil {
+		c.String(http.StatusInternalServerError, "Error rendering template")
+		return
+	}
+	base, err := s.LookupTemplate("base.tmpl.html")
+	if err != nil || base == nil {
+		c.String(http.StatusInternalServerError, "Error rendering template")
+		return
+	}
+
+	page := strings.TrimSuffix(name, ".tmpl.html")
+	layout := map[string]interface{}{}
+	for key, name_ := range map[string]string{"content": name, "title": page + "-title", "head": page + "-head"} {
+		block := t.Lookup(name_)
+		if block == nil {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		err = block.Execute(buf, data)
+		if err != nil {
+			log.Error().Err(err).Str("template", name).Str("block", name_).Msg("error rendering template")
+			c.String(http.StatusInternalServerError, "Error rendering template")
+			return
+		}
+		layout[key] = template.HTML(buf.String())
+	}
+
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err = base.Execute(c.Writer, layout)
+	if err != nil {
+		log.Error().Err(err).Str("template", name).Msg("error rendering template")
+	}
+}
+
+// renderTemplateFragment renders the template called fragment defined in the template file name,
+// or the whole file if fragment is empty.
+func (s *Server) renderTemplateFragment(c *gin.Context, status int, name string, fragment string, data interface{}) {
+	t, err := s.LookupTemplate(name)
+	if err != nil || t == nil {
+		c.String(http.StatusInternalServerError, "Error rendering template")
+		return
+	}
+
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if fragment == "" {
+		err = t.Execute(c.Writer, data)
+	} else {
+		err = t.ExecuteTemplate(c.Writer, fragment, data)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("template", name).Str("fragment", fragment).Msg("error rendering template")
+	}
+}
+
+// isHTMXRequest returns true if the request was issued by htmx, which expects an HTML
+// fragment to swap into the page instead of a whole page.
+func isHTMXRequest(c *gin.Context) bool {
+	return c.GetHeader("HX-Request") == "true"
+}
+
+func commandFormPath(description *cmds.CommandDescription) string {
+	return "/commands/" + commandPath(description)
+}
+
+// serveCommandForms exposes each command as a web form under /commands/<parents>/<name>.
+// Submitting the form runs the command and renders its output as an HTML table.
+// When submitted through htmx, only the results fragment is returned and swapped into the page.
+//
+// The pages are rendered with the command.tmpl.html and commands.tmpl.html templates,
+// which can be overridden through the server's TemplateLookups.
+func (s *Server) serveCommandForms() {
+	lookupCommand := func(c *gin.Context) (ParkaCommand, bool) {
+		cmd, ok := s.LookupCommand(c.Param("path"))
+		if !ok {
+			c.String(http.StatusNotFound, "Unknown command")
+			return nil, false
+		}
+		if s.authorize(c, cmd, nil) != nil {
+			c.String(http.StatusForbidden, "Forbidden")
+			return nil, false
+		}
+		return cmd, true
+	}
+
+	s.Router.GET("/commands/*path", func(c *gin.Context) {
+		cmd, ok := lookupCommand(c)
+		if !ok {
+			return
+		}
+
+		var submitted map[string][]string
+		if len(c.Request.URL.Query()) > 0 {
+			submitted = c.Request.URL.Query()
+		}
+		page := s.newCommandFormPage(c, cmd, submitted)
+		s.renderTemplate(c, http.StatusOK, "command.tmpl.html", page)
+	})
+
+	s.Router.POST("/commands/*path", func(c *gin.Context) {
+		cmd, ok := lookupCommand(c)
+		if !ok {
+			return
+		}
+
+		// the submitted values are echoed back, even if the form is rejected
+		err := s.parseForm(c)
+		page := s.newCommandFormPage(c, cmd, c.Request.PostForm)
+		var status int
+		if err != nil {
+			page.Error = err.Error()
+			status = errorStatus(err)
+		} else {
+			status = s.runCommandForm(c, cmd, page)
+		}
+
+		c.Header("Vary", "HX-Request")
+		if isHTMXRequest(c) {
+			// htmx doesn't swap in the content of error responses by default,
+			// so the error panel is returned with a 200.
+			s.renderTemplateFragment(c, http.StatusOK, "command.tmpl.html", "command-results", page)
+			return
+		}
+		s.renderTemplate(c, status, "command.tmpl.html", page)
+	})
+
+	s.Router.GET("/commands", func(c *gin.Context) {
+		commands := []map[string]interface{}{}
+		for _, cmd := range s.listCommands(c) {
+			commands = append(commands, map[string]interface{}{
+				"path":        commandFormPath(cmd.Description()),
+				"description": cmd.Description(),
+			})
+		}
+		s.renderTemplate(c, http.StatusOK, "commands.tmpl.html", map[string]interface{}{
+			"commands": commands,
+		})
+	})
+}
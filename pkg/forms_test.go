@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// expectLayout checks that a page was rendered once within the layout of base.tmpl.html.
+func expectLayout(title string, contains ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		body := w.Body.String()
+		if strings.Count(body, "<html") != 1 || strings.Count(body, `href="/dist/output.css"`) != 1 {
+			t.Errorf("expected the page to be rendered once within the layout, got %s", body)
+		}
+		expectBody(append([]string{"<title>" + title + "</title>"}, contains...)...)(t, w)
+	}
+}
+
+func TestCommandForms(t *testing.T) {
+	s := newTestServer(t, WithCommands(newParametersCommand()))
+	form := url.Values{"name": {"submitted"}, "count": {"2"}}.Encode()
+	invalidForm := url.Values{"name": {"submitted"}, "count": {"many"}}.Encode()
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "page",
+			target: "/commands/echo?name=preset",
+			status: http.StatusOK,
+			check: expectBody(
+				`<input type="text" id="field-name" name="name" value="preset" required/>`,
+				`<input type="checkbox" id="field-verbose" name="verbose" value="true" />`,
+				`<option value="fast" selected>fast</option>`,
+			),
+		},
+		{
+			name:   "layout",
+			target: "/commands/echo",
+			status: http.StatusOK,
+			check:  expectLayout("echo", `<script src="/dist/js/htmx-1.8.6.min.js" defer></script>`, "function parkaAddListItem"),
+		},
+		{name: "list", target: "/commands", status: http.StatusOK, check: expectLayout("Commands", `<a href="/commands/echo">`)},
+		{name: "api docs", target: "/api/docs", status: http.StatusOK, check: expectLayout("API", ".api-try {", "function parkaTryIt")},
+		{name: "unknown command", target: "/commands/unknown", status: http.StatusNotFound},
+		{
+			// the results are shown in the full page, along with the submitted values
+			name:   "submit",
+			method: http.MethodPost, target: "/commands/echo",
+			body: form, contentType: "application/x-www-form-urlencoded",
+			status: http.StatusOK,
+			check:  expectBody("<html", "<td>submitted</td>", `value="submitted"`),
+		},
+		{
+			// htmx only swaps in the results
+			name:   "submit with htmx",
+			method: http.MethodPost, target: "/commands/echo", headers: []string{"HX-Request", "true"},
+			body: form, contentType: "application/x-www-form-urlencoded",
+			status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				body := strings.TrimSpace(w.Body.String())
+				if !strings.HasPrefix(body, `<div id="command-results">`) || !strings.Contains(body, "<td>submitted</td>") {
+					t.Errorf("expected the results fragment, got %s", body)
+				}
+			},
+		},
+		{
+			name:   "submit invalid",
+			method: http.MethodPost, target: "/commands/echo",
+			body: invalidForm, contentType: "application/x-www-form-urlencoded",
+			status: http.StatusBadRequest,
+			check:  expectBody(`role="alert"`, `value="many"`),
+		},
+		{
+			// htmx doesn't swap in error responses
+			name:   "submit invalid with htmx",
+			method: http.MethodPost, target: "/commands/echo", headers: []string{"HX-Request", "true"},
+			body: invalidForm, contentType: "application/x-www-form-urlencoded",
+			status: http.StatusOK,
+		},
+	})
+}
@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrJobNotFound is returned by a JobStore when no job with the requested ID exists.
+var ErrJobNotFound = errors.New("job not found")
+
+// JobStore persists the status and the results of asynchronous command jobs.
+//
+// Implementations must be safe for concurrent use, and must return copies of the stored
+// jobs, so that callers can modify them without affecting the store.
+type JobStore interface {
+	// SaveJob creates or updates the status of a job.
+	SaveJob(job *Job) error
+	GetJob(id string) (*Job, error)
+	// ListJobs returns all jobs, sorted by creation time.
+	ListJobs() ([]*Job, error)
+	SaveResult(id string, result *JobResult) error
+	GetResult(id string) (*JobResult, error)
+	// DeleteJob removes a job and its result.
+	DeleteJob(id string) error
+}
+
+type MemoryJobStore struct {
+	mutex   sync.RWMutex
+	jobs    map[string]Job
+	results map[string]*JobResult
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		jobs:    map[string]Job{},
+		results: map[string]*JobResult{},
+	}
+}
+
+func (m *MemoryJobStore) SaveJob(job *Job) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jobs[job.ID] = *job
+	return nil
+}
+
+func (m *MemoryJobStore) GetJob(id string) (*Job, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (m *MemoryJobStore) ListJobs() ([]*Job, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ret := []*Job{}
+	for _, job := range m.jobs {
+		job := job
+		ret = append(ret, &job)
+	}
+	sortJobs(ret)
+	return ret, nil
+}
+
+func (m *MemoryJobStore) SaveResult(id string, result *JobResult) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	m.results[id] = result
+	return nil
+}
+
+// GetResult returns the stored result. Results are never modified once saved,
+// so they are shared instead of copied.
+func (m *MemoryJobStore) GetResult(id string) (*JobResult, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	result, ok := m.results[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return result, nil
+}
+
+func (m *MemoryJobStore) DeleteJob(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	delete(m.jobs, id)
+	delete(m.results, id)
+	return nil
+}
+
+// FileJobStore stores each job as <id>.json in a directory, and its result as
+// <id>.result.json, so that jobs survive a restart of the server.
+type FileJobStore struct {
+	mutex sync.RWMutex
+	dir   string
+}
+
+func NewFileJobStore(dir string) (*FileJobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create job directory %s", dir)
+	}
+	return &FileJobStore{dir: dir}, nil
+}
+
+var jobIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+func (f *FileJobStore) path(id string, suffix string) (string, error) {
+	// the ID comes from the URL, make sure it can't be used to escape the job directory
+	if !jobIDRegexp.MatchString(id) {
+		return "", ErrJobNotFound
+	}
+	return filepath.Join(f.dir, id+suffix), nil
+}
+
+func (f *FileJobStore) writeJSON(id string, suffix string, v interface{}) error {
+	path, err := f.path(id, suffix)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that a crash doesn't leave a truncated file behind
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *FileJobStore) readJSON(id string, suffix string, v interface{}) error {
+	path, err := f.path(id, suffix)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrJobNotFound
+		}
+		return err
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse %s", path)
+	}
+	return nil
+}
+
+func (f *FileJobStore) SaveJob(job *Job) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writeJSON(job.ID, ".json", job)
+}
+
+func (f *FileJobStore) GetJob(id string) (*Job, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	job := &Job{}
+	err := f.readJSON(id, ".json", job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (f *FileJobStore) ListJobs() ([]*Job, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*Job{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".result.json") {
+			continue
+		}
+		job := &Job{}
+		err = f.readJSON(strings.TrimSuffix(name, ".json"), ".json", job)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, job)
+	}
+	sortJobs(ret)
+	return ret, nil
+}
+
+func (f *FileJobStore) SaveResult(id string, result *JobResult) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writeJSON(id, ".result.json", result)
+}
+
+func (f *FileJobStore) GetResult(id string) (*JobResult, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	result := &JobResult{}
+	err := f.readJSON(id, ".result.json", result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *FileJobStore) DeleteJob(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, err := f.path(id, ".json")
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrJobNotFound
+		}
+		return err
+	}
+
+	resultPath, _ := f.path(id, ".result.json")
+	err = os.Remove(resultPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove result of job %s: %v", id, err)
+	}
+	return nil
+}
+
+func sortJobs(jobs []*Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+}
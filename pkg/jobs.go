@@ -0,0 +1,530 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/formatters"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	// JobStatusPending is the status of jobs waiting for a free slot to run
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusDone      JobStatus = "done"
+	JobStatusError     JobStatus = "error"
+	JobStatusCancelled JobStatus = "cancelled"
+)
+
+func (s JobStatus) IsFinished() bool {
+	return s == JobStatusDone || s == JobStatusError || s == JobStatusCancelled
+}
+
+// Job is an asynchronous run of a command, see JobManager.
+type Job struct {
+	ID string `json:"id"`
+	// Command is the path of the command, see commandPath
+	Command string `json:"command"`
+	// Principal is the ID of the principal who submitted the job, empty without authentication
+	Principal  string     `json:"principal,omitempty"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Rows       int        `json:"rows"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobResult holds the rows output by a job, once all the glazed middlewares have been applied.
+type JobResult struct {
+	Columns []string       `json:"columns"`
+	Rows    []types.MapRow `json:"rows"`
+}
+
+// JobManager runs commands in the background, and keeps track of their status and results
+// in a JobStore.
+//
+// At most MaxConcurrentJobs jobs run at the same time, the others wait in the pending state.
+// Finished jobs are deleted from the store once they are older than Retention.
+type JobManager struct {
+	Store             JobStore
+	MaxConcurrentJobs int
+	Retention         time.Duration
+
+	// mutex serializes the status updates of the jobs
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+	slots   chan struct{}
+}
+
+func NewJobManager(store JobStore) *JobManager {
+	return &JobManager{
+		Store:             store,
+		MaxConcurrentJobs: 4,
+		Retention:         24 * time.Hour,
+		cancels:           map[string]context.CancelFunc{},
+	}
+}
+
+// Start marks the jobs left unfinished by a previous run of the server as failed, and
+// starts deleting expired jobs in the background until ctx is cancelled.
+func (m *JobManager) Start(ctx context.Context) error {
+	if m.MaxConcurrentJobs <= 0 {
+		return fmt.Errorf("invalid maximum number of concurrent jobs: %d", m.MaxConcurrentJobs)
+	}
+	m.slots = make(chan struct{}, m.MaxConcurrentJobs)
+
+	jobs, err := m.Store.ListJobs()
+	if err != nil {
+		return errors.Wrap(err, "could not list jobs")
+	}
+	for _, job := range jobs {
+		if job.Status.IsFinished() {
+			continue
+		}
+		now := time.Now()
+		job.Status = JobStatusError
+		job.Error = "interrupted by a server restart"
+		job.FinishedAt = &now
+		err = m.Store.SaveJob(job)
+		if err != nil {
+			return errors.Wrapf(err, "could not update job %s", job.ID)
+		}
+	}
+
+	go func() {
+		interval := m.Retention
+		if interval > time.Minute || interval <= 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := m.DeleteExpiredJobs()
+				if err != nil {
+					log.Warn().Err(err).Msg("could not delete expired jobs")
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// DeleteExpiredJobs deletes the jobs that finished more than Retention ago.
+func (m *JobManager) DeleteExpiredJobs() error {
+	if m.Retention <= 0 {
+		return nil
+	}
+
+	jobs, err := m.Store.ListJobs()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, job := range jobs {
+		if job.FinishedAt == nil || time.Since(*job.FinishedAt) < m.Retention {
+			continue
+		}
+		err = m.Store.DeleteJob(job.ID)
+		if err != nil && err != ErrJobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateJob applies update to the stored job, unless it has already finished.
+func (m *JobManager) updateJob(id string, update func(job *Job)) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, err := m.Store.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status.IsFinished() {
+		return job, nil
+	}
+	update(job)
+	err = m.Store.SaveJob(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Submit creates a job running cmd in the background, and returns it right away.
+//
+// The command is run with a copy of c, whose request context is only cancelled
+// when the job is cancelled.
+func (m *JobManager) Submit(
+	c *gin.Context,
+	cmd ParkaCommand,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+) (*Job, error) {
+	if m.slots == nil {
+		return nil, fmt.Errorf("job manager is not started")
+	}
+
+	job := &Job{
+		ID:        uuid.New().String(),
+		Command:   commandPath(cmd.Description()),
+		Status:    JobStatusPending,
+		CreatedAt: time.Now(),
+	}
+	if principal, ok := PrincipalFromContext(c); ok {
+		job.Principal = principal.ID()
+	}
+	err := m.Store.SaveJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c = c.Copy()
+	c.Request = c.Request.WithContext(ctx)
+
+	m.mutex.Lock()
+	m.cancels[job.ID] = cancel
+	m.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			m.mutex.Lock()
+			delete(m.cancels, job.ID)
+			m.mutex.Unlock()
+			cancel()
+		}()
+
+		select {
+		case m.slots <- struct{}{}:
+			defer func() { <-m.slots }()
+		case <-ctx.Done():
+			return
+		}
+
+		_, err := m.updateJob(job.ID, func(job *Job) {
+			now := time.Now()
+			job.Status = JobStatusRunning
+			job.StartedAt = &now
+		})
+		if err != nil {
+			log.Error().Err(err).Str("job", job.ID).Msg("could not update job")
+			return
+		}
+
+		result, err := runJob(c, cmd, parsedLayers, ps)
+		if err == nil {
+			err = m.Store.SaveResult(job.ID, result)
+		}
+
+		_, err_ := m.updateJob(job.ID, func(job *Job) {
+			now := time.Now()
+			job.FinishedAt = &now
+			switch {
+			case ctx.Err() != nil:
+				job.Status = JobStatusCancelled
+			case err != nil:
+				job.Status = JobStatusError
+				job.Error = err.Error()
+			default:
+				job.Status = JobStatusDone
+				job.Rows = len(result.Rows)
+			}
+		})
+		if err_ != nil {
+			log.Error().Err(err_).Str("job", job.ID).Msg("could not update job")
+		}
+	}()
+
+	return job, nil
+}
+
+// runJob runs the command and collects its output rows.
+func runJob(
+	c *gin.Context,
+	cmd ParkaCommand,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+) (*JobResult, error) {
+	format, _ := LookupOutputFormat("json")
+	of, gp, err := SetupProcessor(format, parsedLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.RunFromParka(c, parsedLayers, ps, gp)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = of.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	jof, ok := of.(*formatters.JSONOutputFormatter)
+	if !ok {
+		return nil, fmt.Errorf("unexpected output formatter %T", of)
+	}
+	result := &JobResult{
+		Columns: jof.Table.Columns,
+		Rows:    []types.MapRow{},
+	}
+	for _, row := range jof.Table.Rows {
+		result.Rows = append(result.Rows, row.GetValues())
+	}
+	return result, nil
+}
+
+// Cancel cancels a pending or running job. Cancelling a finished job has no effect.
+func (m *JobManager) Cancel(id string) (*Job, error) {
+	job, err := m.updateJob(id, func(job *Job) {
+		now := time.Now()
+		job.Status = JobStatusCancelled
+		job.FinishedAt = &now
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	cancel, ok := m.cancels[id]
+	m.mutex.Unlock()
+	if ok {
+		cancel()
+	}
+
+	return job, nil
+}
+
+// writeJobResult renders the rows of a job result in the given format.
+func writeJobResult(c *gin.Context, format *OutputFormat, name string, result *JobResult) error {
+	if format.Streaming {
+		format.SetContentHeaders(c, name)
+		w := &httpStreamWriter{c: c, sse: format.Name == "sse"}
+		for _, row := range result.Rows {
+			err := w.writeEvent("row", row)
+			if err != nil {
+				return err
+			}
+		}
+		if w.sse {
+			return w.writeEvent("done", gin.H{"rows": len(result.Rows)})
+		}
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+		return nil
+	}
+
+	of, err := format.CreateOutputFormatter()
+	if err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		of.AddRow(&types.SimpleRow{Hash: row})
+	}
+	of.SetColumnOrder(result.Columns)
+
+	return format.WriteOutput(c, of, name)
+}
+
+// canAccessJob returns true if the caller may see, read the result of and cancel job, which
+// is the case if they submitted it and may still run its command, or if they are an admin.
+func (s *Server) canAccessJob(c *gin.Context, job *Job) bool {
+	principal, _ := PrincipalFromContext(c)
+	if s.Policies != nil && s.Policies.IsAdmin(principal) {
+		return true
+	}
+
+	id := ""
+	if principal != nil {
+		id = principal.ID()
+	}
+	if job.Principal != id {
+		return false
+	}
+
+	if s.Policies != nil {
+		cmd, ok := s.LookupCommand(job.Command)
+		if ok && !s.Policies.CanRun(principal, cmd.Description()) {
+			return false
+		}
+	}
+	return true
+}
+
+// getJob returns the job, or a *ForbiddenError if the caller may not access it.
+func (s *Server) getJob(c *gin.Context, id string) (*Job, error) {
+	job, err := s.Jobs.Store.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.canAccessJob(c, job) {
+		return nil, &ForbiddenError{Message: fmt.Sprintf("not allowed to access job %s", job.ID)}
+	}
+	return job, nil
+}
+
+func jobError(c *gin.Context, err error) {
+	if err == ErrJobNotFound {
+		writeError(c, NewHTTPError(http.StatusNotFound, "%s", err.Error()))
+		return
+	}
+	writeError(c, err)
+}
+
+// serveJobs exposes the asynchronous job API:
+//
+//   - POST /api/jobs/<parents>/<name> starts the command with the parameters passed as in
+//     a POST to /api/command, and returns the job with a 202 status.
+//   - GET /api/jobs lists the jobs of the caller, GET /api/jobs/:id returns a single one.
+//   - GET /api/jobs/:id/result returns the rows of a finished job, in the format negotiated
+//     with the client, like /api/command.
+//   - DELETE /api/jobs/:id cancels the job.
+//
+// Callers only list the jobs they submitted, unless they are admins, and get a 403 for the
+// jobs of others, see canAccessJob.
+func (s *Server) serveJobs() error {
+	err := s.Jobs.Start(context.Background())
+	if err != nil {
+		return err
+	}
+
+	s.Router.POST("/api/jobs/*path", func(c *gin.Context) {
+		path := c.Param("path")
+		cmd, ok := s.LookupCommand(path)
+		if !ok {
+			writeError(c, newUnknownCommandError(path))
+			return
+		}
+		err := s.authorize(c, cmd, nil)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		err = s.limitRate(c, cmd)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		parsedLayers, ps, err := s.parsePostParameters(c, cmd.Description())
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		err = s.checkParameters(c, cmd, ps)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		job, err := s.Jobs.Submit(c, &cachedCommand{ParkaCommand: cmd, s: s}, parsedLayers, ps)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		c.Header("Location", "/api/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, job)
+	})
+
+	s.Router.GET("/api/jobs", func(c *gin.Context) {
+		jobs, err := s.Jobs.Store.ListJobs()
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		ret := []*Job{}
+		for _, job := range jobs {
+			if s.canAccessJob(c, job) {
+				ret = append(ret, job)
+			}
+		}
+		c.JSON(http.StatusOK, ret)
+	})
+
+	s.Router.GET("/api/jobs/:id", func(c *gin.Context) {
+		job, err := s.getJob(c, c.Param("id"))
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	s.Router.GET("/api/jobs/:id/result", func(c *gin.Context) {
+		format, status, err := NegotiateOutputFormat(c)
+		if err != nil {
+			writeError(c, NewHTTPError(status, "%s", err.Error()))
+			return
+		}
+
+		job, err := s.getJob(c, c.Param("id"))
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		if job.Status != JobStatusDone {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  fmt.Sprintf("job %s has no result", job.ID),
+				"code":   "no_result",
+				"status": job.Status,
+			})
+			return
+		}
+
+		result, err := s.Jobs.Store.GetResult(job.ID)
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+
+		cmd, _ := s.LookupCommand(job.Command)
+		name := job.ID
+		if cmd != nil {
+			name = cmd.Description().Name
+		}
+		err = writeJobResult(c, format, name, result)
+		if err != nil && !c.Writer.Written() {
+			writeError(c, err)
+		}
+	})
+
+	s.Router.DELETE("/api/jobs/:id", func(c *gin.Context) {
+		job, err := s.getJob(c, c.Param("id"))
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		job, err = s.Jobs.Cancel(job.ID)
+		if err != nil {
+			jobError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// submitJob submits a job running the command at path, and returns it.
+func submitJob(t *testing.T, s *Server, path string, body string) *Job {
+	t.Helper()
+	w := post(s, "/api/jobs/"+path, "application/json", strings.NewReader(body))
+	expectStatus(t, w, http.StatusAccepted)
+	job := &Job{}
+	err := json.Unmarshal(w.Body.Bytes(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// expectJob checks the status and the error of the job returned by the job API.
+func expectJob(status JobStatus, err string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		job := &Job{}
+		err_ := json.Unmarshal(w.Body.Bytes(), job)
+		if err_ != nil {
+			t.Fatal(err_)
+		}
+		if job.Status != status || job.Error != err {
+			t.Errorf("expected the status %s and the error %q, got %s and %q", status, err, job.Status, job.Error)
+		}
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	slow := newTestCommand("slow", nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		started <- struct{}{}
+		<-c.Request.Context().Done()
+		return nil, c.Request.Context().Err()
+	})
+	s := newTestServer(t, WithCommands(slow))
+
+	job := submitJob(t, s, "slow", "{}")
+	<-started
+	runRequestTests(t, s, []requestTest{
+		{name: "running", target: "/api/jobs/" + job.ID, status: http.StatusOK, check: expectJob(JobStatusRunning, "")},
+		{name: "no result yet", target: "/api/jobs/" + job.ID + "/result", status: http.StatusConflict},
+		{name: "cancel", method: http.MethodDelete, target: "/api/jobs/" + job.ID, status: http.StatusOK, check: expectJob(JobStatusCancelled, "")},
+	})
+
+	waitForJob(t, s, job.ID)
+	runRequestTests(t, s, []requestTest{
+		// the command returning once cancelled doesn't turn the job into an error
+		{name: "cancelled", target: "/api/jobs/" + job.ID, status: http.StatusOK, check: expectJob(JobStatusCancelled, "")},
+		{name: "no result", target: "/api/jobs/" + job.ID + "/result", status: http.StatusConflict},
+		{name: "cancel again", method: http.MethodDelete, target: "/api/jobs/" + job.ID, status: http.StatusOK, check: expectJob(JobStatusCancelled, "")},
+		{name: "unknown", method: http.MethodDelete, target: "/api/jobs/unknown", status: http.StatusNotFound},
+	})
+}
+
+func TestJobPersistence(t *testing.T) {
+	dir := t.TempDir()
+	echo := newEchoCommand("echo", &parameters.ParameterDefinition{Name: "name", Type: parameters.ParameterTypeString})
+
+	store, err := NewFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithCommands(echo), WithJobStore(store))
+	done := submitJob(t, s, "echo", `{"name": "alice"}`)
+	waitForJob(t, s, done.ID)
+	// a job still running when the server stopped
+	interrupted := &Job{ID: "interrupted", Command: "echo", Status: JobStatusRunning, CreatedAt: time.Now()}
+	err = store.SaveJob(interrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart the server on the same directory
+	store, err = NewFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestServer(t, WithCommands(echo), WithJobStore(store))
+	runRequestTests(t, s, []requestTest{
+		{name: "done", target: "/api/jobs/" + done.ID, status: http.StatusOK, check: expectJob(JobStatusDone, "")},
+		{name: "result", target: "/api/jobs/" + done.ID + "/result", status: http.StatusOK, check: expectRow(map[string]interface{}{"name": "alice"})},
+		{
+			name:   "interrupted",
+			target: "/api/jobs/interrupted", status: http.StatusOK,
+			check: expectJob(JobStatusError, "interrupted by a server restart"),
+		},
+		{name: "list", target: "/api/jobs", status: http.StatusOK, check: expectBody(done.ID, `"interrupted"`)},
+	})
+}
+
+func TestFileJobStoreIDs(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "jobs")
+	store, err := NewFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a job right outside the job directory
+	err = os.WriteFile(filepath.Join(root, "outside.json"), []byte(`{"id": "outside", "status": "done"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"../outside", "..", "a/b", "a.b", "", "outside/../../outside"} {
+		t.Run(id, func(t *testing.T) {
+			if _, err := store.GetJob(id); err != ErrJobNotFound {
+				t.Errorf("expected GetJob to return ErrJobNotFound, got %v", err)
+			}
+			if _, err := store.GetResult(id); err != ErrJobNotFound {
+				t.Errorf("expected GetResult to return ErrJobNotFound, got %v", err)
+			}
+			if err := store.SaveJob(&Job{ID: id}); err != ErrJobNotFound {
+				t.Errorf("expected SaveJob to return ErrJobNotFound, got %v", err)
+			}
+			if err := store.SaveResult(id, &JobResult{}); err != ErrJobNotFound {
+				t.Errorf("expected SaveResult to return ErrJobNotFound, got %v", err)
+			}
+			if err := store.DeleteJob(id); err != ErrJobNotFound {
+				t.Errorf("expected DeleteJob to return ErrJobNotFound, got %v", err)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "outside.json")); err != nil {
+		t.Errorf("expected the file outside the job directory to survive, got %v", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected nothing to be written outside the job directory, got %v", entries)
+	}
+
+	s := newTestServer(t, WithJobStore(store))
+	runRequestTests(t, s, []requestTest{
+		{name: "escaped", target: "/api/jobs/..%2Foutside", status: http.StatusNotFound},
+		{name: "escaped result", target: "/api/jobs/..%2Foutside/result", status: http.StatusNotFound},
+	})
+}
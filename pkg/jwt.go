@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// JWTAuthenticator authenticates requests by a JWT passed as a bearer token, signed with one
+// of the keys of a JWKS.
+type JWTAuthenticator struct {
+	// keys maps key IDs to public keys
+	keys map[string]interface{}
+	// Issuer and Audience are checked if they are set
+	Issuer   string
+	Audience string
+	// NameClaim is the claim used as the name of the principal, "sub" by default
+	NameClaim string
+}
+
+type JWTAuthenticatorOption func(*JWTAuthenticator)
+
+func WithJWTIssuer(issuer string) JWTAuthenticatorOption {
+	return func(j *JWTAuthenticator) {
+		j.Issuer = issuer
+	}
+}
+
+func WithJWTAudience(audience string) JWTAuthenticatorOption {
+	return func(j *JWTAuthenticator) {
+		j.Audience = audience
+	}
+}
+
+func WithJWTNameClaim(claim string) JWTAuthenticatorOption {
+	return func(j *JWTAuthenticator) {
+		j.NameClaim = claim
+	}
+}
+
+// NewJWTAuthenticator creates an authenticator checking tokens against keys, which maps key
+// IDs to *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey, see ParseJWKS.
+func NewJWTAuthenticator(keys map[string]interface{}, options ...JWTAuthenticatorOption) *JWTAuthenticator {
+	ret := &JWTAuthenticator{
+		keys:      keys,
+		NameClaim: "sub",
+	}
+	for _, option := range options {
+		option(ret)
+	}
+	return ret
+}
+
+func NewJWTAuthenticatorFromJWKSFile(path string, options ...JWTAuthenticatorOption) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load JWKS %s", path)
+	}
+	return NewJWTAuthenticator(keys, options...), nil
+}
+
+func (j *JWTAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	scheme, tokenString, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimSpace(tokenString), claims, j.lookupKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+
+	if j.Issuer != "" && !claims.VerifyIssuer(j.Issuer, true) {
+		return nil, errors.New("invalid token: wrong issuer")
+	}
+	if j.Audience != "" && !claims.VerifyAudience(j.Audience, true) {
+		return nil, errors.New("invalid token: wrong audience")
+	}
+
+	name, ok := claims[j.NameClaim].(string)
+	if !ok || name == "" {
+		return nil, errors.Errorf("invalid token: missing %s claim", j.NameClaim)
+	}
+
+	roles := []string{}
+	if l, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range l {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	}
+
+	return &Principal{Name: name, Provider: "jwt", Roles: roles, Claims: claims}, nil
+}
+
+// lookupKey returns the key the token was signed with, making sure the algorithm of the
+// token matches the type of the key.
+func (j *JWTAuthenticator) lookupKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := j.keys[kid]
+	if !ok && kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, errors.Errorf("unknown key '%s'", kid)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, isRSA := token.Method.(*jwt.SigningMethodRSA)
+		_, isPSS := token.Method.(*jwt.SigningMethodRSAPSS)
+		ok = isRSA || isPSS
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	case ed25519.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodEd25519)
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, errors.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	return key, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses the public RSA, EC and Ed25519 keys of a JSON Web Key Set, indexed by their
+// key ID. Encryption keys are skipped.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key '%s'", k.Kid)
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, errors.Errorf("duplicate key '%s'", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys found")
+	}
+
+	return keys, nil
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.Sign() <= 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.X, "="))
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
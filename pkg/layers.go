@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// These parsers implement glazed's layers.ParameterLayerParser for the different ways
+// parameters can be passed over HTTP, the same way layers.CobraParameterLayerParser
+// does for command line flags. Files referenced by file loading parameters are loaded
+// with the given FileLoader.
+//
+// Each parameter of a layer is looked up under the layer's prefix followed by its name,
+// so that the flags of a layer prefixed with "db-" are passed as ?db-host=...
+
+// QueryParameterLayerParser parses layers from the query parameters of a request.
+type QueryParameterLayerParser struct {
+	c     *gin.Context
+	files *FileLoader
+}
+
+func NewQueryParameterLayerParser(c *gin.Context, files *FileLoader) *QueryParameterLayerParser {
+	return &QueryParameterLayerParser{c: c, files: files}
+}
+
+func (q *QueryParameterLayerParser) RegisterParameterLayer(layer layers.ParameterLayer) (layers.ParameterLayerParserFunc, error) {
+	return func() (*layers.ParsedParameterLayer, error) {
+		ps, err := parseQueryParameters(q.c, q.files, getLayerParameterDefinitions(layer), layer.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+		return newParsedParameterLayer(layer, ps), nil
+	}, nil
+}
+
+// FormParameterLayerParser parses layers from the form fields and files of a POST request.
+type FormParameterLayerParser struct {
+	c     *gin.Context
+	files *FileLoader
+}
+
+func NewFormParameterLayerParser(c *gin.Context, files *FileLoader) *FormParameterLayerParser {
+	return &FormParameterLayerParser{c: c, files: files}
+}
+
+func (f *FormParameterLayerParser) RegisterParameterLayer(layer layers.ParameterLayer) (layers.ParameterLayerParserFunc, error) {
+	return func() (*layers.ParsedParameterLayer, error) {
+		ps, err := parseFormData(f.c, f.files, getLayerParameterDefinitions(layer), layer.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+		return newParsedParameterLayer(layer, ps), nil
+	}, nil
+}
+
+// JSONParameterLayerParser parses layers from an already decoded JSON object.
+type JSONParameterLayerParser struct {
+	values map[string]interface{}
+	files  *FileLoader
+}
+
+func NewJSONParameterLayerParser(values map[string]interface{}, files *FileLoader) *JSONParameterLayerParser {
+	return &JSONParameterLayerParser{values: values, files: files}
+}
+
+func (j *JSONParameterLayerParser) RegisterParameterLayer(layer layers.ParameterLayer) (layers.ParameterLayerParserFunc, error) {
+	return func() (*layers.ParsedParameterLayer, error) {
+		ps, err := parseJSONParameters(j.files, j.values, getLayerParameterDefinitions(layer), layer.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+		return newParsedParameterLayer(layer, ps), nil
+	}, nil
+}
+
+// newParsedParameterLayer leaves the parameters without a value or default out, like glazed,
+// since layers like the glazed output layer can't initialize their settings from nil values.
+func newParsedParameterLayer(layer layers.ParameterLayer, ps map[string]interface{}) *layers.ParsedParameterLayer {
+	for k, v := range ps {
+		if v == nil {
+			delete(ps, k)
+		}
+	}
+	return &layers.ParsedParameterLayer{Layer: layer, Parameters: ps}
+}
+
+// getLayerParameterDefinitions returns the parameter definitions of a layer sorted by name,
+// so that errors are reported in a stable order.
+func getLayerParameterDefinitions(layer layers.ParameterLayer) []*parameters.ParameterDefinition {
+	pds := layer.GetParameterDefinitions()
+	ret := make([]*parameters.ParameterDefinition, 0, len(pds))
+	for _, p := range pds {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// parseLayers parses all the layers of the command described by description with the given parser.
+//
+// It returns the parsed layers by slug, as well as all the parsed layer parameters merged
+// into a single map, which is how glazed passes them to commands on the command line.
+// The invalid parameters of all the layers are reported together.
+func parseLayers(
+	description *cmds.CommandDescription,
+	parser layers.ParameterLayerParser,
+) (map[string]*layers.ParsedParameterLayer, map[string]interface{}, error) {
+	parsedLayers := map[string]*layers.ParsedParameterLayer{}
+	ps := map[string]interface{}{}
+	invalidParameters := []error{}
+
+	for _, layer := range description.Layers {
+		parserFunc, err := parser.RegisterParameterLayer(layer)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to register layer '%s'", layer.GetSlug())
+		}
+
+		parsedLayer, err := parserFunc()
+		var httpError *HTTPError
+		if errors.As(err, &httpError) && httpError.Code == ErrorCodeInvalidParameters {
+			// keep going to report the invalid parameters of all the layers
+			invalidParameters = append(invalidParameters, err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse layer '%s'", layer.GetSlug())
+		}
+
+		parsedLayers[layer.GetSlug()] = parsedLayer
+		for k, v := range parsedLayer.Parameters {
+			ps[k] = v
+		}
+	}
+
+	if err := mergeParameterErrors(invalidParameters...); err != nil {
+		return nil, nil, err
+	}
+
+	return parsedLayers, ps, nil
+}
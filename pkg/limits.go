@@ -0,0 +1,267 @@
+package pkg
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits protect the server from clients running too many commands. They are loaded from YAML:
+//
+//	# applies to the commands matched by no other limit
+//	default:
+//	  rate: 10
+//	  burst: 20
+//	limits:
+//	  - commands: ["reports/**"]
+//	    # one run per second for each client, with bursts of up to 5 runs
+//	    rate: 1
+//	    burst: 5
+//	    # at most 2 runs of each command at the same time, other runs wait for up to 30s
+//	    concurrency: 2
+//	    queue_timeout: 30s
+//
+// Rates are enforced with a token bucket per client and command, clients being identified
+// by their principal when authenticated, and by their IP address otherwise. Command paths
+// are matched like in Policies, and the first limit matching a command applies.
+// Requests over the limits are rejected with a 429 and a Retry-After header.
+type Limits struct {
+	Default *Limit   `yaml:"default,omitempty"`
+	Limits  []*Limit `yaml:"limits,omitempty"`
+}
+
+type Limit struct {
+	Commands []string `yaml:"commands,omitempty"`
+	// Rate is the number of runs per second allowed for each client, 0 for no limit
+	Rate float64 `yaml:"rate,omitempty"`
+	// Burst is the number of runs a client can start at once, by default the rate rounded up
+	Burst int `yaml:"burst,omitempty"`
+	// Concurrency is the number of runs of each command at the same time, 0 for no limit
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// QueueTimeout is how long runs wait for a slot once Concurrency is reached,
+	// 0 to reject them right away
+	QueueTimeout time.Duration `yaml:"queue_timeout,omitempty"`
+}
+
+func LoadLimitsFromFile(fileName string) (*Limits, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limits := &Limits{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(limits)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load limits from %s", fileName)
+	}
+
+	for _, limit := range append([]*Limit{limits.Default}, limits.Limits...) {
+		if limit == nil {
+			continue
+		}
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrency < 0 || limit.QueueTimeout < 0 {
+			return nil, errors.Errorf("limits in %s can't be negative", fileName)
+		}
+	}
+	if limits.Default != nil && len(limits.Default.Commands) > 0 {
+		return nil, errors.Errorf("the default limit in %s can't have commands", fileName)
+	}
+	for _, limit := range limits.Limits {
+		if len(limit.Commands) == 0 {
+			return nil, errors.Errorf("a limit in %s has no commands", fileName)
+		}
+		for _, pattern := range limit.Commands {
+			for _, segment := range strings.Split(pattern, "/") {
+				if _, err := path.Match(segment, ""); err != nil {
+					return nil, errors.Errorf("invalid command pattern '%s' in %s", pattern, fileName)
+				}
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// WithLimits enforces limits on the runs of all the commands of the server.
+func WithLimits(limits *Limits) ServerOption {
+	return func(s *Server) {
+		s.limiter = newLimiter(limits)
+	}
+}
+
+func (l *Limits) lookupLimit(description *cmds.CommandDescription) *Limit {
+	segments := strings.Split(commandPath(description), "/")
+	for _, limit := range l.Limits {
+		for _, pattern := range limit.Commands {
+			if matchCommandPattern(strings.Split(pattern, "/"), segments) {
+				return limit
+			}
+		}
+	}
+	return l.Default
+}
+
+func (l *Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Ceil(l.Rate))
+}
+
+// limiter keeps the token buckets of the clients and the run slots of the commands.
+type limiter struct {
+	limits *Limits
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	slots   map[string]chan struct{}
+	// pruned is when the idle buckets were last removed
+	pruned time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiter(limits *Limits) *limiter {
+	return &limiter{
+		limits:  limits,
+		buckets: map[string]*bucket{},
+		slots:   map[string]chan struct{}{},
+		pruned:  time.Now(),
+	}
+}
+
+// prune removes the buckets that have been idle long enough to be full again, as they
+// are no different from new ones. It has to be called with the mutex held.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		refill := time.Duration(float64(b.limiter.Burst()) / float64(b.limiter.Limit()) * float64(time.Second))
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client of a request for rate limiting. Principals are identified
+// by their ID, so that principals with the same name known by different authenticators don't
+// share their limits.
+func clientKey(c *gin.Context) string {
+	if principal, ok := PrincipalFromContext(c); ok && principal != nil {
+		return "principal:" + principal.ID()
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// newTooManyRequestsError returns a 429 telling the client to retry after retryAfter.
+func newTooManyRequestsError(code string, retryAfter time.Duration, format string, args ...interface{}) *HTTPError {
+	ret := NewHTTPError(http.StatusTooManyRequests, format, args...).WithCode(code)
+	ret.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+	if ret.RetryAfter < 1 {
+		ret.RetryAfter = 1
+	}
+	return ret
+}
+
+func (l *limiter) allow(c *gin.Context, description *cmds.CommandDescription) error {
+	limit := l.limits.lookupLimit(description)
+	if limit == nil || limit.Rate <= 0 {
+		return nil
+	}
+
+	name := commandPath(description)
+	key := name + "\x00" + clientKey(c)
+	now := time.Now()
+
+	l.mutex.Lock()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.burst())}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	l.mutex.Unlock()
+
+	r := b.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if r.OK() && delay == 0 {
+		return nil
+	}
+	r.CancelAt(now)
+	return newTooManyRequestsError("rate_limited", delay,
+		"too many runs of '%s', retry in %s", name, delay.Round(time.Second))
+}
+
+// acquire waits for a slot to run the command, and returns the function releasing it.
+func (l *limiter) acquire(ctx context.Context, description *cmds.CommandDescription) (func(), error) {
+	limit := l.limits.lookupLimit(description)
+	if limit == nil || limit.Concurrency <= 0 {
+		return func() {}, nil
+	}
+
+	name := commandPath(description)
+	l.mutex.Lock()
+	slots, ok := l.slots[name]
+	if !ok {
+		slots = make(chan struct{}, limit.Concurrency)
+		l.slots[name] = slots
+	}
+	l.mutex.Unlock()
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if limit.QueueTimeout > 0 {
+		timer := time.NewTimer(limit.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+			return release, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil, newTooManyRequestsError("concurrency_limited", limit.QueueTimeout,
+		"too many runs of '%s' at the same time", name)
+}
+
+// limitRate returns a 429 *HTTPError if the client of the request runs cmd too often, see Limits.
+func (s *Server) limitRate(c *gin.Context, cmd ParkaCommand) error {
+	if s.limiter == nil {
+		return nil
+	}
+	return s.limiter.allow(c, cmd.Description())
+}
+
+// acquireSlot waits for a slot to run cmd, see Limit.Concurrency, and returns the function
+// releasing it.
+func (s *Server) acquireSlot(c *gin.Context, cmd ParkaCommand) (func(), error) {
+	if s.limiter == nil {
+		return func() {}, nil
+	}
+	return s.limiter.acquire(c.Request.Context(), cmd.Description())
+}
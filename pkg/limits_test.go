@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t,
+		WithCommands(newEchoCommand("reports/echo"), newEchoCommand("other")),
+		WithLimits(&Limits{Limits: []*Limit{{Commands: []string{"reports/*"}, Rate: 0.1, Burst: 2}}}),
+	)
+
+	runRequestTests(t, s, []requestTest{
+		{name: "first", target: "/api/command/reports/echo", remoteAddr: "10.0.0.1:1234", status: http.StatusOK},
+		{name: "burst", target: "/api/command/reports/echo", remoteAddr: "10.0.0.1:1234", status: http.StatusOK},
+		{
+			name:   "limited",
+			target: "/api/command/reports/echo", remoteAddr: "10.0.0.1:1234",
+			status: http.StatusTooManyRequests,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				e := decodeError(t, w)
+				if e.Code != "rate_limited" || e.RetryAfter < 1 || e.RetryAfter > 10 {
+					t.Errorf("unexpected error %+v", e)
+				}
+				if w.Header().Get("Retry-After") == "" {
+					t.Errorf("expected a Retry-After header")
+				}
+			},
+		},
+		// the other clients and commands are not limited
+		{name: "other client", target: "/api/command/reports/echo", remoteAddr: "10.0.0.2:1234", status: http.StatusOK},
+		{name: "other command", target: "/api/command/other", remoteAddr: "10.0.0.1:1234", status: http.StatusOK},
+		{
+			// X-Forwarded-For is ignored unless the proxy is trusted
+			name:   "forwarded",
+			target: "/api/command/reports/echo", remoteAddr: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", "10.0.0.3"},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			// the jobs API is limited as well
+			name:   "jobs",
+			method: http.MethodPost, target: "/api/jobs/reports/echo", remoteAddr: "10.0.0.1:1234",
+			body:   "{}",
+			status: http.StatusTooManyRequests,
+		},
+	})
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	s := newTestServer(t,
+		WithCommands(newEchoCommand("echo")),
+		WithLimits(&Limits{Default: &Limit{Rate: 0.1, Burst: 1}}),
+		WithTrustedProxies("10.0.0.1"),
+	)
+
+	forwardedFor := func(name string, client string, status int) requestTest {
+		return requestTest{
+			name:   name,
+			target: "/api/command/echo", remoteAddr: "10.0.0.1:1234", headers: []string{"X-Forwarded-For", client},
+			status: status,
+		}
+	}
+	runRequestTests(t, s, []requestTest{
+		forwardedFor("client", "10.0.0.3", http.StatusOK),
+		forwardedFor("other client", "10.0.0.4", http.StatusOK),
+		forwardedFor("limited", "10.0.0.3", http.StatusTooManyRequests),
+	})
+}
+
+func TestRateLimitPerPrincipal(t *testing.T) {
+	s := newTestServer(t, withTestAuthenticators(t), WithCommands(newWhoamiCommand("whoami")),
+		WithLimits(&Limits{Default: &Limit{Rate: 0.1, Burst: 1}}))
+
+	alice := []string{"X-API-Key", "alice-key"}
+	runRequestTests(t, s, []requestTest{
+		{name: "alice", target: "/api/command/whoami", headers: alice, status: http.StatusOK},
+		{name: "alice limited", target: "/api/command/whoami", headers: alice, status: http.StatusTooManyRequests},
+		{name: "bob", target: "/api/command/whoami", headers: []string{"X-API-Key", "bob-key"}, status: http.StatusOK},
+		// principals with the same name but another authenticator have their own limit
+		{name: "dave", target: "/api/command/whoami", headers: []string{"X-API-Key", "dave-key"}, status: http.StatusOK},
+		{name: "dave with basic", target: "/api/command/whoami", headers: []string{"Authorization", basicAuth("dave", "secret")}, status: http.StatusOK},
+		{name: "dave limited", target: "/api/command/whoami", headers: []string{"X-API-Key", "dave-key"}, status: http.StatusTooManyRequests},
+	})
+}
+
+// newBlockingCommand returns a command that blocks until release is closed, signalling on
+// started when it runs.
+func newBlockingCommand(path string, started chan<- struct{}, release <-chan struct{}) *testCommand {
+	return newTestCommand(path, nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return []map[string]interface{}{{"done": true}}, nil
+	})
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	s := newTestServer(t,
+		WithCommands(newBlockingCommand("slow", started, release)),
+		WithLimits(&Limits{Default: &Limit{Concurrency: 1}}),
+	)
+
+	done := make(chan int)
+	go func() {
+		done <- get(s, "/api/command/slow").Code
+	}()
+	<-started
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "limited",
+			target: "/api/command/slow",
+			status: http.StatusTooManyRequests,
+			check:  expectErrorCode("concurrency_limited"),
+		},
+		{name: "limited stream", target: "/api/command/slow?_output=ndjson", status: http.StatusTooManyRequests},
+	})
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected the first run to succeed, got %d", code)
+	}
+	go func() { <-started }()
+	expectStatus(t, get(s, "/api/command/slow"), http.StatusOK)
+}
+
+func TestConcurrencyLimitQueue(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	s := newTestServer(t,
+		WithCommands(newBlockingCommand("slow", started, release)),
+		WithLimits(&Limits{Default: &Limit{Concurrency: 1, QueueTimeout: 5 * time.Second}}),
+	)
+
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- get(s, "/api/command/slow").Code
+		}()
+	}
+	<-started
+	select {
+	case <-started:
+		t.Fatal("expected the second run to wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-results; code != http.StatusOK {
+			t.Errorf("expected the queued run to succeed, got %d", code)
+		}
+	}
+}
+
+// forwardingTestCommand forwards its requests by blocking until release is closed.
+type forwardingTestCommand struct {
+	*testCommand
+	started chan<- struct{}
+	release <-chan struct{}
+}
+
+func (f *forwardingTestCommand) ForwardRequest(c *gin.Context) {
+	f.started <- struct{}{}
+	<-f.release
+	c.JSON(http.StatusOK, []interface{}{})
+}
+
+func TestConcurrencyLimitForwarded(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	cmd := &forwardingTestCommand{testCommand: newEchoCommand("upstream/echo"), started: started, release: release}
+	s := newTestServer(t, WithCommands(cmd), WithLimits(&Limits{Default: &Limit{Concurrency: 1}}))
+
+	done := make(chan int)
+	go func() {
+		done <- get(s, "/api/command/upstream/echo").Code
+	}()
+	<-started
+	expectStatus(t, get(s, "/api/command/upstream/echo"), http.StatusTooManyRequests)
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected the forwarded request to succeed, got %d", code)
+	}
+}
+
+func TestLoadLimitsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	load := func(content string) error {
+		fileName := filepath.Join(dir, "limits.yaml")
+		err := os.WriteFile(fileName, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadLimitsFromFile(fileName)
+		return err
+	}
+
+	if err := load("default:\n  rate: 1\nlimits:\n  - commands: [\"reports/**\"]\n    concurrency: 2\n    queue_timeout: 30s\n"); err != nil {
+		t.Errorf("expected valid limits, got %v", err)
+	}
+	for _, invalid := range []string{
+		"default:\n  rate: -1\n",
+		"default:\n  commands: [\"a\"]\n",
+		"limits:\n  - rate: 1\n",
+		"limits:\n  - commands: [\"[\"]\n",
+		"default:\n  rte: 1\n",
+	} {
+		if err := load(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
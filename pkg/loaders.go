@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// aliasCommand is a command alias whose description uses the flags and arguments of
+// the alias as defaults of the aliased command.
+type aliasCommand struct {
+	alias       *cmds.CommandAlias
+	description *cmds.CommandDescription
+}
+
+func newAliasCommand(alias *cmds.CommandAlias, aliased cmds.Command) (*aliasCommand, error) {
+	alias.AliasedCommand = aliased
+
+	description := alias.Description()
+	description.Parents = alias.Parents
+	description.Source = alias.Source
+
+	for _, flag := range description.Flags {
+		v, ok := alias.Flags[flag.Name]
+		if !ok {
+			continue
+		}
+		value, err := flag.ParseParameter([]string{v})
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for flag %s of alias %s", flag.Name, alias.Name)
+		}
+		flag.Default = value
+		flag.Required = false
+	}
+	for i, argument := range description.Arguments {
+		if i >= len(alias.Arguments) {
+			break
+		}
+		value, err := argument.ParseParameter([]string{alias.Arguments[i]})
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for argument %s of alias %s", argument.Name, alias.Name)
+		}
+		argument.Default = value
+		argument.Required = false
+	}
+
+	return &aliasCommand{
+		alias:       alias,
+		description: description,
+	}, nil
+}
+
+func (a *aliasCommand) Description() *cmds.CommandDescription {
+	return a.description
+}
+
+func (a *aliasCommand) Run(
+	ctx context.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	return a.alias.Run(ctx, parsedLayers, ps, gp)
+}
+
+// strictCommandLoader records the errors of the files that can't be loaded, which glazed's
+// YAMLFSCommandLoader skips. Files that can't be decoded as a command are loaded as an alias,
+// so only the errors of aliases are recorded for them.
+type strictCommandLoader struct {
+	cmds.YAMLCommandLoader
+	errs []error
+}
+
+func (l *strictCommandLoader) record(s io.Reader, err error) {
+	name := "file"
+	if f, ok := s.(fs.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			name = fi.Name()
+		}
+	}
+	l.errs = append(l.errs, errors.Wrapf(err, "could not load %s", name))
+}
+
+func (l *strictCommandLoader) LoadCommandFromYAML(s io.Reader) ([]cmds.Command, error) {
+	commands, err := l.YAMLCommandLoader.LoadCommandFromYAML(s)
+	if _, ok := err.(*yaml.TypeError); err != nil && !ok {
+		l.record(s, err)
+	}
+	return commands, err
+}
+
+func (l *strictCommandLoader) LoadCommandAliasFromYAML(s io.Reader) ([]*cmds.CommandAlias, error) {
+	aliases, err := l.YAMLCommandLoader.LoadCommandAliasFromYAML(s)
+	if err != nil {
+		l.record(s, err)
+	}
+	return aliases, err
+}
+
+// LoadCommandsFromDirectory loads the YAML shell commands and command aliases found in dir,
+// see ShellCommandDescription. Subdirectories become the parents of the commands they contain.
+//
+// Aliases refer to a command with the same parents. The relative working directories of
+// shell commands are resolved against the directory of their YAML file.
+//
+// Loading fails if one of the files is neither a valid command nor a valid alias, instead
+// of leaving it out.
+func LoadCommandsFromDirectory(dir string) ([]ParkaCommand, error) {
+	strictLoader := &strictCommandLoader{YAMLCommandLoader: &ShellCommandLoader{}}
+	loader := cmds.NewYAMLFSCommandLoader(strictLoader, dir, ".")
+	commands, aliases, err := loader.LoadCommandsFromFS(os.DirFS(dir), ".")
+	if err == nil && len(strictLoader.errs) > 0 {
+		err = strictLoader.errs[0]
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load commands from %s", dir)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load commands from %s", dir)
+	}
+
+	ret := []ParkaCommand{}
+	commandsByPath := map[string]cmds.Command{}
+	for _, command := range commands {
+		// the YAML file of a command is in the directory of its parents
+		if sc, ok := command.(*ShellCommand); ok && sc.Dir != "" && !filepath.IsAbs(sc.Dir) {
+			sc.Dir = filepath.Join(append(append([]string{absDir}, command.Description().Parents...), sc.Dir)...)
+		}
+		commandsByPath[commandPath(command.Description())] = command
+		ret = append(ret, NewSimpleParkaCommand(command))
+	}
+
+	for _, alias := range aliases {
+		path := strings.Join(append(append([]string{}, alias.Parents...), alias.AliasFor), "/")
+		aliased, ok := commandsByPath[path]
+		if !ok {
+			return nil, errors.Errorf("alias %s (%s) refers to unknown command %s", alias.Name, alias.Source, path)
+		}
+		command, err := newAliasCommand(alias, aliased)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, NewSimpleParkaCommand(command))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,615 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The OpenAPI types only cover the subset of the OpenAPI 3 specification needed to
+// describe the parka API.
+
+type OpenAPISpec struct {
+	OpenAPI    string                      `json:"openapi" yaml:"openapi"`
+	Info       OpenAPIInfo                 `json:"info" yaml:"info"`
+	Tags       []*OpenAPITag               `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Paths      map[string]*OpenAPIPathItem `json:"paths" yaml:"paths"`
+	Components OpenAPIComponents           `json:"components" yaml:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title" yaml:"title"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Version     string `json:"version" yaml:"version"`
+}
+
+type OpenAPITag struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+type OpenAPIComponents struct {
+	Schemas   map[string]*OpenAPISchema   `json:"schemas,omitempty" yaml:"schemas,omitempty"`
+	Responses map[string]*OpenAPIResponse `json:"responses,omitempty" yaml:"responses,omitempty"`
+}
+
+type OpenAPIPathItem struct {
+	Get    *OpenAPIOperation `json:"get,omitempty" yaml:"get,omitempty"`
+	Post   *OpenAPIOperation `json:"post,omitempty" yaml:"post,omitempty"`
+	Delete *OpenAPIOperation `json:"delete,omitempty" yaml:"delete,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty" yaml:"operationId,omitempty"`
+	Summary     string                      `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Description string                      `json:"description,omitempty" yaml:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses" yaml:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name        string         `json:"name" yaml:"name"`
+	In          string         `json:"in" yaml:"in"`
+	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool           `json:"required,omitempty" yaml:"required,omitempty"`
+	Style       string         `json:"style,omitempty" yaml:"style,omitempty"`
+	Explode     *bool          `json:"explode,omitempty" yaml:"explode,omitempty"`
+	Schema      *OpenAPISchema `json:"schema" yaml:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty" yaml:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content" yaml:"content"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type OpenAPIResponse struct {
+	Ref         string                       `json:"$ref,omitempty" yaml:"$ref,omitempty"`
+	Description string                       `json:"description,omitempty" yaml:"description,omitempty"`
+	Headers     map[string]*OpenAPIHeader    `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+type OpenAPIHeader struct {
+	Description string         `json:"description,omitempty" yaml:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty" yaml:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty" yaml:"type,omitempty"`
+	Format      string                    `json:"format,omitempty" yaml:"format,omitempty"`
+	Description string                    `json:"description,omitempty" yaml:"description,omitempty"`
+	Items       *OpenAPISchema            `json:"items,omitempty" yaml:"items,omitempty"`
+	Properties  map[string]*OpenAPISchema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	// AdditionalProperties is either a bool or a *OpenAPISchema
+	AdditionalProperties interface{}   `json:"additionalProperties,omitempty" yaml:"additionalProperties,omitempty"`
+	Required             []string      `json:"required,omitempty" yaml:"required,omitempty"`
+	Enum                 []interface{} `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Default              interface{}   `json:"default,omitempty" yaml:"default,omitempty"`
+	Minimum              *float64      `json:"minimum,omitempty" yaml:"minimum,omitempty"`
+	Maximum              *float64      `json:"maximum,omitempty" yaml:"maximum,omitempty"`
+}
+
+// ParameterRanger is implemented by commands restricting the values of numeric parameters,
+// see WithParameterRange. The ranges are documented as the minimum and maximum of the schemas.
+type ParameterRanger interface {
+	ParameterRange(name string) (min float64, max float64, ok bool)
+}
+
+func schemaRef(name string) *OpenAPISchema {
+	return &OpenAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func responseRef(name string) *OpenAPIResponse {
+	return &OpenAPIResponse{Ref: "#/components/responses/" + name}
+}
+
+// parameterSchema returns the schema of a parameter. In query strings and forms, file loading
+// parameters are passed the content of the file or a reference to it as a string, while they
+// are passed as structured values in JSON bodies.
+func parameterSchema(p *parameters.ParameterDefinition, inJSON bool) *OpenAPISchema {
+	ret := &OpenAPISchema{}
+
+	switch p.Type {
+	case parameters.ParameterTypeString,
+		parameters.ParameterTypeStringFromFile:
+		ret.Type = "string"
+	case parameters.ParameterTypeInteger:
+		ret.Type = "integer"
+	case parameters.ParameterTypeFloat:
+		ret.Type = "number"
+	case parameters.ParameterTypeBool:
+		ret.Type = "boolean"
+	case parameters.ParameterTypeDate:
+		// glazed also accepts natural language dates, so no format is enforced
+		ret.Type = "string"
+		ret.Description = "A date, for example 2023-01-31"
+	case parameters.ParameterTypeChoice:
+		ret.Type = "string"
+		for _, choice := range p.Choices {
+			ret.Enum = append(ret.Enum, choice)
+		}
+	case parameters.ParameterTypeStringList:
+		ret.Type = "array"
+		ret.Items = &OpenAPISchema{Type: "string"}
+	case parameters.ParameterTypeIntegerList:
+		ret.Type = "array"
+		ret.Items = &OpenAPISchema{Type: "integer"}
+	case parameters.ParameterTypeFloatList:
+		ret.Type = "array"
+		ret.Items = &OpenAPISchema{Type: "number"}
+	case parameters.ParameterTypeKeyValue:
+		if inJSON {
+			ret.Type = "object"
+			ret.AdditionalProperties = &OpenAPISchema{Type: "string"}
+		} else {
+			ret.Type = "array"
+			ret.Items = &OpenAPISchema{Type: "string", Description: "key:value"}
+		}
+	case parameters.ParameterTypeObjectFromFile:
+		if inJSON {
+			ret.Type = "object"
+			ret.AdditionalProperties = true
+		} else {
+			ret.Type = "string"
+			ret.Description = "A JSON or YAML object, or @ followed by a reference to a file"
+		}
+	case parameters.ParameterTypeObjectListFromFile:
+		if inJSON {
+			ret.Type = "array"
+			ret.Items = &OpenAPISchema{Type: "object", AdditionalProperties: true}
+		} else {
+			ret.Type = "string"
+			ret.Description = "A JSON or YAML list of objects, or @ followed by a reference to a file, which can also be CSV or TSV"
+		}
+	case parameters.ParameterTypeStringListFromFile:
+		if inJSON {
+			ret.Type = "array"
+			ret.Items = &OpenAPISchema{Type: "string"}
+		} else {
+			ret.Type = "string"
+			ret.Description = "One value per line, or @ followed by a reference to a file"
+		}
+	}
+
+	if p.Default != nil {
+		ret.Default = p.Default
+	}
+
+	return ret
+}
+
+// commandParameterDefinitions returns all the parameters of a command, along with the name
+// under which they are passed, which includes the layer prefix.
+func commandParameterDefinitions(description *cmds.CommandDescription) ([]string, []*parameters.ParameterDefinition) {
+	names := []string{}
+	ret := []*parameters.ParameterDefinition{}
+	for _, p := range append(append([]*parameters.ParameterDefinition{}, description.Arguments...), description.Flags...) {
+		names = append(names, p.Name)
+		ret = append(ret, p)
+	}
+	for _, layer := range description.Layers {
+		for _, p := range getLayerParameterDefinitions(layer) {
+			names = append(names, layer.GetPrefix()+p.Name)
+			ret = append(ret, p)
+		}
+	}
+	return names, ret
+}
+
+// applyParameterRange sets the minimum and maximum of the schema of the parameter passed as name,
+// or of the elements of lists.
+func applyParameterRange(schema *OpenAPISchema, ranger ParameterRanger, name string) {
+	if ranger == nil {
+		return
+	}
+	min, max, ok := ranger.ParameterRange(name)
+	if !ok {
+		return
+	}
+	if schema.Type == "array" && schema.Items != nil {
+		schema = schema.Items
+	}
+	schema.Minimum = &min
+	schema.Maximum = &max
+}
+
+func commandBodySchema(description *cmds.CommandDescription, ranger ParameterRanger, inJSON bool) *OpenAPISchema {
+	ret := &OpenAPISchema{
+		Type:       "object",
+		Properties: map[string]*OpenAPISchema{},
+	}
+	if inJSON {
+		// unknown parameters are rejected. This is a pointer, because YAML omits a plain false.
+		additionalProperties := false
+		ret.AdditionalProperties = &additionalProperties
+	}
+
+	names, ps := commandParameterDefinitions(description)
+	for i, p := range ps {
+		schema := parameterSchema(p, inJSON)
+		if p.Help != "" {
+			if schema.Description != "" {
+				schema.Description = p.Help + ". " + schema.Description
+			} else {
+				schema.Description = p.Help
+			}
+		}
+		applyParameterRange(schema, ranger, names[i])
+		if !inJSON && widgetForParameterType(p.Type) == "file" {
+			schema = &OpenAPISchema{Type: "string", Format: "binary", Description: p.Help}
+		}
+		ret.Properties[names[i]] = schema
+		if p.Required {
+			ret.Required = append(ret.Required, names[i])
+		}
+	}
+
+	return ret
+}
+
+func commandQueryParameters(description *cmds.CommandDescription, ranger ParameterRanger) []*OpenAPIParameter {
+	ret := []*OpenAPIParameter{}
+	names, ps := commandParameterDefinitions(description)
+	for i, p := range ps {
+		param := &OpenAPIParameter{
+			Name:        names[i],
+			In:          "query",
+			Description: p.Help,
+			Required:    p.Required,
+			Schema:      parameterSchema(p, false),
+		}
+		applyParameterRange(param.Schema, ranger, names[i])
+		if param.Schema.Type == "array" {
+			explode := true
+			param.Style = "form"
+			param.Explode = &explode
+			param.Description = strings.TrimSpace(param.Description +
+				" Repeat the parameter, use " + names[i] + "[] or separate the values with commas.")
+		}
+		ret = append(ret, param)
+	}
+	return ret
+}
+
+// outputResponses describes the output of a command in all the supported output formats.
+func outputResponses() map[string]*OpenAPIResponse {
+	content := map[string]*OpenAPIMediaType{}
+	description := "The rows output by the command, in the requested format"
+	for _, f := range OutputFormats {
+		if f.Description != "" {
+			description += "\n\n" + f.Description
+		}
+		for _, ct := range f.ContentTypes {
+			if f.Name == "json" {
+				content[ct] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "array", Items: schemaRef("Row")}}
+			} else {
+				content[ct] = &OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+			}
+		}
+	}
+
+	return map[string]*OpenAPIResponse{
+		"200": {
+			Description: description,
+			Content:     content,
+		},
+		"400": responseRef("BadRequest"),
+		"401": responseRef("Unauthorized"),
+		"403": responseRef("Forbidden"),
+		"404": responseRef("NotFound"),
+		"406": responseRef("NotAcceptable"),
+		"429": responseRef("TooManyRequests"),
+		"500": responseRef("InternalError"),
+	}
+}
+
+// bodyResponses adds the responses to requests with a body to responses.
+func bodyResponses(responses map[string]*OpenAPIResponse) map[string]*OpenAPIResponse {
+	responses["413"] = responseRef("RequestEntityTooLarge")
+	responses["415"] = responseRef("UnsupportedMediaType")
+	return responses
+}
+
+func outputFormatParameter() *OpenAPIParameter {
+	names := []interface{}{}
+	for _, f := range OutputFormats {
+		names = append(names, f.Name)
+	}
+	return &OpenAPIParameter{
+		Name:        "_output",
+		In:          "query",
+		Description: "The output format, takes precedence over the Accept header",
+		Schema:      &OpenAPISchema{Type: "string", Enum: names},
+	}
+}
+
+func errorResponse(description string) *OpenAPIResponse {
+	return &OpenAPIResponse{
+		Description: description,
+		Content: map[string]*OpenAPIMediaType{
+			"application/json": {Schema: schemaRef("Error")},
+		},
+	}
+}
+
+func tooManyRequestsResponse() *OpenAPIResponse {
+	ret := errorResponse("The command was run too often, or too many runs are in progress")
+	ret.Headers = map[string]*OpenAPIHeader{
+		"Retry-After": {
+			Description: "The number of seconds after which the request can be retried",
+			Schema:      &OpenAPISchema{Type: "integer"},
+		},
+	}
+	return ret
+}
+
+func jsonResponse(description string, schema *OpenAPISchema) *OpenAPIResponse {
+	return &OpenAPIResponse{
+		Description: description,
+		Content: map[string]*OpenAPIMediaType{
+			"application/json": {Schema: schema},
+		},
+	}
+}
+
+func commandRequestBody(description *cmds.CommandDescription, ranger ParameterRanger) *OpenAPIRequestBody {
+	return &OpenAPIRequestBody{
+		Required: true,
+		Content: map[string]*OpenAPIMediaType{
+			"application/json":                  {Schema: commandBodySchema(description, ranger, true)},
+			"application/x-www-form-urlencoded": {Schema: commandBodySchema(description, ranger, false)},
+			"multipart/form-data":               {Schema: commandBodySchema(description, ranger, false)},
+		},
+	}
+}
+
+func operationID(method string, path string) string {
+	ret := method
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '_' || r == '.'
+	}) {
+		r, size := utf8.DecodeRuneInString(part)
+		ret += string(unicode.ToUpper(r)) + part[size:]
+	}
+	return ret
+}
+
+func commandTag(description *cmds.CommandDescription) string {
+	if len(description.Parents) == 0 {
+		return "commands"
+	}
+	return strings.Join(description.Parents, "/")
+}
+
+// NewOpenAPISpec describes the API of all the commands of the server as an OpenAPI 3 specification.
+func (s *Server) NewOpenAPISpec() *OpenAPISpec {
+	return newOpenAPISpec(s.ListCommands())
+}
+
+func newOpenAPISpec(commands []ParkaCommand) *OpenAPISpec {
+	spec := &OpenAPISpec{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:       "parka",
+			Description: "The commands served by parka",
+			Version:     "1.0.0",
+		},
+		Paths: map[string]*OpenAPIPathItem{},
+		Components: OpenAPIComponents{
+			Schemas: map[string]*OpenAPISchema{
+				"Error": {
+					Type: "object",
+					Properties: map[string]*OpenAPISchema{
+						"error": {Type: "string", Description: "A human readable message"},
+						"code":  {Type: "string", Description: "The kind of error, for example invalid_parameters or not_found"},
+						"parameters": {
+							Type:  "array",
+							Items: schemaRef("ParameterError"),
+						},
+						"retry_after": {Type: "integer", Description: "The number of seconds after which the request can be retried"},
+					},
+					Required: []string{"error", "code"},
+				},
+				"ParameterError": {
+					Type:        "object",
+					Description: "An invalid parameter of the request",
+					Properties: map[string]*OpenAPISchema{
+						"parameter": {Type: "string"},
+						"message":   {Type: "string"},
+						"type":      {Type: "string", Description: "The expected type of the parameter"},
+						"choices":   {Type: "array", Items: &OpenAPISchema{Type: "string"}},
+					},
+					Required: []string{"parameter", "message"},
+				},
+				"Row": {
+					Type:                 "object",
+					Description:          "A row output by a command",
+					AdditionalProperties: true,
+				},
+				"Job": {
+					Type: "object",
+					Properties: map[string]*OpenAPISchema{
+						"id":          {Type: "string"},
+						"command":     {Type: "string"},
+						"principal":   {Type: "string"},
+						"status":      {Type: "string", Enum: []interface{}{"pending", "running", "done", "error", "cancelled"}},
+						"error":       {Type: "string"},
+						"rows":        {Type: "integer"},
+						"created_at":  {Type: "string", Format: "date-time"},
+						"started_at":  {Type: "string", Format: "date-time"},
+						"finished_at": {Type: "string", Format: "date-time"},
+					},
+					Required: []string{"id", "command", "status", "rows", "created_at"},
+				},
+			},
+			Responses: map[string]*OpenAPIResponse{
+				"BadRequest":            errorResponse("The parameters are invalid"),
+				"Unauthorized":          errorResponse("The request is not authenticated"),
+				"Forbidden":             errorResponse("The caller is not allowed to run the command, or not with these parameters"),
+				"NotFound":              errorResponse("Not found"),
+				"NotAcceptable":         errorResponse("None of the accepted output formats is supported"),
+				"RequestEntityTooLarge": errorResponse("The request body or an uploaded file is too large"),
+				"UnsupportedMediaType":  errorResponse("The request body is neither form data nor JSON"),
+				"InternalError":         errorResponse("The command failed"),
+				"TooManyRequests":       tooManyRequestsResponse(),
+			},
+		},
+	}
+
+	tags := map[string]bool{}
+	for _, cmd := range commands {
+		description := cmd.Description()
+		ranger, _ := cmd.(ParameterRanger)
+		path := commandPath(description)
+		tag := commandTag(description)
+		tags[tag] = true
+
+		get := &OpenAPIOperation{
+			OperationID: operationID("get", path),
+			Summary:     description.Short,
+			Description: description.Long,
+			Tags:        []string{tag},
+			Parameters:  append(commandQueryParameters(description, ranger), outputFormatParameter()),
+			Responses:   outputResponses(),
+		}
+
+		post := &OpenAPIOperation{
+			OperationID: operationID("post", path),
+			Summary:     description.Short,
+			Description: description.Long,
+			Tags:        []string{tag},
+			Parameters:  []*OpenAPIParameter{outputFormatParameter()},
+			RequestBody: commandRequestBody(description, ranger),
+			Responses:   bodyResponses(outputResponses()),
+		}
+
+		spec.Paths["/api/command/"+path] = &OpenAPIPathItem{Get: get, Post: post}
+
+		spec.Paths["/api/jobs/"+path] = &OpenAPIPathItem{
+			Post: &OpenAPIOperation{
+				OperationID: operationID("submit", path),
+				Summary:     fmt.Sprintf("Run %s asynchronously", description.Name),
+				Tags:        []string{tag},
+				RequestBody: commandRequestBody(description, ranger),
+				Responses: bodyResponses(map[string]*OpenAPIResponse{
+					"202": jsonResponse("The job was created", schemaRef("Job")),
+					"400": responseRef("BadRequest"),
+					"401": responseRef("Unauthorized"),
+					"403": responseRef("Forbidden"),
+					"404": responseRef("NotFound"),
+					"429": responseRef("TooManyRequests"),
+					"500": responseRef("InternalError"),
+				}),
+			},
+		}
+	}
+
+	addJobPaths(spec)
+
+	tagNames := []string{}
+	for tag := range tags {
+		tagNames = append(tagNames, tag)
+	}
+	sort.Strings(tagNames)
+	for _, tag := range tagNames {
+		spec.Tags = append(spec.Tags, &OpenAPITag{Name: tag})
+	}
+	spec.Tags = append(spec.Tags, &OpenAPITag{Name: "jobs", Description: "Asynchronous command runs"})
+
+	return spec
+}
+
+func addJobPaths(spec *OpenAPISpec) {
+	idParameter := &OpenAPIParameter{
+		Name:     "id",
+		In:       "path",
+		Required: true,
+		Schema:   &OpenAPISchema{Type: "string"},
+	}
+
+	spec.Paths["/api/jobs"] = &OpenAPIPathItem{
+		Get: &OpenAPIOperation{
+			OperationID: "listJobs",
+			Summary:     "List the jobs of the caller",
+			Tags:        []string{"jobs"},
+			Responses: map[string]*OpenAPIResponse{
+				"200": jsonResponse("The jobs", &OpenAPISchema{Type: "array", Items: schemaRef("Job")}),
+				"401": responseRef("Unauthorized"),
+			},
+		},
+	}
+	// jobs of others are visible to admins only
+	jobForbidden := errorResponse("The job was submitted by another principal")
+	spec.Paths["/api/jobs/{id}"] = &OpenAPIPathItem{
+		Get: &OpenAPIOperation{
+			OperationID: "getJob",
+			Summary:     "Get the status of a job",
+			Tags:        []string{"jobs"},
+			Parameters:  []*OpenAPIParameter{idParameter},
+			Responses: map[string]*OpenAPIResponse{
+				"200": jsonResponse("The job", schemaRef("Job")),
+				"401": responseRef("Unauthorized"),
+				"403": jobForbidden,
+				"404": responseRef("NotFound"),
+			},
+		},
+		Delete: &OpenAPIOperation{
+			OperationID: "cancelJob",
+			Summary:     "Cancel a job",
+			Tags:        []string{"jobs"},
+			Parameters:  []*OpenAPIParameter{idParameter},
+			Responses: map[string]*OpenAPIResponse{
+				"200": jsonResponse("The cancelled job", schemaRef("Job")),
+				"401": responseRef("Unauthorized"),
+				"403": jobForbidden,
+				"404": responseRef("NotFound"),
+			},
+		},
+	}
+
+	resultResponses := outputResponses()
+	delete(resultResponses, "400")
+	delete(resultResponses, "429")
+	resultResponses["403"] = jobForbidden
+	resultResponses["409"] = errorResponse("The job has not finished successfully")
+	spec.Paths["/api/jobs/{id}/result"] = &OpenAPIPathItem{
+		Get: &OpenAPIOperation{
+			OperationID: "getJobResult",
+			Summary:     "Get the rows output by a job",
+			Tags:        []string{"jobs"},
+			Parameters:  []*OpenAPIParameter{idParameter, outputFormatParameter()},
+			Responses:   resultResponses,
+		},
+	}
+}
+
+// serveOpenAPI serves the OpenAPI specification of the server at /api/openapi.json
+// and /api/openapi.yaml.
+func (s *Server) serveOpenAPI() {
+	s.Router.GET("/api/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, newOpenAPISpec(s.listCommands(c)))
+	})
+
+	s.Router.GET("/api/openapi.yaml", func(c *gin.Context) {
+		b, err := yaml.Marshal(newOpenAPISpec(s.listCommands(c)))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/x-yaml; charset=utf-8", b)
+	})
+}
@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIResponses(t *testing.T) {
+	spec := newOpenAPISpec([]ParkaCommand{newEchoCommand("reports/echo")})
+
+	tests := []struct {
+		name      string
+		operation *OpenAPIOperation
+		codes     []string
+	}{
+		{"get", spec.Paths["/api/command/reports/echo"].Get, []string{"200", "400", "401", "403", "404", "406", "429", "500"}},
+		{"post", spec.Paths["/api/command/reports/echo"].Post, []string{"200", "400", "401", "403", "404", "406", "413", "415", "429", "500"}},
+		{"submit", spec.Paths["/api/jobs/reports/echo"].Post, []string{"202", "400", "401", "403", "404", "413", "415", "429", "500"}},
+		{"list jobs", spec.Paths["/api/jobs"].Get, []string{"200", "401"}},
+		{"get job", spec.Paths["/api/jobs/{id}"].Get, []string{"200", "401", "403", "404"}},
+		{"cancel job", spec.Paths["/api/jobs/{id}"].Delete, []string{"200", "401", "403", "404"}},
+		{"job result", spec.Paths["/api/jobs/{id}/result"].Get, []string{"200", "401", "403", "404", "406", "409", "500"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := []string{}
+			for code, response := range tt.operation.Responses {
+				codes = append(codes, code)
+				name := strings.TrimPrefix(response.Ref, "#/components/responses/")
+				if response.Ref != "" && spec.Components.Responses[name] == nil {
+					t.Errorf("unknown response %s", response.Ref)
+				}
+			}
+			sort.Strings(codes)
+			if !reflect.DeepEqual(codes, tt.codes) {
+				t.Errorf("expected the responses %v, got %v", tt.codes, codes)
+			}
+		})
+	}
+
+	tooManyRequests := spec.Components.Responses["TooManyRequests"]
+	if h, ok := tooManyRequests.Headers["Retry-After"]; !ok || h.Schema.Type != "integer" {
+		t.Errorf("expected a Retry-After header, got %v", tooManyRequests.Headers)
+	}
+}
+
+func TestOperationID(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{"get", "reports/echo", "getReportsEcho"},
+		{"post", "list-users_v2.json", "postListUsersV2Json"},
+		{"get", "rapports/été", "getRapportsÉté"},
+		{"get", "ünits//x", "getÜnitsX"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if id := operationID(tt.method, tt.path); id != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, id)
+			}
+		})
+	}
+}
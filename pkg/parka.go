@@ -3,10 +3,12 @@ package pkg
 import (
 	"embed"
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"html/template"
 	"io/fs"
 	"net/http"
 	"strings"
+	"time"
 )
 
 //go:embed "web/src/templates/*"
@@ -29,17 +31,54 @@ func NewStaticPath(fs http.FileSystem, urlPath string) StaticPath {
 
 type Server struct {
 	Router   *gin.Engine
-	Commands []ParkaCommand
+	commands *commandRegistry
 
 	StaticPaths     []StaticPath
 	TemplateLookups []TemplateLookup
+
+	Jobs *JobManager
+
+	Authenticators []Authenticator
+	Policies       *Policies
+
+	UploadLimits UploadLimits
+	// Files loads the files referenced by file loading parameters
+	Files *FileLoader
+
+	Cache      Cache
+	cacheRules []cacheRule
+
+	limiter *limiter
+	// trustedProxies are the proxies whose X-Forwarded-For header identifies clients, see WithTrustedProxies
+	trustedProxies []string
 }
 
 type ServerOption = func(*Server)
 
 func WithCommands(commands ...ParkaCommand) ServerOption {
 	return func(s *Server) {
-		s.Commands = append(s.Commands, commands...)
+		s.commands.add(commands...)
+	}
+}
+
+// WithJobStore sets the store used to keep track of asynchronous jobs,
+// which defaults to a MemoryJobStore.
+func WithJobStore(store JobStore) ServerOption {
+	return func(s *Server) {
+		s.Jobs.Store = store
+	}
+}
+
+func WithMaxConcurrentJobs(n int) ServerOption {
+	return func(s *Server) {
+		s.Jobs.MaxConcurrentJobs = n
+	}
+}
+
+// WithJobRetention sets how long finished jobs and their results are kept.
+func WithJobRetention(retention time.Duration) ServerOption {
+	return func(s *Server) {
+		s.Jobs.Retention = retention
 	}
 }
 
@@ -66,8 +105,19 @@ func WithStaticPaths(paths ...StaticPath) ServerOption {
 	}
 }
 
+// WithTrustedProxies sets the IP addresses or CIDRs of the reverse proxies in front of the server.
+// The client IP address, used for example to rate limit anonymous clients, is taken from the
+// X-Forwarded-For header only for requests coming from these proxies. No proxy is trusted by default.
+func WithTrustedProxies(proxies ...string) ServerOption {
+	return func(s *Server) {
+		s.trustedProxies = append(s.trustedProxies, proxies...)
+	}
+}
+
 func NewServer(options ...ServerOption) (*Server, error) {
 	router := gin.Default()
+	// let commands see the request context being cancelled when the client goes away
+	router.ContextWithFallback = true
 
 	parkaLookup, err := LookupTemplateFromFS(templateFS, "web/src/templates", "**/*.tmpl.*")
 	if err != nil {
@@ -75,18 +125,30 @@ func NewServer(options ...ServerOption) (*Server, error) {
 	}
 
 	s := &Server{
-		Router: router,
+		Router:   router,
+		commands: &commandRegistry{},
 		StaticPaths: []StaticPath{
 			NewStaticPath(NewEmbedFileSystem(distFS, "web/dist"), "/dist"),
 		},
 		TemplateLookups: []TemplateLookup{
 			parkaLookup,
 		},
+		Jobs:         NewJobManager(NewMemoryJobStore()),
+		UploadLimits: DefaultUploadLimits,
+		Files:        NewFileLoader(),
 	}
+	router.MaxMultipartMemory = DefaultUploadLimits.MaxMemory
 
 	for _, option := range options {
 		option(s)
 	}
+	err = router.SetTrustedProxies(s.trustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxies")
+	}
+	if len(s.cacheRules) > 0 && s.Cache == nil {
+		s.Cache = NewMemoryCache(DefaultCacheSize)
+	}
 
 	return s, nil
 }
@@ -163,7 +225,7 @@ func (s *Server) serveMarkdownTemplatePage(c *gin.Context, page string, data int
 		err = baseTemplate.Execute(
 			c.Writer,
 			map[string]interface{}{
-				"markdown": template.HTML(markdown),
+				"content": template.HTML(markdown),
 			})
 		if err != nil {
 			c.String(http.StatusInternalServerError, "Error rendering template")
@@ -189,10 +251,24 @@ func (s *Server) serveMarkdownTemplatePage(c *gin.Context, page string, data int
 }
 
 func (s *Server) Run() error {
+	err := s.setupRoutes()
+	if err != nil {
+		return err
+	}
+	return s.Router.Run()
+}
+
+// setupRoutes registers the static files, pages and APIs of the server on its router.
+func (s *Server) setupRoutes() error {
 	for _, path := range s.StaticPaths {
 		s.Router.StaticFS(path.urlPath, path.fs)
 	}
 
+	// the static files are registered before, and are public
+	if len(s.Authenticators) > 0 {
+		s.Router.Use(s.authenticate)
+	}
+
 	s.Router.GET("/", func(c *gin.Context) {
 		s.serveMarkdownTemplatePage(c, "index", nil)
 	})
@@ -202,6 +278,10 @@ func (s *Server) Run() error {
 	})
 
 	s.serveCommands()
-
-	return s.Router.Run()
+	s.serveCommandForms()
+	s.serveCommandWebSocket()
+	s.serveOpenAPI()
+	s.serveAPIDocs()
+	s.serveCache()
+	return s.serveJobs()
 }
@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCommand outputs the rows returned by rows, which is called with the parsed parameters.
+type testCommand struct {
+	description *cmds.CommandDescription
+	rows        func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error)
+	// err is returned once the rows have been output
+	err error
+	// runs counts the calls to RunFromParka
+	runs int
+}
+
+func newTestCommand(
+	path string,
+	flags []*parameters.ParameterDefinition,
+	rows func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error),
+) *testCommand {
+	segments := strings.Split(path, "/")
+	return &testCommand{
+		description: &cmds.CommandDescription{
+			Name:    segments[len(segments)-1],
+			Short:   "Test command",
+			Flags:   flags,
+			Parents: segments[:len(segments)-1],
+		},
+		rows: rows,
+	}
+}
+
+// newEchoCommand returns a command outputting a single row with its parameters.
+func newEchoCommand(path string, flags ...*parameters.ParameterDefinition) *testCommand {
+	return newTestCommand(path, flags, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{copyRow(ps)}, nil
+	})
+}
+
+func (t *testCommand) Description() *cmds.CommandDescription {
+	return t.description
+}
+
+func (t *testCommand) Run(
+	ctx context.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	return t.RunFromParka(ctx.(*gin.Context), parsedLayers, ps, gp)
+}
+
+func (t *testCommand) RunFromParka(
+	c *gin.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	t.runs++
+	rows, err := t.rows(c, ps)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = gp.ProcessInputObject(row)
+		if err != nil {
+			return err
+		}
+	}
+	return t.err
+}
+
+// newTestServer returns a server with all its routes set up, as done by Run.
+func newTestServer(t *testing.T, options ...ServerOption) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s, err := NewServer(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.setupRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends req to s and returns the response.
+func serve(s *Server, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	return w
+}
+
+func get(s *Server, target string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return serve(s, req)
+}
+
+func post(s *Server, target string, contentType string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return serve(s, req)
+}
+
+// requestTest is a request sent by runRequestTests, along with the status it is expected to get.
+type requestTest struct {
+	name   string
+	method string
+	target string
+	// headers are given as name, value pairs
+	headers []string
+	// body is sent as application/json, unless contentType is set
+	body        string
+	contentType string
+	remoteAddr  string
+	status      int
+	// check, if set, is called with the response once its status has been checked
+	check func(t *testing.T, w *httptest.ResponseRecorder)
+}
+
+func (rt *requestTest) request() *http.Request {
+	method := rt.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if rt.body != "" {
+		body = strings.NewReader(rt.body)
+	}
+	req := httptest.NewRequest(method, rt.target, body)
+	if rt.body != "" || rt.contentType != "" {
+		contentType := rt.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if rt.remoteAddr != "" {
+		req.RemoteAddr = rt.remoteAddr
+	}
+	for i := 0; i+1 < len(rt.headers); i += 2 {
+		req.Header.Set(rt.headers[i], rt.headers[i+1])
+	}
+	return req
+}
+
+// runRequestTests sends the requests to s in order, each in its own subtest.
+func runRequestTests(t *testing.T, s *Server, tests []requestTest) {
+	t.Helper()
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, tt.request())
+			expectStatus(t, w, tt.status)
+			if tt.check != nil {
+				tt.check(t, w)
+			}
+		})
+	}
+}
+
+// expectErrorCode returns a check of the code of an error response.
+func expectErrorCode(code string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if e := decodeError(t, w); e.Code != code {
+			t.Errorf("expected code %s, got %s", code, e.Code)
+		}
+	}
+}
+
+// expectBody returns a check that the body of the response contains all the given strings.
+func expectBody(contains ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		for _, s := range contains {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("expected the body to contain %q, got %q", s, w.Body.String())
+			}
+		}
+	}
+}
+
+// expectHeader returns a check of the value of a header of the response.
+func expectHeader(name string, value string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Header().Get(name) != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, w.Header().Get(name))
+		}
+	}
+}
+
+// expectRow returns a check that the first row of a JSON response has the given values.
+func expectRow(values map[string]interface{}) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		rows := decodeRows(t, w)
+		if len(rows) == 0 {
+			t.Fatalf("expected a row, got none")
+		}
+		for k, v := range values {
+			if !reflect.DeepEqual(rows[0][k], v) {
+				t.Errorf("expected %s to be %v, got %v", k, v, rows[0][k])
+			}
+		}
+	}
+}
+
+// expectStatus fails the test if the response doesn't have the given status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+}
+
+// decodeRows decodes the rows of a JSON response.
+func decodeRows(t *testing.T, w *httptest.ResponseRecorder) []map[string]interface{} {
+	t.Helper()
+	rows := []map[string]interface{}{}
+	err := json.Unmarshal(w.Body.Bytes(), &rows)
+	if err != nil {
+		t.Fatalf("could not decode rows from %q: %v", w.Body.String(), err)
+	}
+	return rows
+}
+
+// decodeError decodes the body of an error response.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) *HTTPError {
+	t.Helper()
+	e := &HTTPError{}
+	err := json.Unmarshal(w.Body.Bytes(), e)
+	if err != nil {
+		t.Fatalf("could not decode error from %q: %v", w.Body.String(), err)
+	}
+	return e
+}
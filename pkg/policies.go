@@ -0,0 +1,379 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies decide which principals may run which commands, and with which parameters.
+// They are loaded from YAML:
+//
+//	# roles given to principals by ID, in addition to the roles of their token
+//	roles:
+//	  jwt:alice: [admin]
+//	# roles allowed to administer the server, for example to purge the cache
+//	admin_roles: [admin]
+//	policies:
+//	  - commands: ["reports/*"]
+//	    roles: [analyst, admin]
+//	    parameters:
+//	      limit:
+//	        max: 1000
+//	        except: [admin]
+//	  - commands: ["**"]
+//	    roles: ["*"]
+//
+// Principals are identified by their ID, the authenticator that authenticated them followed
+// by their name, like api-key:alice or basic:bob, see Principal.ID. Parameters are constrained
+// by the name they are passed under, which includes the prefix of their layer.
+//
+// Command paths are the parents and the name of a command, matched with path.Match globs for
+// each segment, and ** matching any number of segments. The first policy matching a command
+// applies, and commands matched by no policy can't be run by anybody.
+type Policies struct {
+	Roles      map[string][]string `yaml:"roles,omitempty"`
+	AdminRoles []string            `yaml:"admin_roles,omitempty"`
+	Policies   []*Policy           `yaml:"policies"`
+}
+
+type Policy struct {
+	Commands []string `yaml:"commands"`
+	// Roles and Principals are the roles and principal IDs allowed to run the commands.
+	// The role "*" allows everybody, including unauthenticated requests.
+	Roles      []string                        `yaml:"roles,omitempty"`
+	Principals []string                        `yaml:"principals,omitempty"`
+	Parameters map[string]*ParameterConstraint `yaml:"parameters,omitempty"`
+}
+
+// ParameterConstraint restricts the values of a parameter. Min, Max and Values apply to each
+// element of list parameters.
+type ParameterConstraint struct {
+	// Deny forbids setting the parameter to something else than its default
+	Deny   bool     `yaml:"deny,omitempty"`
+	Min    *float64 `yaml:"min,omitempty"`
+	Max    *float64 `yaml:"max,omitempty"`
+	Values []string `yaml:"values,omitempty"`
+	// Except are the roles the constraint doesn't apply to
+	Except []string `yaml:"except,omitempty"`
+}
+
+// ForbiddenError is returned when a principal is not allowed to run a command.
+type ForbiddenError struct {
+	Message string
+}
+
+func (f *ForbiddenError) Error() string {
+	return f.Message
+}
+
+func LoadPoliciesFromFile(fileName string) (*Policies, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policies := &Policies{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(policies)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load policies from %s", fileName)
+	}
+
+	for id := range policies.Roles {
+		err = checkPrincipalID(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid roles in %s", fileName)
+		}
+	}
+	for _, policy := range policies.Policies {
+		for _, id := range policy.Principals {
+			err = checkPrincipalID(id)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid policy in %s", fileName)
+			}
+		}
+		if len(policy.Commands) == 0 {
+			return nil, errors.Errorf("a policy in %s has no commands", fileName)
+		}
+		for _, pattern := range policy.Commands {
+			for _, segment := range strings.Split(pattern, "/") {
+				if _, err := path.Match(segment, ""); err != nil {
+					return nil, errors.Errorf("invalid command pattern '%s' in %s", pattern, fileName)
+				}
+			}
+		}
+	}
+
+	return policies, nil
+}
+
+// checkPrincipalID rejects the principals given by name only, which could match principals
+// of different authenticators.
+func checkPrincipalID(id string) error {
+	provider, name, ok := strings.Cut(id, ":")
+	if !ok || provider == "" || name == "" {
+		return errors.Errorf("principal '%s' has to be given as provider:name, for example api-key:%s", id, id)
+	}
+	return nil
+}
+
+// WithPolicies enforces policies on all the commands of the server. Commands are hidden from
+// the listings of principals that can't run them.
+func WithPolicies(policies *Policies) ServerOption {
+	return func(s *Server) {
+		s.Policies = policies
+	}
+}
+
+// matchCommandPattern matches the segments of a command path against a pattern, see Policies.
+func matchCommandPattern(pattern []string, path_ []string) bool {
+	if len(pattern) == 0 {
+		return len(path_) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path_); i++ {
+			if matchCommandPattern(pattern[1:], path_[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path_) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], path_[0])
+	return ok && matchCommandPattern(pattern[1:], path_[1:])
+}
+
+func (p *Policies) lookupPolicy(description *cmds.CommandDescription) *Policy {
+	segments := strings.Split(commandPath(description), "/")
+	for _, policy := range p.Policies {
+		for _, pattern := range policy.Commands {
+			if matchCommandPattern(strings.Split(pattern, "/"), segments) {
+				return policy
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Policies) principalRoles(principal *Principal) map[string]bool {
+	roles := map[string]bool{}
+	if principal == nil {
+		return roles
+	}
+	for _, role := range principal.Roles {
+		roles[role] = true
+	}
+	for _, role := range p.Roles[principal.ID()] {
+		roles[role] = true
+	}
+	return roles
+}
+
+func hasAnyRole(roles map[string]bool, wanted []string) bool {
+	for _, role := range wanted {
+		if role == "*" || roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRun returns true if principal, which is nil for unauthenticated requests, may run the command.
+func (p *Policies) CanRun(principal *Principal, description *cmds.CommandDescription) bool {
+	policy := p.lookupPolicy(description)
+	if policy == nil {
+		return false
+	}
+	if hasAnyRole(p.principalRoles(principal), policy.Roles) {
+		return true
+	}
+	if principal != nil {
+		for _, id := range policy.Principals {
+			if id == principal.ID() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsAdmin returns true if principal may administer the server.
+func (p *Policies) IsAdmin(principal *Principal) bool {
+	return hasAnyRole(p.principalRoles(principal), p.AdminRoles)
+}
+
+// HasParameterConstraints returns true if the parameters of the command have to be checked
+// with Authorize.
+func (p *Policies) HasParameterConstraints(description *cmds.CommandDescription) bool {
+	policy := p.lookupPolicy(description)
+	return policy != nil && len(policy.Parameters) > 0
+}
+
+// Authorize returns a *ForbiddenError if principal may not run the command with the
+// parsed parameters ps. If ps is nil, only the access to the command is checked.
+func (p *Policies) Authorize(
+	principal *Principal,
+	description *cmds.CommandDescription,
+	ps map[string]interface{},
+) error {
+	if !p.CanRun(principal, description) {
+		return &ForbiddenError{Message: fmt.Sprintf("not allowed to run '%s'", commandPath(description))}
+	}
+	if ps == nil {
+		return nil
+	}
+
+	policy := p.lookupPolicy(description)
+	roles := p.principalRoles(principal)
+	// layer parameters are constrained under their prefixed name, but are merged into ps
+	// under their name
+	names, definitions := commandParameterDefinitions(description)
+	for i, definition := range definitions {
+		constraint, ok := policy.Parameters[names[i]]
+		if !ok || hasAnyRole(roles, constraint.Except) {
+			continue
+		}
+		v, ok := ps[definition.Name]
+		if !ok || v == nil {
+			continue
+		}
+		err := constraint.check(v, definition.Default)
+		if err != nil {
+			return &ForbiddenError{Message: fmt.Sprintf("parameter '%s': %s", names[i], err.Error())}
+		}
+	}
+
+	return nil
+}
+
+func (c *ParameterConstraint) check(v interface{}, defaultValue interface{}) error {
+	if c.Deny {
+		if defaultValue != nil && reflect.DeepEqual(v, defaultValue) {
+			return nil
+		}
+		return errors.New("not allowed to be set")
+	}
+
+	values := []interface{}{v}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		values = []interface{}{}
+		for i := 0; i < rv.Len(); i++ {
+			values = append(values, rv.Index(i).Interface())
+		}
+	}
+
+	for _, v := range values {
+		if c.Min != nil || c.Max != nil {
+			f, ok := constraintNumber(v)
+			if !ok {
+				return errors.Errorf("%v is not a number", v)
+			}
+			if c.Min != nil && f < *c.Min {
+				return errors.Errorf("%v is below the allowed minimum %v", v, *c.Min)
+			}
+			if c.Max != nil && f > *c.Max {
+				return errors.Errorf("%v is above the allowed maximum %v", v, *c.Max)
+			}
+		}
+		if len(c.Values) > 0 {
+			s := fmt.Sprintf("%v", v)
+			if t, ok := v.(time.Time); ok {
+				s = t.Format(time.RFC3339)
+			}
+			allowed := false
+			for _, value := range c.Values {
+				if value == s {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return errors.Errorf("%s is not one of the allowed values", s)
+			}
+		}
+	}
+
+	return nil
+}
+
+func constraintNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// authorize checks the policies of the server, see Policies.Authorize.
+func (s *Server) authorize(c *gin.Context, cmd ParkaCommand, ps map[string]interface{}) error {
+	if s.Policies == nil {
+		return nil
+	}
+	principal, _ := PrincipalFromContext(c)
+	return s.Policies.Authorize(principal, cmd.Description(), ps)
+}
+
+// authorizeAdmin checks that the caller may administer the server. Without policies,
+// nobody may.
+func (s *Server) authorizeAdmin(c *gin.Context) error {
+	principal, _ := PrincipalFromContext(c)
+	if s.Policies == nil || !s.Policies.IsAdmin(principal) {
+		return &ForbiddenError{Message: "not allowed to administer the server"}
+	}
+	return nil
+}
+
+// checkParameters validates the parsed parameters of cmd, see ParameterValidator, and checks
+// that the caller may run it with them.
+func (s *Server) checkParameters(c *gin.Context, cmd ParkaCommand, ps map[string]interface{}) error {
+	if v, ok := cmd.(ParameterValidator); ok {
+		err := v.ValidateParameters(ps)
+		var httpError *HTTPError
+		if err != nil && !errors.As(err, &httpError) {
+			err = NewHTTPError(http.StatusBadRequest, "%s", err.Error()).WithCode(ErrorCodeInvalidParameters)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.authorize(c, cmd, ps)
+}
+
+// listCommands returns the commands the principal of the request may run.
+func (s *Server) listCommands(c *gin.Context) []ParkaCommand {
+	commands := s.ListCommands()
+	if s.Policies == nil {
+		return commands
+	}
+
+	principal, _ := PrincipalFromContext(c)
+	ret := []ParkaCommand{}
+	for _, cmd := range commands {
+		if s.Policies.CanRun(principal, cmd.Description()) {
+			ret = append(ret, cmd)
+		}
+	}
+	return ret
+}
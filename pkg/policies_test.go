@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestPolicies restricts admin/** to carol, the admin, and to dave when authenticated by
+// API key, and constrains the limit, debug and db-port parameters for everyone else.
+func withTestPolicies() ServerOption {
+	maxLimit := 10.0
+	maxPort := 6000.0
+	return WithPolicies(&Policies{
+		Roles:      map[string][]string{"api-key:carol": {"admin"}},
+		AdminRoles: []string{"admin"},
+		Policies: []*Policy{
+			{Commands: []string{"admin/**"}, Roles: []string{"admin"}, Principals: []string{"api-key:dave"}},
+			{
+				Commands: []string{"**"},
+				Roles:    []string{"*"},
+				Parameters: map[string]*ParameterConstraint{
+					"limit":   {Max: &maxLimit, Except: []string{"admin"}},
+					"debug":   {Deny: true},
+					"db-port": {Max: &maxPort},
+				},
+			},
+		},
+	})
+}
+
+// newReportCommand returns an echo command with the parameters constrained by withTestPolicies.
+func newReportCommand() *testCommand {
+	return newEchoCommand("report",
+		&parameters.ParameterDefinition{Name: "limit", Type: parameters.ParameterTypeInteger, Default: 5},
+		&parameters.ParameterDefinition{Name: "debug", Type: parameters.ParameterTypeString},
+	)
+}
+
+func TestPolicies(t *testing.T) {
+	s := newTestServer(t, withTestAuthenticators(t), withTestPolicies(),
+		WithCommands(newWhoamiCommand("whoami"), newWhoamiCommand("admin/whoami"), newReportCommand(), newQueryCommand(t)))
+
+	bob := []string{"X-API-Key", "bob-key"}
+	carol := []string{"X-API-Key", "carol-key"}
+	commandNames := func(expected ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			descriptions := []struct{ Name string }{}
+			err := json.Unmarshal(w.Body.Bytes(), &descriptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, d := range descriptions {
+				names = append(names, d.Name)
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("expected the commands %v, got %v", expected, names)
+			}
+		}
+	}
+	runRequestTests(t, s, []requestTest{
+		{
+			name:   "admin command",
+			target: "/api/command/admin/whoami", headers: bob,
+			status: http.StatusForbidden,
+			check:  expectErrorCode("forbidden"),
+		},
+		{name: "admin command as admin", target: "/api/command/admin/whoami", headers: carol, status: http.StatusOK},
+		{
+			// dave is only allowed when authenticated by API key
+			name:   "admin command as another principal with the same name",
+			target: "/api/command/admin/whoami", headers: []string{"Authorization", basicAuth("dave", "secret")},
+			status: http.StatusForbidden,
+		},
+		// the parameters without a value or default are not checked
+		{name: "defaults", target: "/api/command/report", headers: bob, status: http.StatusOK},
+		{name: "maximum", target: "/api/command/report?limit=10", headers: bob, status: http.StatusOK},
+		{name: "above maximum", target: "/api/command/report?limit=11", headers: bob, status: http.StatusForbidden},
+		{name: "denied", target: "/api/command/report?debug=1", headers: bob, status: http.StatusForbidden},
+		{
+			name:   "above maximum in json",
+			method: http.MethodPost, target: "/api/command/report", headers: bob,
+			body:   `{"limit": 11}`,
+			status: http.StatusForbidden,
+		},
+		{name: "above maximum as admin", target: "/api/command/report?limit=11", headers: carol, status: http.StatusOK},
+		{name: "layer parameter", target: "/api/command/query?name=x&db-port=6000", headers: bob, status: http.StatusOK},
+		{
+			name:   "layer parameter above maximum",
+			target: "/api/command/query?name=x&db-port=6001", headers: bob,
+			status: http.StatusForbidden,
+			check:  expectBody("parameter 'db-port'"),
+		},
+		// the commands that can't be run are hidden
+		{name: "list", target: "/api/commands", headers: bob, status: http.StatusOK, check: commandNames("whoami", "report", "query")},
+		{
+			name:   "list as admin",
+			target: "/api/commands", headers: carol,
+			status: http.StatusOK,
+			check:  commandNames("whoami", "whoami", "report", "query"),
+		},
+	})
+}
+
+func TestLoadPoliciesFromFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies string
+		err      string
+	}{
+		{
+			name:     "valid",
+			policies: "roles:\n  jwt:alice: [admin]\npolicies:\n  - commands: [\"**\"]\n    principals: [basic:bob]\n",
+		},
+		{
+			name:     "roles by name",
+			policies: "roles:\n  alice: [admin]\npolicies: []\n",
+			err:      "principal 'alice' has to be given as provider:name",
+		},
+		{
+			name:     "principal by name",
+			policies: "policies:\n  - commands: [\"**\"]\n    principals: [bob]\n",
+			err:      "principal 'bob' has to be given as provider:name",
+		},
+		{
+			name:     "invalid pattern",
+			policies: "policies:\n  - commands: [\"[\"]\n",
+			err:      "invalid command pattern",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "policies.yaml")
+			err := os.WriteFile(fileName, []byte(tt.policies), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = LoadPoliciesFromFile(fileName)
+			if tt.err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestJobOwnership(t *testing.T) {
+	s := newTestServer(t, withTestAuthenticators(t), withTestPolicies(), WithCommands(newWhoamiCommand("whoami")))
+
+	w := post(s, "/api/jobs/whoami", "application/json", strings.NewReader("{}"), "X-API-Key", "alice-key")
+	expectStatus(t, w, http.StatusAccepted)
+	job := &Job{}
+	err := json.Unmarshal(w.Body.Bytes(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Principal != "api-key:alice" {
+		t.Errorf("expected the job to belong to alice, got %s", job.Principal)
+	}
+	waitForJob(t, s, job.ID)
+
+	jobCount := func(expected int) func(t *testing.T, w *httptest.ResponseRecorder) {
+		return func(t *testing.T, w *httptest.ResponseRecorder) {
+			jobs := []*Job{}
+			err := json.Unmarshal(w.Body.Bytes(), &jobs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs) != expected {
+				t.Errorf("expected %d jobs, got %v", expected, jobs)
+			}
+		}
+	}
+	alice := []string{"X-API-Key", "alice-key"}
+	bob := []string{"X-API-Key", "bob-key"}
+	carol := []string{"X-API-Key", "carol-key"}
+	runRequestTests(t, s, []requestTest{
+		// the jobs of others are hidden from the list and forbidden, except for admins
+		{name: "list", target: "/api/jobs", headers: bob, status: http.StatusOK, check: jobCount(0)},
+		{name: "list as owner", target: "/api/jobs", headers: alice, status: http.StatusOK, check: jobCount(1)},
+		{name: "list as admin", target: "/api/jobs", headers: carol, status: http.StatusOK, check: jobCount(1)},
+		{name: "get", target: "/api/jobs/" + job.ID, headers: bob, status: http.StatusForbidden},
+		{name: "result", target: "/api/jobs/" + job.ID + "/result", headers: bob, status: http.StatusForbidden},
+		{name: "delete", method: http.MethodDelete, target: "/api/jobs/" + job.ID, headers: bob, status: http.StatusForbidden},
+		{
+			// jobs run as the principal who submitted them
+			name:   "result as owner",
+			target: "/api/jobs/" + job.ID + "/result", headers: alice,
+			status: http.StatusOK,
+			check:  expectRow(map[string]interface{}{"principal": "alice"}),
+		},
+		{name: "get as admin", target: "/api/jobs/" + job.ID, headers: carol, status: http.StatusOK},
+		{name: "delete as admin", method: http.MethodDelete, target: "/api/jobs/" + job.ID, headers: carol, status: http.StatusOK},
+	})
+}
+
+// waitForJob waits for a job to finish.
+func waitForJob(t *testing.T, s *Server, id string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		job, err := s.Jobs.Store.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status.IsFinished() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", id)
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// commandRegistry holds the commands served by a Server. All the routes look up their
+// command in the registry on each request, so that commands can be added and removed
+// while the server is running.
+type commandRegistry struct {
+	mutex    sync.RWMutex
+	commands []ParkaCommand
+}
+
+func (r *commandRegistry) list() []ParkaCommand {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]ParkaCommand{}, r.commands...)
+}
+
+func (r *commandRegistry) lookup(path string) (ParkaCommand, bool) {
+	path = strings.Trim(path, "/")
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, cmd := range r.commands {
+		if commandPath(cmd.Description()) == path {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+// add appends commands without checking for duplicates, the first command registered
+// under a path is the one being served.
+func (r *commandRegistry) add(commands ...ParkaCommand) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands = append(r.commands, commands...)
+}
+
+func (r *commandRegistry) register(cmd ParkaCommand) error {
+	path := commandPath(cmd.Description())
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, cmd_ := range r.commands {
+		if commandPath(cmd_.Description()) == path {
+			return fmt.Errorf("command '%s' is already registered", path)
+		}
+	}
+	r.commands = append(r.commands, cmd)
+	return nil
+}
+
+func (r *commandRegistry) unregister(path string) error {
+	path = strings.Trim(path, "/")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, cmd := range r.commands {
+		if commandPath(cmd.Description()) == path {
+			r.commands = append(r.commands[:i:i], r.commands[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command '%s'", path)
+}
+
+// swap atomically removes the commands in remove and adds the commands in add.
+// Commands are compared by identity, not by path.
+func (r *commandRegistry) swap(remove []ParkaCommand, add []ParkaCommand) {
+	removed := map[ParkaCommand]bool{}
+	for _, cmd := range remove {
+		removed[cmd] = true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	commands := []ParkaCommand{}
+	for _, cmd := range r.commands {
+		if !removed[cmd] {
+			commands = append(commands, cmd)
+		}
+	}
+	r.commands = append(commands, add...)
+}
+
+// RegisterCommand adds a command to the server. It can be called while the server is running,
+// and fails if a command with the same parents and name is already registered.
+func (s *Server) RegisterCommand(cmd ParkaCommand) error {
+	return s.commands.register(cmd)
+}
+
+// UnregisterCommand removes the command served under path, made of the parents of the command
+// and its name, for example "reports/daily". Requests already running the command are not affected.
+func (s *Server) UnregisterCommand(path string) error {
+	return s.commands.unregister(path)
+}
+
+// ListCommands returns the commands currently served.
+func (s *Server) ListCommands() []ParkaCommand {
+	return s.commands.list()
+}
+
+// Commands returns the commands currently served.
+//
+// Deprecated: Commands used to be a field of Server, which could not be changed safely while
+// the server is running. Use ListCommands, and RegisterCommand or UnregisterCommand to change
+// the commands.
+func (s *Server) Commands() []ParkaCommand {
+	return s.ListCommands()
+}
+
+// LookupCommand returns the command served under path, see UnregisterCommand.
+func (s *Server) LookupCommand(path string) (ParkaCommand, bool) {
+	return s.commands.lookup(path)
+}
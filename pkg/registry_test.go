@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	s := newTestServer(t, WithCommands(newEchoCommand("reports/daily")))
+
+	err := s.RegisterCommand(newEchoCommand("reports/weekly"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterCommand(newEchoCommand("reports/daily"))
+	if err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("expected reports/daily to be already registered, got %v", err)
+	}
+	runRequestTests(t, s, []requestTest{
+		{name: "registered", target: "/api/command/reports/weekly", status: http.StatusOK},
+		{name: "registered form", target: "/commands/reports/weekly", status: http.StatusOK},
+		{name: "list", target: "/api/commands", status: http.StatusOK, check: expectBody(`"Name":"daily"`, `"Name":"weekly"`)},
+		{name: "openapi", target: "/api/openapi.json", status: http.StatusOK, check: expectBody(`"/api/command/reports/weekly"`)},
+	})
+
+	err = s.UnregisterCommand("/reports/daily/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UnregisterCommand("reports/daily")
+	if err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("expected reports/daily to be unknown, got %v", err)
+	}
+	runRequestTests(t, s, []requestTest{
+		{name: "unregistered", target: "/api/command/reports/daily", status: http.StatusNotFound},
+		{name: "unregistered form", target: "/commands/reports/daily", status: http.StatusNotFound},
+		{name: "still registered", target: "/api/command/reports/weekly", status: http.StatusOK},
+	})
+
+	if commands := s.Commands(); len(commands) != 1 || commands[0].Description().Name != "weekly" {
+		t.Errorf("expected only reports/weekly to be left, got %v", commands)
+	}
+}
+
+func TestRegistrySwapDuringRequest(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	old := newBlockingCommand("slow", started, release)
+	s := newTestServer(t, WithCommands(old))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- get(s, "/api/command/slow")
+	}()
+	<-started
+
+	replacement := newTestCommand("slow", nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{{"version": 2}}, nil
+	})
+	s.commands.swap([]ParkaCommand{old}, []ParkaCommand{replacement})
+	runRequestTests(t, s, []requestTest{
+		{name: "new request", target: "/api/command/slow", status: http.StatusOK, check: expectRow(map[string]interface{}{"version": float64(2)})},
+	})
+
+	// the request in flight finishes with the command it started with
+	close(release)
+	w := <-done
+	expectStatus(t, w, http.StatusOK)
+	expectRow(map[string]interface{}{"done": true})(t, w)
+	if old.runs != 1 || replacement.runs != 1 {
+		t.Errorf("expected each command to run once, got %d and %d", old.runs, replacement.runs)
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	s := newTestServer(t, WithCommands(newEchoCommand("echo")))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("echo%d", i)
+			for j := 0; j < 10; j++ {
+				if err := s.RegisterCommand(newEchoCommand(path)); err != nil {
+					t.Error(err)
+					return
+				}
+				if w := get(s, "/api/command/"+path); w.Code != http.StatusOK {
+					t.Errorf("expected %s to be served, got %d", path, w.Code)
+				}
+				if w := get(s, "/api/commands"); w.Code != http.StatusOK {
+					t.Errorf("could not list the commands, got %d", w.Code)
+				}
+				if err := s.UnregisterCommand(path); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if commands := s.ListCommands(); len(commands) != 1 {
+		t.Errorf("expected only echo to be left, got %d commands", len(commands))
+	}
+}
@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cli"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/go-go-golems/glazed/pkg/helpers"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ShellCommandDescription is the YAML definition of a ShellCommand:
+//
+//	name: ls
+//	short: List the files in a directory
+//	flags:
+//	  - name: dir
+//	    type: string
+//	    default: .
+//	command: [ "find", "{{ .dir }}", "-maxdepth", "1" ]
+//	output: lines
+//
+// Each element of command is a go template rendered with the parsed parameters, and is
+// passed to the program as a single argument, without going through a shell.
+//
+// Since programs treat the arguments starting with "-" as options, a rendered element that
+// starts with "-" is rejected, unless the template itself starts with "-", like "--name={{ .name }}",
+// or follows a literal "--" element, which ends the options of most programs:
+//
+//	command: [ "grep", "-r", "--", "{{ .pattern }}", "." ]
+type ShellCommandDescription struct {
+	Name      string                            `yaml:"name"`
+	Short     string                            `yaml:"short"`
+	Long      string                            `yaml:"long,omitempty"`
+	Flags     []*parameters.ParameterDefinition `yaml:"flags,omitempty"`
+	Arguments []*parameters.ParameterDefinition `yaml:"arguments,omitempty"`
+
+	Command []string `yaml:"command"`
+	// Dir is the working directory of the command. LoadCommandsFromDirectory resolves
+	// relative directories against the directory of the YAML file.
+	Dir string `yaml:"dir,omitempty"`
+	// Env is added to the environment of the server, values are templates as well
+	Env map[string]string `yaml:"env,omitempty"`
+	// Output is how the standard output of the command is turned into rows:
+	//   - json: a JSON array of objects, or a stream of JSON objects (the default)
+	//   - lines: one row per line, with a single "line" column
+	Output string `yaml:"output,omitempty"`
+}
+
+// ShellCommand is a glazed command running an external program, and emitting the rows
+// it outputs.
+type ShellCommand struct {
+	description *cmds.CommandDescription
+	Command     []string
+	Dir         string
+	Env         map[string]string
+	Output      string
+}
+
+func NewShellCommand(description *cmds.CommandDescription, command []string, options ...ShellCommandOption) (*ShellCommand, error) {
+	if len(command) == 0 {
+		return nil, errors.Errorf("command %s has no program to run", description.Name)
+	}
+	ret := &ShellCommand{
+		description: description,
+		Command:     command,
+		Env:         map[string]string{},
+		Output:      "json",
+	}
+	for _, option := range options {
+		option(ret)
+	}
+	if ret.Output != "json" && ret.Output != "lines" {
+		return nil, errors.Errorf("command %s has an unknown output type '%s'", description.Name, ret.Output)
+	}
+	return ret, nil
+}
+
+type ShellCommandOption func(*ShellCommand)
+
+func WithShellDir(dir string) ShellCommandOption {
+	return func(s *ShellCommand) {
+		s.Dir = dir
+	}
+}
+
+func WithShellEnv(env map[string]string) ShellCommandOption {
+	return func(s *ShellCommand) {
+		for k, v := range env {
+			s.Env[k] = v
+		}
+	}
+}
+
+func WithShellOutput(output string) ShellCommandOption {
+	return func(s *ShellCommand) {
+		if output != "" {
+			s.Output = output
+		}
+	}
+}
+
+func (s *ShellCommand) Description() *cmds.CommandDescription {
+	return s.description
+}
+
+func renderShellTemplate(name string, s string, ps map[string]interface{}) (string, error) {
+	t, err := helpers.CreateTemplate(name).Parse(s)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not parse template %s", s)
+	}
+	return helpers.RenderTemplate(t, ps)
+}
+
+func (s *ShellCommand) Run(
+	ctx context.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	args := []string{}
+	endOfOptions := false
+	for _, arg := range s.Command {
+		rendered, err := renderShellTemplate(s.description.Name, arg, ps)
+		if err != nil {
+			return err
+		}
+		// don't let parameter values be taken for options, see ShellCommandDescription
+		if !endOfOptions && strings.HasPrefix(rendered, "-") && !strings.HasPrefix(arg, "-") {
+			return NewHTTPError(http.StatusBadRequest,
+				"argument '%s' of %s can't start with '-'", rendered, s.description.Name)
+		}
+		if arg == "--" {
+			endOfOptions = true
+		}
+		args = append(args, rendered)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = s.Dir
+	cmd.Env = os.Environ()
+	for k, v := range s.Env {
+		rendered, err := renderShellTemplate(s.description.Name, v, ps)
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, k+"="+rendered)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return errors.Wrapf(err, "could not start %s", args[0])
+	}
+
+	if s.Output == "lines" {
+		err = processLines(stdout, gp)
+	} else {
+		err = processJSON(stdout, gp)
+	}
+	if err != nil {
+		// make sure the program doesn't block on a full pipe
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if waitErr != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return fmt.Errorf("%s failed: %v: %s", args[0], waitErr, msg)
+		}
+		return fmt.Errorf("%s failed: %v", args[0], waitErr)
+	}
+
+	return err
+}
+
+func processLines(r io.Reader, gp *cmds.GlazeProcessor) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err := gp.ProcessInputObject(map[string]interface{}{"line": scanner.Text()})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// processJSON accepts either a single JSON array, or a stream of JSON values. Values that
+// are not objects are emitted as a row with a single "value" column.
+func processJSON(r io.Reader, gp *cmds.GlazeProcessor) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	processValue := func(v interface{}) error {
+		if obj, ok := v.(map[string]interface{}); ok {
+			return gp.ProcessInputObject(obj)
+		}
+		return gp.ProcessInputObject(map[string]interface{}{"value": v})
+	}
+
+	for {
+		var v json.RawMessage
+		err := decoder.Decode(&v)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not parse command output")
+		}
+
+		trimmed := bytes.TrimSpace(v)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			var values []interface{}
+			err = json.Unmarshal(trimmed, &values)
+			if err != nil {
+				return errors.Wrap(err, "could not parse command output")
+			}
+			for _, value := range values {
+				err = processValue(value)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var value interface{}
+		err = json.Unmarshal(trimmed, &value)
+		if err != nil {
+			return errors.Wrap(err, "could not parse command output")
+		}
+		err = processValue(value)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ShellCommandLoader loads ShellCommands from their YAML description, see ShellCommandDescription.
+// It implements glazed's YAMLCommandLoader, and is meant to be used with a YAMLFSCommandLoader.
+type ShellCommandLoader struct {
+}
+
+func (l *ShellCommandLoader) LoadCommandFromYAML(s io.Reader) ([]cmds.Command, error) {
+	scd := &ShellCommandDescription{}
+	err := yaml.NewDecoder(s).Decode(scd)
+	if err != nil {
+		return nil, err
+	}
+
+	// a file without command can be an alias, which the YAMLFSCommandLoader only tries to
+	// load when the YAML could not be decoded
+	if scd.Name == "" || len(scd.Command) == 0 {
+		return nil, &yaml.TypeError{Errors: []string{"not a shell command"}}
+	}
+
+	for _, p := range append(append([]*parameters.ParameterDefinition{}, scd.Flags...), scd.Arguments...) {
+		err = p.CheckParameterDefaultValueValidity()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid default for parameter %s of command %s", p.Name, scd.Name)
+		}
+	}
+
+	glazedParameterLayer, err := cli.NewGlazedParameterLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	description := cmds.NewCommandDescription(
+		scd.Name,
+		cmds.WithShort(scd.Short),
+		cmds.WithLong(scd.Long),
+		cmds.WithFlags(scd.Flags...),
+		cmds.WithArguments(scd.Arguments...),
+		cmds.WithLayers(glazedParameterLayer),
+	)
+
+	cmd, err := NewShellCommand(description, scd.Command,
+		WithShellDir(scd.Dir),
+		WithShellEnv(scd.Env),
+		WithShellOutput(scd.Output),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return []cmds.Command{cmd}, nil
+}
+
+func (l *ShellCommandLoader) LoadCommandAliasFromYAML(s io.Reader) ([]*cmds.CommandAlias, error) {
+	return cmds.LoadCommandAliasFromYAML(s)
+}
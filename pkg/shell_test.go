@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newShellTestCommand returns a shell command outputting lines, with a dir flag.
+func newShellTestCommand(t *testing.T, dir string, name string, command ...string) ParkaCommand {
+	t.Helper()
+	cmd, err := NewShellCommand(&cmds.CommandDescription{
+		Name: name,
+		Flags: []*parameters.ParameterDefinition{
+			{Name: "dir", Type: parameters.ParameterTypeString, Default: "."},
+		},
+	}, command, WithShellDir(dir), WithShellOutput("lines"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSimpleParkaCommand(cmd)
+}
+
+// expectLines checks the lines output by a shell command.
+func expectLines(lines ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		got := []string{}
+		for _, row := range decodeRows(t, w) {
+			line, _ := row["line"].(string)
+			got = append(got, line)
+		}
+		if !reflect.DeepEqual(got, lines) {
+			t.Errorf("expected the lines %q, got %q", lines, got)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "file")
+	err := os.WriteFile(fileName, []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithCommands(
+		newShellTestCommand(t, dir, "ls", "find", "{{ .dir }}", "-maxdepth", "1"),
+		newShellTestCommand(t, dir, "print", "printf", `%s\n`, "--", "{{ .dir }}"),
+	))
+
+	runRequestTests(t, s, []requestTest{
+		{name: "files", target: "/api/command/ls", status: http.StatusOK, check: expectLines(".", "./file")},
+		// find would take the value for an option and delete the files
+		{name: "option", target: "/api/command/ls?dir=-delete", status: http.StatusBadRequest},
+		{
+			// printf prints the "--" as well, only the value matters
+			name:   "end of options",
+			target: "/api/command/print?dir=-n", status: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				rows := decodeRows(t, w)
+				if len(rows) == 0 || rows[len(rows)-1]["line"] != "-n" {
+					t.Errorf("expected the value to be passed as an argument, got %v", rows)
+				}
+			},
+		},
+	})
+
+	if _, err := os.Stat(fileName); err != nil {
+		t.Errorf("expected the file to survive, got %v", err)
+	}
+}
+
+func TestLoadShellCommandDir(t *testing.T) {
+	root := t.TempDir()
+	absolute := t.TempDir()
+	for name, content := range map[string]string{
+		"pwd.yaml":        "name: pwd\ncommand: [pwd]\noutput: lines\ndir: data\n",
+		"sub/pwd.yaml":    "name: pwd\ncommand: [pwd]\noutput: lines\ndir: ../data/..\n",
+		"sub/nested.yaml": "name: nested\ncommand: [pwd]\noutput: lines\ndir: data\n",
+		"absolute.yaml":   "name: absolute\ncommand: [pwd]\noutput: lines\ndir: " + absolute + "\n",
+		"data/.keep":      "",
+		"sub/data/.keep":  "",
+	} {
+		fileName := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fileName, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commands, err := LoadCommandsFromDirectory(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithCommands(commands...))
+
+	// pwd prints the directory with the symlinks resolved
+	resolve := func(dir string) string {
+		ret, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	runRequestTests(t, s, []requestTest{
+		{name: "relative", target: "/api/command/pwd", status: http.StatusOK, check: expectLines(resolve(filepath.Join(root, "data")))},
+		{name: "parent", target: "/api/command/sub/pwd", status: http.StatusOK, check: expectLines(resolve(root))},
+		{name: "nested", target: "/api/command/sub/nested", status: http.StatusOK, check: expectLines(resolve(filepath.Join(root, "sub", "data")))},
+		{name: "absolute", target: "/api/command/absolute", status: http.StatusOK, check: expectLines(resolve(absolute))},
+	})
+}
@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/glazed/pkg/middlewares"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+// StreamingOutputFormatter is a glazed OutputFormatter that hands each row to writeRow
+// as soon as it is added by the GlazeProcessor, instead of collecting the whole table.
+//
+// Table middlewares are applied to each row individually, which works for the row-local
+// middlewares added by the glazed layers (fields, filters, renames, replacements), but
+// means that column ordering is not meaningful.
+type StreamingOutputFormatter struct {
+	writeRow    func(row types.MapRow) error
+	middlewares []middlewares.TableMiddleware
+	cancel      context.CancelFunc
+	rowCount    int
+	err         error
+	// writeFailed is set when a row could not be written to the client
+	writeFailed bool
+}
+
+// NewStreamingOutputFormatter creates a formatter calling writeRow for each output row.
+// cancel is called to stop the command once a row fails to be processed or written.
+func NewStreamingOutputFormatter(
+	writeRow func(row types.MapRow) error,
+	cancel context.CancelFunc,
+) *StreamingOutputFormatter {
+	return &StreamingOutputFormatter{
+		writeRow:    writeRow,
+		middlewares: []middlewares.TableMiddleware{},
+		cancel:      cancel,
+	}
+}
+
+func (s *StreamingOutputFormatter) AddRow(row types.Row) {
+	if s.err != nil {
+		return
+	}
+
+	table := types.NewTable()
+	table.Rows = append(table.Rows, row)
+	table.Finalize()
+
+	var err error
+	for _, middleware := range s.middlewares {
+		table, err = middleware.Process(table)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+
+	for _, row := range table.Rows {
+		err = s.writeRow(row.GetValues())
+		if err != nil {
+			// the client most likely went away, stop the command
+			s.writeFailed = true
+			s.fail(err)
+			return
+		}
+		s.rowCount++
+	}
+}
+
+// RowCount returns the number of rows written so far.
+func (s *StreamingOutputFormatter) RowCount() int {
+	return s.rowCount
+}
+
+func (s *StreamingOutputFormatter) fail(err error) {
+	s.err = err
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// httpStreamWriter writes events to a streaming HTTP response, either as NDJSON lines
+// or as Server-Sent Events.
+//
+// NDJSON has no event types, so each line is an object with a single key, the name of the
+// event, like {"row": {...}} or {"error": {...}}. Rows are wrapped as well, so that no row can
+// be taken for another event, whatever its columns.
+type httpStreamWriter struct {
+	c   *gin.Context
+	sse bool
+}
+
+func (h *httpStreamWriter) writeEvent(event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if !h.c.Writer.Written() {
+		h.c.Header("Cache-Control", "no-cache")
+		// disable response buffering in nginx
+		h.c.Header("X-Accel-Buffering", "no")
+		h.c.Status(http.StatusOK)
+	}
+
+	if h.sse {
+		_, err = fmt.Fprintf(h.c.Writer, "event: %s\ndata: %s\n\n", event, b)
+	} else {
+		b, err = json.Marshal(map[string]json.RawMessage{event: b})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(h.c.Writer, "%s\n", b)
+	}
+	if err != nil {
+		return err
+	}
+	h.c.Writer.Flush()
+
+	return nil
+}
+
+func (s *StreamingOutputFormatter) SetColumnOrder([]types.FieldName) {
+}
+
+func (s *StreamingOutputFormatter) AddTableMiddleware(m middlewares.TableMiddleware) {
+	s.middlewares = append(s.middlewares, m)
+}
+
+func (s *StreamingOutputFormatter) AddTableMiddlewareInFront(m middlewares.TableMiddleware) {
+	s.middlewares = append([]middlewares.TableMiddleware{m}, s.middlewares...)
+}
+
+func (s *StreamingOutputFormatter) AddTableMiddlewareAtIndex(i int, m middlewares.TableMiddleware) {
+	s.middlewares = append(s.middlewares[:i], append([]middlewares.TableMiddleware{m}, s.middlewares[i:]...)...)
+}
+
+// Output returns an empty string, since all the rows have already been written.
+func (s *StreamingOutputFormatter) Output() (string, error) {
+	return "", s.err
+}
+
+// runCommandStreaming runs a command and streams its rows to the client as NDJSON or as
+// Server-Sent Events.
+//
+// The command's context is cancelled when the client disconnects or when writing a row fails.
+// Errors happening before the first row was sent are reported with a JSON error body and
+// the status of the error, see HTTPError. After that, the status can't be changed anymore,
+// and the error body is sent as a final {"error": ...} line, or as an "error" event for SSE.
+func (s *Server) runCommandStreaming(
+	c *gin.Context,
+	cmd ParkaCommand,
+	format *OutputFormat,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+) {
+	requestCtx := c.Request.Context()
+	ctx, cancel := context.WithCancel(requestCtx)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	format.SetContentHeaders(c, cmd.Description().Name)
+
+	w := &httpStreamWriter{c: c, sse: format.Name == "sse"}
+	sof := NewStreamingOutputFormatter(func(row types.MapRow) error {
+		return w.writeEvent("row", row)
+	}, cancel)
+	gp, err := NewGlazeProcessor(sof, parsedLayers)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+
+	_, err = s.runFromParka(c, cmd, parsedLayers, ps, gp)
+	if err == nil {
+		_, err = sof.Output()
+	}
+
+	// there is nobody left to report the error to
+	if requestCtx.Err() != nil || sof.writeFailed {
+		log.Debug().Err(err).Str("command", cmd.Description().Name).Msg("client went away while streaming")
+		return
+	}
+
+	if err != nil {
+		if !c.Writer.Written() {
+			writeError(c, err)
+			return
+		}
+		_ = w.writeEvent("error", toHTTPError(err))
+		return
+	}
+
+	if w.sse {
+		_ = w.writeEvent("done", gin.H{"rows": sof.RowCount()})
+	} else if !c.Writer.Written() {
+		// make sure the headers are sent even if the command didn't output any row
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+	}
+}
@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// expectStream checks the streamed body against lines, ignoring the order of the keys of
+// NDJSON lines.
+func expectStream(contentType string, lines ...string) func(t *testing.T, w *httptest.ResponseRecorder) {
+	return func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), contentType) || w.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("unexpected headers %v", w.Header())
+		}
+		if contentType == "text/event-stream" {
+			if expected := strings.Join(lines, ""); w.Body.String() != expected {
+				t.Errorf("expected %q, got %q", expected, w.Body.String())
+			}
+			return
+		}
+
+		got := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		if len(got) != len(lines) {
+			t.Fatalf("expected %d lines, got %q", len(lines), w.Body.String())
+		}
+		for i, line := range got {
+			var v, expected interface{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				t.Fatalf("could not decode line %q: %v", line, err)
+			}
+			if err := json.Unmarshal([]byte(lines[i]), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, expected) {
+				t.Errorf("expected line %d to be %s, got %s", i, lines[i], line)
+			}
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	early := newTestCommand("early", nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return nil, NewHTTPError(http.StatusBadRequest, "early failure")
+	})
+	// rows looking like errors must not be taken for errors
+	late := newEchoCommand("late")
+	late.rows = func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{
+			{"error": map[string]interface{}{"error": "a column", "code": "x"}},
+			{"_error": "a column"},
+		}, nil
+	}
+	late.err = errors.New("late failure")
+	s := newTestServer(t, WithCommands(newEchoCommand("echo"), early, late))
+
+	runRequestTests(t, s, []requestTest{
+		{
+			name: "ndjson", target: "/api/command/echo?_output=ndjson", status: http.StatusOK,
+			check: expectStream("application/x-ndjson", `{"row": {}}`),
+		},
+		{
+			name: "sse", target: "/api/command/echo", headers: []string{"Accept", "text/event-stream"}, status: http.StatusOK,
+			check: expectStream("text/event-stream", "event: row\ndata: {}\n\n", "event: done\ndata: {\"rows\":1}\n\n"),
+		},
+		{
+			// errors happening before the first row keep their status
+			name: "early error", target: "/api/command/early?_output=ndjson", status: http.StatusBadRequest,
+			check: expectBody("early failure"),
+		},
+		{
+			name: "late error", target: "/api/command/late?_output=ndjson", status: http.StatusOK,
+			check: expectStream("application/x-ndjson",
+				`{"row": {"error": {"error": "a column", "code": "x"}}}`,
+				`{"row": {"_error": "a column"}}`,
+				`{"error": {"error": "late failure", "code": "internal_server_error"}}`,
+			),
+		},
+		{
+			name: "late sse error", target: "/api/command/late?_output=sse", status: http.StatusOK,
+			check: expectStream("text/event-stream",
+				"event: row\ndata: {\"error\":{\"code\":\"x\",\"error\":\"a column\"}}\n\n",
+				"event: row\ndata: {\"_error\":\"a column\"}\n\n",
+				"event: error\ndata: {\"code\":\"internal_server_error\",\"error\":\"late failure\"}\n\n",
+			),
+		},
+	})
+}
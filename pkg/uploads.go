@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"mime/multipart"
+	"net/http"
+)
+
+// UploadLimits restrict the size of the form data and files posted to the server.
+type UploadLimits struct {
+	// MaxRequestSize is the maximum size of the body of a POST request, including all its
+	// files, 0 for no limit
+	MaxRequestSize int64
+	// MaxFileSize is the maximum size of a single uploaded file, 0 for no limit
+	MaxFileSize int64
+	// MaxMemory is the amount of the files of a multipart request kept in memory. The files
+	// that don't fit are spilled to temporary files, which are removed once the request is
+	// done. With 0, all the files are written to temporary files.
+	MaxMemory int64
+}
+
+var DefaultUploadLimits = UploadLimits{
+	MaxRequestSize: 64 << 20,
+	MaxFileSize:    32 << 20,
+	MaxMemory:      8 << 20,
+}
+
+// WithUploadLimits sets the size limits of the form data and files posted to the server.
+// Requests exceeding them are rejected with a 413.
+func WithUploadLimits(limits UploadLimits) ServerOption {
+	return func(s *Server) {
+		s.UploadLimits = limits
+		s.Files.MaxSize = limits.MaxFileSize
+		s.Router.MaxMultipartMemory = limits.MaxMemory
+	}
+}
+
+// parseForm parses the form data of a POST request within the upload limits of the server.
+func (s *Server) parseForm(c *gin.Context) error {
+	if s.UploadLimits.MaxRequestSize > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.UploadLimits.MaxRequestSize)
+	}
+
+	var err error
+	if c.ContentType() == "multipart/form-data" {
+		err = c.Request.ParseMultipartForm(s.Router.MaxMultipartMemory)
+	} else {
+		err = c.Request.ParseForm()
+	}
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return NewHTTPError(http.StatusRequestEntityTooLarge,
+				"the request is larger than the limit of %d bytes", maxBytesError.Limit).
+				WithCode("request_too_large")
+		}
+		return NewHTTPError(http.StatusBadRequest, "could not parse form data: %v", err).WithCode("invalid_body")
+	}
+
+	if s.UploadLimits.MaxFileSize <= 0 || c.Request.MultipartForm == nil {
+		return nil
+	}
+	errs := parameterErrors{}
+	for name, fhs := range c.Request.MultipartForm.File {
+		for _, fh := range fhs {
+			if fh.Size > s.UploadLimits.MaxFileSize {
+				errs.add(nil, name, "file '%s' is larger than the limit of %d bytes", fh.Filename, s.UploadLimits.MaxFileSize)
+				break
+			}
+		}
+	}
+	if len(errs) > 0 {
+		ret := toHTTPError(errs.err())
+		ret.Status = http.StatusRequestEntityTooLarge
+		ret.Code = "file_too_large"
+		return ret
+	}
+
+	return nil
+}
+
+// formFiles returns the files uploaded as the parts called name of a multipart request.
+func formFiles(c *gin.Context, name string) []*multipart.FileHeader {
+	if c.Request.MultipartForm == nil {
+		return nil
+	}
+	return c.Request.MultipartForm.File[name]
+}
+
+// parseUploadedFile parses an uploaded file for the file loading parameter p, detecting its
+// format from the Content-Type of its part or the extension of its name.
+func parseUploadedFile(p *parameters.ParameterDefinition, fh *multipart.FileHeader) (interface{}, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open file '%s'", fh.Filename)
+	}
+	defer func(f multipart.File) {
+		err := f.Close()
+		if err != nil {
+			log.Error().Err(err).Msgf("error closing file '%s'", fh.Filename)
+		}
+	}(f)
+
+	ret, err := parseFileContent(p, f, fh.Filename, fh.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse file '%s'", fh.Filename)
+	}
+	return ret, nil
+}
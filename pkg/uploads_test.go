@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// multipartBody builds a multipart form with the given fields, and files given as
+// field name, file name and content.
+func multipartBody(t *testing.T, fields map[string]string, files ...[3]string) (string, *bytes.Buffer) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		err := mw.WriteField(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="`+file[0]+`"; filename="`+file[1]+`"`)
+		h.Set("Content-Type", "application/octet-stream")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(file[2]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType(), body
+}
+
+// newUploadCommand returns an echo command with file parameters and a required argument.
+func newUploadCommand() *testCommand {
+	cmd := newEchoCommand("upload",
+		&parameters.ParameterDefinition{Name: "text", Type: parameters.ParameterTypeStringFromFile},
+		&parameters.ParameterDefinition{Name: "data", Type: parameters.ParameterTypeObjectFromFile},
+	)
+	cmd.description.Arguments = []*parameters.ParameterDefinition{
+		{Name: "target", Type: parameters.ParameterTypeString, Required: true},
+	}
+	return cmd
+}
+
+// multipartTest returns a request test posting a multipart form to target.
+func multipartTest(t *testing.T, name string, target string, status int, fields map[string]string, files ...[3]string) requestTest {
+	contentType, body := multipartBody(t, fields, files...)
+	return requestTest{
+		name:   name,
+		method: http.MethodPost, target: target,
+		body: body.String(), contentType: contentType,
+		status: status,
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	s := newTestServer(t, WithCommands(newUploadCommand()))
+
+	// files are found by their part alone, and arguments are parsed like flags
+	upload := multipartTest(t, "upload", "/api/command/upload", http.StatusOK,
+		map[string]string{"target": "prod"},
+		[3]string{"text", "notes.txt", "hello\n"},
+		[3]string{"data", "data.json", `{"a": 1}`},
+	)
+	upload.check = expectRow(map[string]interface{}{
+		"target": "prod",
+		"text":   "hello\n",
+		"data":   map[string]interface{}{"a": 1.0},
+	})
+	missing := multipartTest(t, "missing argument", "/api/command/upload", http.StatusBadRequest, nil)
+	missing.check = expectInvalidParameters("target")
+
+	runRequestTests(t, s, []requestTest{upload, missing})
+}
+
+func TestUploadLimits(t *testing.T) {
+	s := newTestServer(t, WithCommands(newUploadCommand()), WithUploadLimits(UploadLimits{
+		MaxRequestSize: 2000,
+		MaxFileSize:    1000,
+		MaxMemory:      1 << 20,
+	}))
+	content := strings.Repeat("x", 900)
+	large := strings.Repeat("x", 1100)
+
+	tests := []requestTest{}
+	for _, target := range []string{"/api/command/upload", "/commands/upload"} {
+		tests = append(tests,
+			multipartTest(t, target+" request too large", target, http.StatusRequestEntityTooLarge,
+				map[string]string{"target": "prod"},
+				[3]string{"text", "a.txt", content},
+				[3]string{"data", "b.json", content},
+				[3]string{"text", "c.txt", content},
+			),
+			multipartTest(t, target+" file too large", target, http.StatusRequestEntityTooLarge,
+				map[string]string{"target": "prod"},
+				[3]string{"text", "a.txt", large},
+			),
+			multipartTest(t, target+" within limits", target, http.StatusOK,
+				map[string]string{"target": "prod"},
+				[3]string{"text", "a.txt", content},
+			),
+		)
+	}
+	runRequestTests(t, s, tests)
+}
+
+func TestUploadMemory(t *testing.T) {
+	for _, maxMemory := range []int64{0, 10, 1 << 20} {
+		s := newTestServer(t, WithCommands(newUploadCommand()), WithUploadLimits(UploadLimits{MaxMemory: maxMemory}))
+		if s.Router.MaxMultipartMemory != maxMemory {
+			t.Errorf("expected %d bytes of the uploads to be kept in memory, got %d", maxMemory, s.Router.MaxMultipartMemory)
+		}
+		// the files that don't fit in memory are still uploaded
+		runRequestTests(t, s, []requestTest{
+			multipartTest(t, fmt.Sprintf("%d bytes in memory", maxMemory), "/api/command/upload", http.StatusOK,
+				map[string]string{"target": "prod"},
+				[3]string{"text", "a.txt", strings.Repeat("x", 900)},
+			),
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package pkg
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds"
+	"github.com/go-go-golems/glazed/pkg/cmds/layers"
+	"github.com/go-go-golems/parka/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream is another parka server whose commands are served under /api/command/<name>/.
+type Upstream struct {
+	Name   string
+	URL    *url.URL
+	Client *client.Client
+}
+
+func NewUpstream(name string, rawURL string, options ...client.ClientOption) (*Upstream, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errors.Errorf("invalid upstream name '%s'", name)
+	}
+	u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid URL for upstream %s", name)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid URL for upstream %s: %s", name, rawURL)
+	}
+
+	return &Upstream{
+		Name:   name,
+		URL:    u,
+		Client: client.NewClient(u.String(), options...),
+	}, nil
+}
+
+// ParseUpstream parses an upstream given as name=URL.
+func ParseUpstream(s string, options ...client.ClientOption) (*Upstream, error) {
+	name, rawURL, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, errors.Errorf("invalid upstream '%s', expected name=URL", s)
+	}
+	return NewUpstream(name, rawURL, options...)
+}
+
+// loadCommands lists the commands of the upstream, which doubles as its health check.
+func (u *Upstream) loadCommands(ctx context.Context) ([]ParkaCommand, error) {
+	descriptions, err := u.Client.ListCommands(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []ParkaCommand{}
+	for _, d := range descriptions {
+		cmd, err := newUpstreamCommand(u, d)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cmd)
+	}
+	return ret, nil
+}
+
+// upstreamCommand is a command of an upstream server. API requests are forwarded as is,
+// the forms, websockets and jobs run it through the client.
+type upstreamCommand struct {
+	remote   *client.RemoteCommand
+	upstream *Upstream
+	proxy    *httputil.ReverseProxy
+}
+
+func newUpstreamCommand(upstream *Upstream, description *client.CommandDescription) (*upstreamCommand, error) {
+	remote, err := client.NewRemoteCommand(upstream.Client, description)
+	if err != nil {
+		return nil, err
+	}
+	remote.Description().Parents = append([]string{upstream.Name}, description.Parents...)
+
+	target := *upstream.URL
+	target.Path += "/api/command/" + description.Path()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			// the credentials of the caller are meant for this server, not the upstream
+			c, _ := req.Context().Value(ginContextKey{}).(*gin.Context)
+			for _, h := range CredentialHeaders(c) {
+				req.Header.Del(h)
+			}
+			for k, vs := range upstream.Client.Headers {
+				req.Header[k] = vs
+			}
+		},
+		// flush streamed rows right away
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Warn().Err(err).Str("upstream", upstream.Name).Msg("could not forward request")
+			err = NewHTTPError(http.StatusBadGateway, "upstream %s is not available", upstream.Name)
+			c, ok := req.Context().Value(ginContextKey{}).(*gin.Context)
+			if !ok {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeError(c, err)
+		},
+	}
+
+	return &upstreamCommand{
+		remote:   remote,
+		upstream: upstream,
+		proxy:    proxy,
+	}, nil
+}
+
+func (u *upstreamCommand) Description() *cmds.CommandDescription {
+	return u.remote.Description()
+}
+
+func (u *upstreamCommand) Run(
+	ctx context.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	return u.remote.Run(ctx, parsedLayers, ps, gp)
+}
+
+func (u *upstreamCommand) RunFromParka(
+	c *gin.Context,
+	parsedLayers map[string]*layers.ParsedParameterLayer,
+	ps map[string]interface{},
+	gp *cmds.GlazeProcessor,
+) error {
+	err := u.remote.Run(c, parsedLayers, ps, gp)
+	// keep the status and the invalid parameters of the errors reported by the upstream
+	var clientError *client.Error
+	if errors.As(err, &clientError) && clientError.StatusCode < 500 {
+		ret := NewHTTPError(clientError.StatusCode, "%s", clientError.Message)
+		if clientError.Code != "" {
+			ret.Code = clientError.Code
+		}
+		for _, p := range clientError.Parameters {
+			ret.Parameters = append(ret.Parameters, &ParameterError{
+				Parameter: p.Parameter,
+				Message:   p.Message,
+				Type:      p.Type,
+				Choices:   p.Choices,
+			})
+		}
+		return ret
+	}
+	return err
+}
+
+// ginContextKey gives the director and the error handler of the proxy access to the gin
+// context of the request.
+type ginContextKey struct{}
+
+func (u *upstreamCommand) ForwardRequest(c *gin.Context) {
+	ctx := context.WithValue(c.Request.Context(), ginContextKey{}, c)
+	u.proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+}
+
+// WatchUpstream serves the commands of upstream, checking every interval that it is up and
+// reloading its commands. When the upstream can't be reached, its commands are removed until
+// it is back. WatchUpstream blocks until ctx is cancelled.
+func (s *Server) WatchUpstream(ctx context.Context, upstream *Upstream, interval time.Duration) {
+	var commands []ParkaCommand
+	up := false
+
+	check := func() {
+		ctx_, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+
+		newCommands, err := upstream.loadCommands(ctx_)
+		if err != nil {
+			if up || commands == nil {
+				log.Warn().Err(err).Str("upstream", upstream.Name).Msg("upstream is down, removing its commands")
+			}
+			s.commands.swap(commands, nil)
+			commands = []ParkaCommand{}
+			up = false
+			return
+		}
+
+		if !up {
+			log.Info().Str("upstream", upstream.Name).Int("commands", len(newCommands)).Msg("upstream is up")
+		}
+		s.commands.swap(commands, newCommands)
+		commands = newCommands
+		up = true
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.commands.swap(commands, nil)
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/go-go-golems/parka/pkg/client"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreams(t *testing.T) {
+	// the upstream outputs the credentials it received
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{{
+			"authorization": req.Header.Get("Authorization"),
+			"api_key":       req.Header.Get("X-API-Key"),
+			"cookie":        req.Header.Get("Cookie"),
+		}})
+	}))
+	defer upstreamServer.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	commands := []ParkaCommand{}
+	for _, u := range []struct {
+		name    string
+		url     string
+		options []client.ClientOption
+	}{
+		{"up", upstreamServer.URL, nil},
+		{"token", upstreamServer.URL, []client.ClientOption{client.WithBearerToken("upstream-token")}},
+		{`a"b`, closed.URL, nil},
+	} {
+		upstream, err := NewUpstream(u.name, u.url, u.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, err := newUpstreamCommand(upstream, &client.CommandDescription{Name: "echo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, cmd)
+	}
+	s := newTestServer(t, withTestAuthenticators(t), WithCommands(commands...))
+	// the proxy needs a response writer implementing http.CloseNotifier
+	ts := httptest.NewServer(s.Router)
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		target   string
+		headers  []string
+		status   int
+		expected map[string]interface{}
+	}{
+		{
+			name:     "api key",
+			target:   "/api/command/up/echo",
+			headers:  []string{"X-API-Key", "alice-key", "Cookie", "session=1"},
+			status:   http.StatusOK,
+			expected: map[string]interface{}{"authorization": "", "api_key": "", "cookie": ""},
+		},
+		{
+			name:     "basic",
+			target:   "/api/command/up/echo",
+			headers:  []string{"Authorization", basicAuth("dave", "secret")},
+			status:   http.StatusOK,
+			expected: map[string]interface{}{"authorization": ""},
+		},
+		{
+			// the headers of the upstream are still sent
+			name:     "upstream credentials",
+			target:   "/api/command/token/echo",
+			headers:  []string{"Authorization", basicAuth("dave", "secret")},
+			status:   http.StatusOK,
+			expected: map[string]interface{}{"authorization": "Bearer upstream-token"},
+		},
+		{
+			name:     "not available",
+			target:   "/api/command/a%22b/echo",
+			headers:  []string{"X-API-Key", "alice-key"},
+			status:   http.StatusBadGateway,
+			expected: map[string]interface{}{"error": `upstream a"b is not available`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i+1 < len(tt.headers); i += 2 {
+				req.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+
+			var body interface{}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows, ok := body.([]interface{}); ok && len(rows) == 1 {
+				body = rows[0]
+			}
+			got, _ := body.(map[string]interface{})
+			for k, v := range tt.expected {
+				if got[k] != v {
+					t.Errorf("expected %s to be %v, got %v", k, v, got[k])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reloadDelay is how long to wait for further changes before reloading commands,
+// since editors and deployment tools usually touch multiple files in a row.
+const reloadDelay = 200 * time.Millisecond
+
+// addDirectoriesToWatcher watches dir and all its subdirectories, since fsnotify
+// doesn't watch recursively. Adding an already watched directory is a no-op.
+func addDirectoriesToWatcher(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// WatchCommandsDirectory reloads the commands of dir with LoadCommandsFromDirectory whenever
+// one of its files changes, and swaps them with the commands previously loaded from it.
+// commands are the commands currently served from dir.
+//
+// If the directory can't be loaded, the previous commands are kept. WatchCommandsDirectory
+// blocks until ctx is cancelled.
+func (s *Server) WatchCommandsDirectory(ctx context.Context, dir string, commands []ParkaCommand) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = watcher.Close()
+	}()
+
+	err = addDirectoriesToWatcher(watcher, dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not watch %s", dir)
+	}
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			log.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("command file changed")
+			reload = time.After(reloadDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Warn().Err(err).Str("dir", dir).Msg("error watching commands")
+
+		case <-reload:
+			reload = nil
+
+			newCommands, err := LoadCommandsFromDirectory(dir)
+			if err != nil {
+				log.Error().Err(err).Str("dir", dir).Msg("could not reload commands, keeping the previous ones")
+				continue
+			}
+			s.commands.swap(commands, newCommands)
+			commands = newCommands
+			log.Info().Str("dir", dir).Int("commands", len(commands)).Msg("Reloaded commands")
+
+			// pick up new subdirectories
+			err = addDirectoriesToWatcher(watcher, dir)
+			if err != nil {
+				log.Warn().Err(err).Str("dir", dir).Msg("could not watch new directories")
+			}
+		}
+	}
+}
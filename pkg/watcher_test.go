@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// printfCommandYAML returns the YAML of a shell command printing value.
+func printfCommandYAML(name string, value string) string {
+	return fmt.Sprintf("name: %s\ncommand: [printf, '%%s\\n', %s]\noutput: lines\n", name, value)
+}
+
+func TestWatchCommandsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "one.yaml"), []byte(printfCommandYAML("one", "v1")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands, err := LoadCommandsFromDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithCommands(commands...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchErr := make(chan error)
+	go func() {
+		watchErr <- s.WatchCommandsDirectory(ctx, dir, commands)
+	}()
+	defer func() {
+		cancel()
+		if err := <-watchErr; err != nil {
+			t.Error(err)
+		}
+	}()
+	// give the watcher time to watch the directory
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name string
+		// files maps file names to their new content, nil deletes the file
+		files  map[string]*string
+		target string
+		status int
+		line   string
+		// keep waits for the reload and checks that the command was kept
+		keep bool
+	}{
+		{name: "initial", target: "/api/command/one", status: http.StatusOK, line: "v1"},
+		{name: "add", files: map[string]*string{"two.yaml": ptr(printfCommandYAML("two", "v1"))}, target: "/api/command/two", status: http.StatusOK, line: "v1"},
+		{name: "modify", files: map[string]*string{"one.yaml": ptr(printfCommandYAML("one", "v2"))}, target: "/api/command/one", status: http.StatusOK, line: "v2"},
+		{name: "invalid YAML", files: map[string]*string{"one.yaml": ptr("name: [one\n")}, target: "/api/command/one", status: http.StatusOK, line: "v2", keep: true},
+		{name: "invalid YAML keeps the other commands", target: "/api/command/two", status: http.StatusOK, line: "v1"},
+		{name: "fixed", files: map[string]*string{"one.yaml": ptr(printfCommandYAML("one", "v3"))}, target: "/api/command/one", status: http.StatusOK, line: "v3"},
+		{name: "subdirectory", files: map[string]*string{"sub/three.yaml": ptr(printfCommandYAML("three", "v1"))}, target: "/api/command/sub/three", status: http.StatusOK, line: "v1"},
+		{name: "delete", files: map[string]*string{"two.yaml": nil}, target: "/api/command/two", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, content := range tt.files {
+				fileName := filepath.Join(dir, name)
+				if content == nil {
+					err := os.Remove(fileName)
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				err := os.MkdirAll(filepath.Dir(fileName), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(fileName, []byte(*content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.keep {
+				time.Sleep(5 * reloadDelay)
+			}
+
+			check := func() (bool, string) {
+				w := get(s, tt.target)
+				if w.Code != tt.status {
+					return false, fmt.Sprintf("status %d", w.Code)
+				}
+				if tt.line == "" {
+					return true, ""
+				}
+				rows := decodeRows(t, w)
+				if len(rows) != 1 || rows[0]["line"] != tt.line {
+					return false, fmt.Sprintf("rows %v", rows)
+				}
+				return true, ""
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				ok, got := check()
+				if ok {
+					break
+				}
+				if tt.keep || time.Now().After(deadline) {
+					t.Fatalf("expected %s to return %d with the line %q, got %s", tt.target, tt.status, tt.line, got)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestLoadCommandsFromDirectoryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid YAML", "name: [one\n"},
+		{"invalid default", "name: one\ncommand: [echo]\nflags:\n  - name: count\n    type: int\n    default: many\n"},
+		{"unknown output", "name: one\ncommand: [echo]\noutput: xml\n"},
+		{"neither a command nor an alias", "short: nothing\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(filepath.Join(dir, "one.yaml"), []byte(tt.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = LoadCommandsFromDirectory(dir)
+			if err == nil {
+				t.Errorf("expected one.yaml to be rejected")
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,314 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/types"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	websocketWriteTimeout = 10 * time.Second
+	// websocketProgressInterval is how often progress messages are sent while a command runs
+	websocketProgressInterval = time.Second
+)
+
+// WebSocketRequest is a message sent by the client over the command websocket.
+//
+// A "run" request starts the command with the given parameters, passed the same way
+// as in a JSON POST request. Command is the path of the command to run, and defaults to
+// the path of the websocket endpoint, which allows running different commands over the
+// same connection. ID identifies the run in all the messages sent back by the server.
+//
+// A "cancel" request cancels the run with the given ID.
+type WebSocketRequest struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Command    string                 `json:"command,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// WebSocketMessage is a message sent by the server over the command websocket.
+//
+// The type is one of:
+//   - "row", with a single output row of the command, which is always present
+//     even if empty
+//   - "progress", sent periodically with the number of rows output so far
+//   - "status", with Status "running" once the command started, and finally
+//     one of "done", "error" or "cancelled"
+//   - "error", when a request could not be handled at all
+//
+// Errors come with the same code and invalid parameters as the HTTP error responses, see HTTPError.
+type WebSocketMessage struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	Row        *types.MapRow     `json:"row,omitempty"`
+	Rows       *int              `json:"rows,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Code       string            `json:"code,omitempty"`
+	Parameters []*ParameterError `json:"parameters,omitempty"`
+	RetryAfter int               `json:"retry_after,omitempty"`
+}
+
+func (m *WebSocketMessage) setError(err error) {
+	e := toHTTPError(err)
+	m.Error = e.Message
+	m.Code = e.Code
+	m.Parameters = e.Parameters
+	m.RetryAfter = e.RetryAfter
+}
+
+// commandWebSocket handles a single websocket connection, on which multiple commands
+// can run concurrently.
+type commandWebSocket struct {
+	s    *Server
+	c    *gin.Context
+	conn *websocket.Conn
+	// path is the command path of the endpoint the client connected to
+	path string
+
+	writeMutex sync.Mutex
+
+	runsMutex sync.Mutex
+	runs      map[string]context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func (ws *commandWebSocket) write(msg *WebSocketMessage) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	err := ws.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if err != nil {
+		return err
+	}
+	return ws.conn.WriteJSON(msg)
+}
+
+func (ws *commandWebSocket) writeError(id string, err error) {
+	msg := &WebSocketMessage{Type: "error", ID: id}
+	msg.setError(err)
+	err_ := ws.write(msg)
+	if err_ != nil {
+		log.Debug().Err(err_).Msg("could not write websocket error")
+	}
+}
+
+func (ws *commandWebSocket) writeStatus(id string, status string, rows int, err error) {
+	msg := &WebSocketMessage{Type: "status", ID: id, Status: status, Rows: &rows}
+	if err != nil {
+		msg.setError(err)
+	}
+	err_ := ws.write(msg)
+	if err_ != nil {
+		log.Debug().Err(err_).Str("id", id).Msg("could not write websocket status")
+	}
+}
+
+// serve reads requests until the connection is closed, and then cancels all the
+// commands that are still running.
+func (ws *commandWebSocket) serve() {
+	ctx, cancel := context.WithCancel(ws.c.Request.Context())
+	defer func() {
+		cancel()
+		ws.wg.Wait()
+	}()
+
+	for {
+		req := &WebSocketRequest{}
+		err := ws.conn.ReadJSON(req)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug().Err(err).Msg("websocket closed")
+			}
+			// a malformed message leaves the connection in an unknown state, give up on it as well
+			return
+		}
+
+		switch req.Type {
+		case "run":
+			ws.run(ctx, req)
+		case "cancel":
+			ws.runsMutex.Lock()
+			cancelRun, ok := ws.runs[req.ID]
+			ws.runsMutex.Unlock()
+			if !ok {
+				ws.writeError(req.ID, fmt.Errorf("no running command with id '%s'", req.ID))
+				continue
+			}
+			cancelRun()
+		default:
+			ws.writeError(req.ID, fmt.Errorf("unknown message type '%s'", req.Type))
+		}
+	}
+}
+
+// run parses the parameters of a run request, and starts the command in the background.
+func (ws *commandWebSocket) run(ctx context.Context, req *WebSocketRequest) {
+	if req.ID == "" {
+		ws.writeError("", fmt.Errorf("missing id"))
+		return
+	}
+
+	path := req.Command
+	if path == "" {
+		path = ws.path
+	}
+	cmd, ok := ws.s.LookupCommand(path)
+	if !ok {
+		ws.writeStatus(req.ID, "error", 0, newUnknownCommandError(path))
+		return
+	}
+	description := cmd.Description()
+	err := ws.s.limitRate(ws.c, cmd)
+	if err != nil {
+		ws.writeStatus(req.ID, "error", 0, err)
+		return
+	}
+
+	values := req.Parameters
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	parsedLayers, ps, err := parseJSONCommandParameters(ws.s.Files, description, values)
+	if err != nil {
+		ws.writeStatus(req.ID, "error", 0, err)
+		return
+	}
+	err = ws.s.checkParameters(ws.c, cmd, ps)
+	if err != nil {
+		ws.writeStatus(req.ID, "error", 0, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	ws.runsMutex.Lock()
+	if _, ok := ws.runs[req.ID]; ok {
+		ws.runsMutex.Unlock()
+		cancel()
+		ws.writeError(req.ID, fmt.Errorf("a command with id '%s' is already running", req.ID))
+		return
+	}
+	ws.runs[req.ID] = cancel
+	ws.runsMutex.Unlock()
+
+	// the gin context is shared by all the runs of the connection, so each one gets its own copy
+	c := ws.c.Copy()
+	c.Request = ws.c.Request.WithContext(ctx)
+
+	rowCount := atomic.Int64{}
+	sof := NewStreamingOutputFormatter(func(row types.MapRow) error {
+		rowCount.Add(1)
+		return ws.write(&WebSocketMessage{Type: "row", ID: req.ID, Row: &row})
+	}, cancel)
+
+	ws.wg.Add(1)
+	go func() {
+		defer func() {
+			ws.runsMutex.Lock()
+			delete(ws.runs, req.ID)
+			ws.runsMutex.Unlock()
+			cancel()
+			ws.wg.Done()
+		}()
+
+		gp, err := NewGlazeProcessor(sof, parsedLayers)
+		if err != nil {
+			ws.writeStatus(req.ID, "error", 0, err)
+			return
+		}
+
+		ws.writeStatus(req.ID, "running", 0, nil)
+
+		done := make(chan struct{})
+		go ws.sendProgress(req.ID, &rowCount, done)
+
+		_, err = ws.s.runFromParka(c, cmd, parsedLayers, ps, gp)
+		if err == nil {
+			_, err = sof.Output()
+		}
+		close(done)
+
+		rows := sof.RowCount()
+		switch {
+		case sof.writeFailed:
+			log.Debug().Err(err).Str("id", req.ID).Msg("could not write websocket row")
+		case ctx.Err() != nil:
+			ws.writeStatus(req.ID, "cancelled", rows, nil)
+		case err != nil:
+			ws.writeStatus(req.ID, "error", rows, err)
+		default:
+			ws.writeStatus(req.ID, "done", rows, nil)
+		}
+	}()
+}
+
+// sendProgress periodically sends the number of rows output by a run, until done is closed.
+func (ws *commandWebSocket) sendProgress(id string, rowCount *atomic.Int64, done chan struct{}) {
+	ticker := time.NewTicker(websocketProgressInterval)
+	defer ticker.Stop()
+
+	lastCount := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			count := int(rowCount.Load())
+			if count == lastCount {
+				continue
+			}
+			lastCount = count
+			err := ws.write(&WebSocketMessage{Type: "progress", ID: id, Rows: &count})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveCommandWebSocket exposes the commands over a websocket at /ws/command/<parents>/<name>.
+// See WebSocketRequest and WebSocketMessage for the protocol.
+func (s *Server) serveCommandWebSocket() {
+	upgrader := websocket.Upgrader{}
+
+	s.Router.GET("/ws/command/*path", func(c *gin.Context) {
+		path := c.Param("path")
+		if path != "/" {
+			cmd, ok := s.LookupCommand(path)
+			if !ok {
+				writeError(c, newUnknownCommandError(path))
+				return
+			}
+			err := s.authorize(c, cmd, nil)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// the upgrader already responded with an error
+			log.Debug().Err(err).Msg("could not upgrade websocket")
+			return
+		}
+		defer conn.Close()
+
+		ws := &commandWebSocket{
+			s:    s,
+			c:    c,
+			conn: conn,
+			path: path,
+			runs: map[string]context.CancelFunc{},
+		}
+		ws.serve()
+	})
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-go-golems/glazed/pkg/cmds/parameters"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket connects to the command websocket of s at path.
+func dialWebSocket(t *testing.T, s *Server, path string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(s.Router)
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// readWebSocketMessages reads the messages sent for the run id until its final status,
+// decoded as maps so that the presence of the fields can be checked.
+func readWebSocketMessages(t *testing.T, conn *websocket.Conn, id string) []map[string]interface{} {
+	t.Helper()
+	messages := []map[string]interface{}{}
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := map[string]interface{}{}
+		err = conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg["id"] != id {
+			continue
+		}
+		messages = append(messages, msg)
+		if msg["type"] == "error" || (msg["type"] == "status" && msg["status"] != "running") {
+			return messages
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	rows := newTestCommand("rows", nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{{"a": 1}, {}}, nil
+	})
+	count := newEchoCommand("count", &parameters.ParameterDefinition{Name: "count", Type: parameters.ParameterTypeInteger})
+	s := newTestServer(t, WithCommands(rows, count))
+	conn := dialWebSocket(t, s, "/ws/command/rows")
+
+	tests := []struct {
+		name     string
+		request  WebSocketRequest
+		messages []map[string]interface{}
+	}{
+		{
+			name:    "rows",
+			request: WebSocketRequest{Type: "run", ID: "1"},
+			messages: []map[string]interface{}{
+				{"type": "status", "id": "1", "status": "running", "rows": float64(0)},
+				{"type": "row", "id": "1", "row": map[string]interface{}{"a": float64(1)}},
+				{"type": "row", "id": "1", "row": map[string]interface{}{}},
+				{"type": "status", "id": "1", "status": "done", "rows": float64(2)},
+			},
+		},
+		{
+			name:    "other command",
+			request: WebSocketRequest{Type: "run", ID: "2", Command: "count", Parameters: map[string]interface{}{"count": 3}},
+			messages: []map[string]interface{}{
+				{"type": "status", "id": "2", "status": "running", "rows": float64(0)},
+				{"type": "row", "id": "2", "row": map[string]interface{}{"count": float64(3)}},
+				{"type": "status", "id": "2", "status": "done", "rows": float64(1)},
+			},
+		},
+		{
+			name:    "unknown command",
+			request: WebSocketRequest{Type: "run", ID: "3", Command: "missing"},
+			messages: []map[string]interface{}{
+				{"type": "status", "id": "3", "status": "error", "rows": float64(0), "error": "unknown command 'missing'", "code": "unknown_command"},
+			},
+		},
+		{
+			name:    "unknown message type",
+			request: WebSocketRequest{Type: "pause", ID: "4"},
+			messages: []map[string]interface{}{
+				{"type": "error", "id": "4", "error": "unknown message type 'pause'", "code": "internal_server_error"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := conn.WriteJSON(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := readWebSocketMessages(t, conn, tt.request.ID)
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("expected the messages %v, got %v", tt.messages, messages)
+			}
+		})
+	}
+}
+
+func TestWebSocketCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	slow := newTestCommand("slow", nil, func(c *gin.Context, ps map[string]interface{}) ([]map[string]interface{}, error) {
+		started <- struct{}{}
+		<-c.Request.Context().Done()
+		return nil, c.Request.Context().Err()
+	})
+	s := newTestServer(t, WithCommands(slow))
+	conn := dialWebSocket(t, s, "/ws/command/slow")
+
+	err := conn.WriteJSON(WebSocketRequest{Type: "run", ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	err = conn.WriteJSON(WebSocketRequest{Type: "cancel", ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := readWebSocketMessages(t, conn, "1")
+	last := messages[len(messages)-1]
+	if last["status"] != "cancelled" {
+		t.Errorf("expected the run to be cancelled, got %v", messages)
+	}
+}